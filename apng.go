@@ -0,0 +1,152 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+	"github.com/Merovius/srvfb/internal/png"
+)
+
+// maxAPNGDuration and maxAPNGSize limit the duration and the size in bytes of
+// recordings, which are kept in memory until they are done. A recording
+// reaching maxAPNGSize ends early.
+const (
+	maxAPNGDuration = time.Hour
+	maxAPNGSize     = 64 << 20
+)
+
+// parseDuration parses the duration query parameter of r, which is required.
+func parseDuration(r *http.Request, max time.Duration) (time.Duration, error) {
+	s := r.URL.Query().Get("duration")
+	if s == "" {
+		return 0, fmt.Errorf("missing duration")
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 || d > max {
+		return 0, fmt.Errorf("invalid duration %q, want at most %v", s, max)
+	}
+	return d, nil
+}
+
+// endRecording handles an error of the subscription of a recording, which
+// ends it. recorded says whether any frames were recorded so far. It returns
+// whether those should still be served; otherwise it has responded to the
+// client already, if it is still there.
+func endRecording(w http.ResponseWriter, r *http.Request, err error, recorded bool) bool {
+	switch {
+	case err == context.DeadlineExceeded:
+		return true
+	case r.Context().Err() != nil:
+		return false
+	case !recorded:
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return false
+	default:
+		log.Printf("Capture failed, ending recording: %v", err)
+		return true
+	}
+}
+
+// serveAPNG records the screen for the given duration and serves the
+// recording as an animated PNG. Every frame only contains the region that
+// changed since the previous one.
+func (h *handler) serveAPNG(w http.ResponseWriter, r *http.Request) {
+	d, err := parseDuration(r, maxAPNGDuration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fps, err := parseFPS(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	sub := h.capture.subscribe(fps, t)
+	defer sub.close()
+
+	var (
+		a     = h.pngEncoder(png.BestSpeed).NewAnimation(w)
+		prev  *frame
+		start = time.Now()
+		// pending is the last frame, which is written once it is known
+		// how long it is shown.
+		pending     image.Image
+		pendingTime time.Time
+	)
+	for {
+		f, err := sub.next(ctx)
+		if err != nil {
+			if !endRecording(w, r, err, prev != nil) {
+				return
+			}
+			break
+		}
+		if prev != nil && f.im.Bounds() != prev.im.Bounds() {
+			log.Println("Screen size changed, ending recording")
+			break
+		}
+		rects := f.changes(prev)
+		if len(rects) == 0 {
+			continue
+		}
+		if pending != nil {
+			if err := a.WriteFrame(pending, f.time.Sub(pendingTime)); err != nil {
+				log.Println(err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			pendingTime = f.time
+		} else {
+			// The first frame is shown from the start of the recording.
+			pendingTime = start
+		}
+		pending = f.im.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(diff.Bounds(rects))
+		prev = f
+		if a.Len() >= maxAPNGSize {
+			log.Printf("Recording reached %d MiB, ending it", maxAPNGSize>>20)
+			break
+		}
+	}
+	if pending == nil {
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if err := a.WriteFrame(pending, time.Since(pendingTime)); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/apng")
+	w.Header().Set("Content-Disposition", `inline; filename="srvfb.apng"`)
+	if err := a.Close(); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/png"
+)
+
+// An archive stores the last frame of every page, when a pageDetector detects
+// a page turn. Pages are stored as PNG files in dir or, if it is empty, in
+// memory, where only the last max pages are kept.
+type archive struct {
+	dir      string
+	max      int
+	pageTurn float64
+	enc      *png.Encoder
+
+	mu sync.Mutex
+	// pages are the pages stored in memory, oldest first.
+	pages []archivedPage
+}
+
+type archivedPage struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	png  []byte
+}
+
+// run archives the pages captured by c. It never returns.
+func (a *archive) run(c *capture) {
+	d := &pageDetector{pageTurn: a.pageTurn}
+	c.follow(func(f *frame) error {
+		if f == nil {
+			*d = pageDetector{pageTurn: a.pageTurn}
+			return nil
+		}
+		if page := d.next(f); page != nil {
+			if err := a.add(page); err != nil {
+				log.Printf("Archiving page: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// A pageDetector detects page turns in a sequence of frames: A change of at
+// least the fraction pageTurn of the screen at once, after the page has been
+// drawn on.
+type pageDetector struct {
+	pageTurn float64
+	prev     *frame
+	// drawn is set, if the current page changed since it appeared.
+	drawn bool
+}
+
+// next returns the last frame of the previous page, if f turned the page.
+func (d *pageDetector) next(f *frame) *frame {
+	prev := d.prev
+	d.prev = f
+	if prev == nil {
+		return nil
+	}
+	if !d.turned(prev, f) {
+		d.drawn = true
+		return nil
+	}
+	if !d.drawn {
+		return nil
+	}
+	d.drawn = false
+	return prev
+}
+
+// turned returns whether f shows a different page than prev.
+func (d *pageDetector) turned(prev, f *frame) bool {
+	b := f.im.Bounds()
+	if prev.im.Bounds() != b {
+		return true
+	}
+	var changed int
+	for _, r := range f.changes(prev) {
+		changed += r.Dx() * r.Dy()
+	}
+	return float64(changed) >= d.pageTurn*float64(b.Dx()*b.Dy())
+}
+
+// add stores f as a page.
+func (a *archive) add(f *frame) error {
+	buf := new(bytes.Buffer)
+	if err := a.enc.Encode(buf, f.im); err != nil {
+		return err
+	}
+	p := archivedPage{
+		Name: f.time.Format("page-20060102-150405.000.png"),
+		Time: f.time,
+	}
+	log.Printf("Page turn detected, archiving %s", p.Name)
+	if a.dir != "" {
+		return os.WriteFile(filepath.Join(a.dir, p.Name), buf.Bytes(), 0644)
+	}
+	p.png = buf.Bytes()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pages = append(a.pages, p)
+	if n := len(a.pages) - a.max; n > 0 {
+		log.Printf("Archive full, dropping %s", a.pages[0].Name)
+		copy(a.pages, a.pages[n:])
+		for i := len(a.pages) - n; i < len(a.pages); i++ {
+			a.pages[i] = archivedPage{}
+		}
+		a.pages = a.pages[:len(a.pages)-n]
+	}
+	return nil
+}
+
+// list returns all archived pages, oldest first. Pages stored in a directory
+// are read back, including those archived by earlier runs.
+func (a *archive) list() ([]archivedPage, error) {
+	if a.dir == "" {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return append([]archivedPage(nil), a.pages...), nil
+	}
+	des, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var pages []archivedPage
+	for _, de := range des {
+		if !isPageName(de.Name()) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			// The page was removed in the meantime.
+			continue
+		}
+		pages = append(pages, archivedPage{Name: fi.Name(), Time: fi.ModTime()})
+	}
+	// Names sort by the time of their page.
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Name < pages[j].Name })
+	return pages, nil
+}
+
+// get returns the PNG of the archived page with the given name.
+func (a *archive) get(name string) ([]byte, error) {
+	if !isPageName(name) {
+		return nil, os.ErrNotExist
+	}
+	if a.dir != "" {
+		return os.ReadFile(filepath.Join(a.dir, name))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, p := range a.pages {
+		if p.Name == name {
+			return p.png, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// isPageName returns whether name is the file name of an archived page.
+func isPageName(name string) bool {
+	return strings.HasPrefix(name, "page-") && strings.HasSuffix(name, ".png") && !strings.ContainsAny(name, `/\`)
+}
+
+// serveArchive serves the list of archived pages as JSON under /archive and
+// the pages under /archive/<name>.
+func (h *handler) serveArchive(w http.ResponseWriter, r *http.Request) {
+	if h.archive == nil {
+		http.Error(w, "archive disabled, use -archive", http.StatusNotFound)
+		return
+	}
+	if r.URL.Path == "/archive" {
+		pages, err := h.archive.list()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if pages == nil {
+			pages = []archivedPage{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pages)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/archive/")
+	b, err := h.archive.get(name)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("page %q not found", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(b)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+)
+
+func TestPageDetector(t *testing.T) {
+	// Strokes change a single tile of the 256x256 screen, turning the page
+	// changes all of it.
+	stroke := func(m *image.Gray, x, y int) {
+		for i := 0; i < 10; i++ {
+			m.Pix[m.PixOffset(x+i, y+i)] ^= 0xff
+		}
+	}
+	fill := func(m *image.Gray, v uint8) {
+		for i := range m.Pix {
+			m.Pix[i] = v
+		}
+	}
+	steps := []struct {
+		name string
+		draw func(m *image.Gray) *image.Gray
+		// skip is the number of frames missed before this one.
+		skip uint64
+		// want is the index of the step returned by next, or -1.
+		want int
+	}{
+		{"first", func(m *image.Gray) *image.Gray { return m }, 0, -1},
+		{"stroke", func(m *image.Gray) *image.Gray { stroke(m, 5, 5); return m }, 0, -1},
+		{"stroke", func(m *image.Gray) *image.Gray { stroke(m, 100, 40); return m }, 0, -1},
+		{"turn", func(m *image.Gray) *image.Gray { fill(m, 0x10); return m }, 0, 2},
+		{"blank turn", func(m *image.Gray) *image.Gray { fill(m, 0x20); return m }, 0, -1},
+		{"stroke", func(m *image.Gray) *image.Gray { stroke(m, 200, 200); return m }, 0, -1},
+		{"resize", func(*image.Gray) *image.Gray { return image.NewGray(image.Rect(0, 0, 256, 128)) }, 0, 5},
+		{"stroke", func(m *image.Gray) *image.Gray { stroke(m, 50, 50); return m }, 0, -1},
+		{"skipped stroke", func(m *image.Gray) *image.Gray { stroke(m, 150, 50); return m }, 2, -1},
+		{"turn half", func(m *image.Gray) *image.Gray {
+			for i := range m.Pix[:len(m.Pix)/2] {
+				m.Pix[i] ^= 0x80
+			}
+			return m
+		}, 0, 8},
+		{"less than half", func(m *image.Gray) *image.Gray {
+			for i := range m.Pix[:len(m.Pix)/2-m.Stride*diff.TileSize] {
+				m.Pix[i] ^= 0x80
+			}
+			return m
+		}, 0, -1},
+		{"skipped turn", func(m *image.Gray) *image.Gray { fill(m, 0x30); return m }, 5, 10},
+	}
+
+	d := &pageDetector{pageTurn: 0.5}
+	var (
+		frames []*frame
+		prev   *image.Gray
+		seq    uint64
+	)
+	for i, s := range steps {
+		var im *image.Gray
+		if prev == nil {
+			im = image.NewGray(image.Rect(0, 0, 256, 256))
+		} else {
+			// Every frame gets its own image, as frames are kept by
+			// the detector.
+			im = image.NewGray(prev.Rect)
+			copy(im.Pix, prev.Pix)
+		}
+		im = s.draw(im)
+		seq += 1 + s.skip
+		f := &frame{seq: seq, time: time.Unix(int64(i), 0), im: im}
+		if s.skip == 0 {
+			var previm image.Image
+			if prev != nil {
+				previm = prev
+			}
+			f.dirty = diff.Changed(previm, im, diff.TileSize)
+		} else {
+			// The changes since the missed frame are unknown to the
+			// detector, so it has to compute them.
+			f.dirty = []image.Rectangle{image.Rect(0, 0, 1, 1)}
+		}
+		frames = append(frames, f)
+		prev = im
+
+		got := d.next(f)
+		var want *frame
+		if s.want >= 0 {
+			want = frames[s.want]
+		}
+		if got != want {
+			gotIdx := -1
+			for j := range frames {
+				if frames[j] == got {
+					gotIdx = j
+				}
+			}
+			t.Errorf("step %d (%s): next() returns step %d, want %d", i, s.name, gotIdx, s.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+)
+
+// A frame is a single image captured from a source. Frames are shared between
+// all viewers, so they must not be modified.
+//
+// Frames taken from a framePool are reference counted, so their images can be
+// reused. Whoever receives such a frame holds a reference and should release
+// it once the frame isn't used anymore. Frames that are never released are
+// simply garbage collected.
+type frame struct {
+	// seq is incremented for every captured frame.
+	seq uint64
+	// time is the time the frame was captured.
+	time time.Time
+	im   image.Image
+	// dirty are the regions of im that changed since the previous frame.
+	dirty []image.Rectangle
+
+	refs int32
+	pool *framePool
+}
+
+// hold adds a reference to f.
+func (f *frame) hold() {
+	if f.pool != nil {
+		atomic.AddInt32(&f.refs, 1)
+	}
+}
+
+// release drops a reference to f, which may be nil. The last one returns f
+// to its pool.
+func (f *frame) release() {
+	if f != nil && f.pool != nil && atomic.AddInt32(&f.refs, -1) == 0 {
+		f.pool.put(f)
+	}
+}
+
+// maxPooledFrames is the number of released frames kept by a framePool.
+const maxPooledFrames = 2
+
+// A framePool keeps released frames, so their buffers can be reused.
+type framePool struct {
+	mu    sync.Mutex
+	free  [maxPooledFrames]*frame
+	nfree int
+}
+
+// get returns a released frame, or a new one with a nil image, holding a
+// single reference.
+func (p *framePool) get() *frame {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.nfree == 0 {
+		return &frame{refs: 1, pool: p}
+	}
+	p.nfree--
+	f := p.free[p.nfree]
+	p.free[p.nfree] = nil
+	f.refs = 1
+	return f
+}
+
+func (p *framePool) put(f *frame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.nfree < len(p.free) {
+		p.free[p.nfree] = f
+		p.nfree++
+	}
+}
+
+// changes returns the regions of f that changed since the frame prev, which
+// may be nil.
+func (f *frame) changes(prev *frame) []image.Rectangle {
+	if prev == nil {
+		return []image.Rectangle{f.im.Bounds()}
+	}
+	if prev.seq == f.seq-1 {
+		return f.dirty
+	}
+	if prev.seq == f.seq {
+		return nil
+	}
+	return diff.Changed(prev.im, f.im, diff.TileSize)
+}
+
+// capture reads frames from a source in a single loop and publishes them to
+// all subscribers. The loop only runs while there are subscribers, and only
+// frames that differ from their predecessor are published.
+//
+// Polled streams are read at most once per minInterval. While the screen is
+// static, the poll interval is doubled up to maxPoll, snapping back to
+// minInterval as soon as a change is detected.
+type capture struct {
+	src         source
+	minInterval time.Duration
+	maxPoll     time.Duration
+
+	// pool holds the frames of the capture loop.
+	pool framePool
+
+	mu sync.Mutex
+	// subs are the current subscribers, which are woken up whenever
+	// latest or err changes.
+	subs    map[*subscription]bool
+	running bool
+	// gen identifies the running loop. It is incremented whenever a loop
+	// is started, so a stopped loop can't affect its successors.
+	gen uint64
+	// stream is the stream read by the running loop, once it is opened.
+	stream stream
+	seq    uint64
+	latest *frame
+	err    error
+}
+
+func newCapture(src source, minInterval, maxPoll time.Duration) *capture {
+	if maxPoll < minInterval {
+		maxPoll = minInterval
+	}
+	return &capture{
+		src:         src,
+		minInterval: minInterval,
+		maxPoll:     maxPoll,
+		subs:        make(map[*subscription]bool),
+	}
+}
+
+// interval returns the minimum interval between frames for the given frame
+// rate. A rate of 0 means no limit.
+func interval(fps float64) time.Duration {
+	if fps <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / fps)
+}
+
+// subscribe registers a new viewer, starting the capture loop if necessary.
+// The subscriber receives at most one frame per minInterval (and at most one
+// frame per c.minInterval in any case), with t applied. The returned
+// subscription must be closed after use.
+func (c *capture) subscribe(minInterval time.Duration, t transform) *subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		c.running = true
+		c.gen++
+		c.latest, c.err = nil, nil
+		go c.run(c.gen)
+	}
+	if minInterval < c.minInterval {
+		minInterval = c.minInterval
+	}
+	s := &subscription{c: c, minInterval: minInterval, t: t, wake: make(chan struct{}, 1)}
+	c.subs[s] = true
+	return s
+}
+
+func (c *capture) run(gen uint64) {
+	s, err := c.src.open()
+	if err != nil {
+		c.stop(gen, err)
+		return
+	}
+	defer s.close()
+	if !c.attach(gen, s) {
+		return
+	}
+
+	var (
+		// cur is the frame read next. prev is the last published frame,
+		// which the loop holds until the next one is published.
+		cur   = c.pool.get()
+		prev  *frame
+		delay = c.minInterval
+		t     = time.NewTimer(0)
+	)
+	defer t.Stop()
+	for {
+		<-t.C
+		start := time.Now()
+		if cur.im, err = s.readImage(cur.im); err != nil {
+			c.stop(gen, err)
+			return
+		}
+		var previm image.Image
+		if prev != nil {
+			previm = prev.im
+		}
+		if cur.dirty = diff.AppendChanged(cur.dirty[:0], previm, cur.im, diff.TileSize); len(cur.dirty) > 0 {
+			cur.time = start
+			c.publish(cur)
+			// The published frame is shared now, so we need another
+			// one, which is the previous one, once all subscribers
+			// released it.
+			prev.release()
+			prev, cur = cur, c.pool.get()
+			delay = c.minInterval
+		} else if delay < c.maxPoll {
+			delay = 2*delay + time.Millisecond
+			if delay > c.maxPoll {
+				delay = c.maxPoll
+			}
+		}
+		if c.idle(gen) {
+			return
+		}
+		if s.polled() {
+			t.Reset(time.Until(start.Add(delay)))
+		} else {
+			t.Reset(0)
+		}
+	}
+}
+
+// publish publishes f to all subscribers, assigning its sequence number.
+func (c *capture) publish(f *frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	f.seq = c.seq
+	c.latest = f
+	c.wake()
+}
+
+// wake wakes up all subscribers. It must be called with c.mu held.
+func (c *capture) wake() {
+	for s := range c.subs {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// attach registers s as the stream of the loop gen. It returns false, if the
+// loop was stopped in the meantime.
+func (c *capture) attach(gen uint64, s stream) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || !c.running {
+		return false
+	}
+	c.stream = s
+	return true
+}
+
+// stop stops the capture loop gen with the given error. Errors of a loop
+// stopped by its last subscriber leaving are caused by closing its stream, so
+// they are ignored.
+func (c *capture) stop(gen uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || !c.running {
+		return
+	}
+	log.Println(err)
+	c.running = false
+	c.stream = nil
+	c.err = err
+	c.wake()
+}
+
+// idle stops the capture loop gen, if there are no subscribers left. It also
+// returns true, if the loop was already stopped.
+func (c *capture) idle(gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || !c.running {
+		return true
+	}
+	if len(c.subs) > 0 {
+		return false
+	}
+	c.running = false
+	c.stream = nil
+	return true
+}
+
+// follow calls fn with every frame captured by c, until it returns an error,
+// keeping the capture loop running. The loop stops if reading the source
+// fails, so follow subscribes again after a second, calling fn with nil first
+// to signal the gap. fn holds a reference to the frames it is called with.
+func (c *capture) follow(fn func(*frame) error) error {
+	for {
+		sub := c.subscribe(0, transform{})
+		for {
+			f, err := sub.next(context.Background())
+			if err != nil {
+				break
+			}
+			if err = fn(f); err != nil {
+				sub.close()
+				return err
+			}
+		}
+		sub.close()
+		time.Sleep(time.Second)
+		if err := fn(nil); err != nil {
+			return err
+		}
+	}
+}
+
+// A subscription receives the frames published by a capture.
+type subscription struct {
+	c           *capture
+	seq         uint64
+	minInterval time.Duration
+	last        time.Time
+	// wake receives a value whenever the capture publishes a frame or
+	// fails.
+	wake chan struct{}
+	// timer is used for waiting in next, created on first use.
+	timer *time.Timer
+	// t is applied to all frames returned by next.
+	t transform
+	// prev is the last frame returned by next, if t is not the identity,
+	// pool holds the frames with transformed images and tmp is the
+	// intermediate image of t.
+	prev *frame
+	pool framePool
+	tmp  image.Image
+}
+
+// next returns the latest frame, blocking until it is newer than the frame
+// previously returned and the minimum interval since then has passed.
+// Intermediate frames are dropped, if the subscriber is too slow. The caller
+// holds a reference to the returned frame.
+//
+// If the subscription has a transform, the returned frames are transformed
+// copies of the captured ones, with the same sequence numbers. Frames that
+// don't change after the transformation are skipped. If the transform crops
+// the whole frame, the first frame is returned with an empty image.
+func (s *subscription) next(ctx context.Context) (*frame, error) {
+	return s.nextBefore(ctx, time.Time{})
+}
+
+// nextTimeout is like next, but returns context.DeadlineExceeded, if there is
+// no new frame within d. Unlike with a context, no timer is allocated.
+func (s *subscription) nextTimeout(ctx context.Context, d time.Duration) (*frame, error) {
+	return s.nextBefore(ctx, time.Now().Add(d))
+}
+
+// nextBefore is like next, but gives up at the deadline, unless it is zero.
+func (s *subscription) nextBefore(ctx context.Context, deadline time.Time) (*frame, error) {
+	if s.t.identity() {
+		return s.nextCaptured(ctx, deadline)
+	}
+	for {
+		f, err := s.nextCaptured(ctx, deadline)
+		if err != nil {
+			return nil, err
+		}
+		tf := s.pool.get()
+		tf.seq, tf.time = f.seq, f.time
+		tf.im = s.t.apply(tf.im, f.im, &s.tmp)
+		f.release()
+		var previm image.Image
+		if s.prev != nil {
+			previm = s.prev.im
+		}
+		if tf.dirty = diff.AppendChanged(tf.dirty[:0], previm, tf.im, diff.TileSize); len(tf.dirty) > 0 || s.prev == nil {
+			// The subscription keeps its reference to compare the
+			// next frame against.
+			s.prev.release()
+			s.prev = tf
+			tf.hold()
+			return tf, nil
+		}
+		tf.release()
+	}
+}
+
+// nextCaptured is like nextBefore, but ignores the transform.
+func (s *subscription) nextCaptured(ctx context.Context, deadline time.Time) (*frame, error) {
+	if start := s.last.Add(s.minInterval); time.Now().Before(start) {
+		timeout := !deadline.IsZero() && deadline.Before(start)
+		if timeout {
+			start = deadline
+		}
+		select {
+		case <-s.after(time.Until(start)):
+			if timeout {
+				return nil, context.DeadlineExceeded
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = s.after(time.Until(deadline))
+	}
+	for {
+		s.c.mu.Lock()
+		f, err := s.c.latest, s.c.err
+		if f != nil && f.seq > s.seq {
+			// The capture holds f while it is the latest frame, so
+			// it can't be released in the meantime.
+			f.hold()
+			s.c.mu.Unlock()
+			s.seq = f.seq
+			s.last = time.Now()
+			return f, nil
+		}
+		s.c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-s.wake:
+		case <-timeout:
+			return nil, context.DeadlineExceeded
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// after returns a channel receiving the time after d, reusing s.timer.
+func (s *subscription) after(d time.Duration) <-chan time.Time {
+	if s.timer == nil {
+		s.timer = time.NewTimer(d)
+		return s.timer.C
+	}
+	if !s.timer.Stop() {
+		select {
+		case <-s.timer.C:
+		default:
+		}
+	}
+	s.timer.Reset(d)
+	return s.timer.C
+}
+
+func (s *subscription) close() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.prev.release()
+	s.prev = nil
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	delete(s.c.subs, s)
+	if len(s.c.subs) > 0 || !s.c.running {
+		return
+	}
+	// Streams, which aren't polled, block until the next frame, which may
+	// take arbitrarily long. Stop the loop right away and close its stream
+	// to unblock it, so e.g. an upstream srvfb can go idle.
+	s.c.running = false
+	if s.c.stream != nil {
+		s.c.stream.close()
+		s.c.stream = nil
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionCropOutside(t *testing.T) {
+	c := newCapture(patternSource{image.Rect(0, 0, 64, 64)}, 0, 10*time.Millisecond)
+	sub := c.subscribe(0, transform{crop: image.Rect(5000, 5000, 5010, 5010)})
+	defer sub.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := sub.next(ctx)
+	if err != nil {
+		t.Fatalf("next() = %v, want the first frame", err)
+	}
+	if b := f.im.Bounds(); !b.Empty() {
+		t.Errorf("next() returned frame with bounds %v, want an empty image", b)
+	}
+}
+
+// testSource is a polled source, whose frames are filled with the value last
+// passed to set.
+type testSource struct {
+	mu     sync.Mutex
+	v      uint8
+	opened int
+	closed int
+}
+
+func (s *testSource) set(v uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.v = v
+}
+
+// counts returns the number of streams opened and closed.
+func (s *testSource) counts() (opened, closed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opened, s.closed
+}
+
+func (s *testSource) open() (stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opened++
+	return testStream{s}, nil
+}
+
+type testStream struct {
+	src *testSource
+}
+
+func (s testStream) readImage(im image.Image) (image.Image, error) {
+	m, _ := im.(*image.Gray)
+	if m == nil {
+		m = image.NewGray(image.Rect(0, 0, 16, 16))
+	}
+	s.src.mu.Lock()
+	v := s.src.v
+	s.src.mu.Unlock()
+	for i := range m.Pix {
+		m.Pix[i] = v
+	}
+	return m, nil
+}
+
+func (s testStream) polled() bool {
+	return true
+}
+
+func (s testStream) close() error {
+	s.src.mu.Lock()
+	defer s.src.mu.Unlock()
+	s.src.closed++
+	return nil
+}
+
+// waitFor returns the first frame of sub filled with v.
+func waitFor(t *testing.T, sub *subscription, v uint8) *frame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		f, err := sub.next(ctx)
+		if err != nil {
+			t.Fatalf("waiting for a frame filled with %d: %v", v, err)
+		}
+		if f.im.(*image.Gray).Pix[0] == v {
+			return f
+		}
+	}
+}
+
+func TestCaptureSubscribers(t *testing.T) {
+	src := new(testSource)
+	c := newCapture(src, 0, 10*time.Millisecond)
+
+	subs := []*subscription{c.subscribe(0, transform{}), c.subscribe(0, transform{})}
+	var last *frame
+	for _, v := range []uint8{1, 2} {
+		src.set(v)
+		f0, f1 := waitFor(t, subs[0], v), waitFor(t, subs[1], v)
+		if f0 != f1 {
+			t.Errorf("subscribers got different frames %d and %d for the same screen", f0.seq, f1.seq)
+		}
+		last = f0
+	}
+	if opened, _ := src.counts(); opened != 1 {
+		t.Errorf("%d streams opened for two subscribers, want 1", opened)
+	}
+
+	// The stream stays open until the last subscriber leaves.
+	subs[0].close()
+	if _, closed := src.counts(); closed != 0 {
+		t.Fatalf("stream closed with a subscriber left")
+	}
+	subs[1].close()
+	if _, closed := src.counts(); closed != 1 {
+		t.Fatalf("%d streams closed after the last subscriber left, want 1", closed)
+	}
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+	if running {
+		t.Fatal("capture loop still running without subscribers")
+	}
+
+	// A new subscriber restarts the loop and doesn't get stale frames.
+	src.set(3)
+	sub := c.subscribe(0, transform{})
+	defer sub.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := sub.next(ctx)
+	if err != nil {
+		t.Fatalf("next() after restart = %v", err)
+	}
+	if v := f.im.(*image.Gray).Pix[0]; v != 3 {
+		t.Errorf("first frame after restart filled with %d, want 3", v)
+	}
+	if f.seq <= last.seq {
+		t.Errorf("first frame after restart has sequence number %d, want more than %d", f.seq, last.seq)
+	}
+	if opened, _ := src.counts(); opened != 2 {
+		t.Errorf("%d streams opened after restart, want 2", opened)
+	}
+}
+
+func TestFrameRecycling(t *testing.T) {
+	tcs := []struct {
+		name string
+		t    transform
+	}{
+		{"captured", transform{}},
+		{"transformed", transform{rotate: 180}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			src := new(testSource)
+			c := newCapture(src, 0, time.Millisecond)
+			sub := c.subscribe(0, tc.t)
+			defer sub.close()
+
+			src.set(1)
+			held := waitFor(t, sub, 1)
+			// The images of released frames are reused.
+			images := make(map[*uint8]bool)
+			for v := uint8(2); v < 20; v++ {
+				src.set(v)
+				f := waitFor(t, sub, v)
+				images[&f.im.(*image.Gray).Pix[0]] = true
+				f.release()
+			}
+			if n := len(images); n > maxPooledFrames+2 {
+				t.Errorf("%d images for 18 released frames, want at most %d", n, maxPooledFrames+2)
+			}
+			// The image of a held frame isn't.
+			if v := held.im.(*image.Gray).Pix[0]; v != 1 || images[&held.im.(*image.Gray).Pix[0]] {
+				t.Errorf("held frame was reused")
+			}
+			held.release()
+		})
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+)
+
+const (
+	// gifDepth is the number of bits per pixel of GIFs, giving the 16 gray
+	// levels of the reMarkable.
+	gifDepth = 4
+	// gifMinDelay is the shortest delay between frames. Browsers show
+	// frames with shorter delays for a tenth of a second instead.
+	gifMinDelay = 20 * time.Millisecond
+	// gifHold is the minimum time the last frame is shown, before the
+	// animation starts over.
+	gifHold = time.Second
+)
+
+// gifWriter collects the frames of an animated GIF. Every frame only contains
+// the region that changed since the previous one.
+//
+// Frames are shown with their original timing sped up by speed or, if delay
+// is set, for delay each. Frames following each other too closely are merged.
+type gifWriter struct {
+	speed float64
+	delay time.Duration
+
+	g gif.GIF
+	// shown is the content of the screen after the last frame of g.
+	shown *image.Paletted
+	// pending is the latest frame, which is added to g once it is known
+	// how long it is shown, and pendingTime when it was captured.
+	pending     *image.Paletted
+	pendingTime time.Time
+}
+
+// add adds the frame image im, captured at t. It fails if the size of the
+// screen changed.
+func (gw *gifWriter) add(im image.Image, t time.Time) error {
+	if gw.pending != nil && im.Bounds() != gw.pending.Bounds() {
+		return errors.New("screen size changed")
+	}
+	cur := reduceDepth(nil, im, gifDepth).(*image.Paletted)
+	if gw.pending == nil {
+		gw.pending, gw.pendingTime = cur, t
+		return nil
+	}
+	if d := gw.frameDelay(t.Sub(gw.pendingTime)); d >= gifMinDelay {
+		gw.flush(d)
+		gw.pendingTime = t
+	}
+	// Otherwise, cur replaces the pending frame and is shown from its
+	// time on.
+	gw.pending = cur
+	return nil
+}
+
+// frameDelay returns how long a frame captured d before the next one is
+// shown.
+func (gw *gifWriter) frameDelay(d time.Duration) time.Duration {
+	if gw.delay > 0 {
+		return gw.delay
+	}
+	return time.Duration(float64(d) / gw.speed)
+}
+
+// flush adds the pending frame to g, shown for the given delay.
+func (gw *gifWriter) flush(delay time.Duration) {
+	cs := int((delay + 5*time.Millisecond) / (10 * time.Millisecond))
+	if cs > 0xffff {
+		cs = 0xffff
+	}
+	r := gw.pending.Rect
+	if gw.shown != nil {
+		r = diff.Bounds(diff.Changed(gw.shown, gw.pending, diff.TileSize))
+	}
+	if r.Empty() {
+		// Nothing visible changed, so the previous frame is shown
+		// longer.
+		if n := len(gw.g.Delay); n > 0 && gw.g.Delay[n-1]+cs <= 0xffff {
+			gw.g.Delay[n-1] += cs
+		}
+		return
+	}
+	m := image.NewPaletted(r, gw.pending.Palette)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(m.Pix[m.PixOffset(r.Min.X, y):], gw.pending.Pix[gw.pending.PixOffset(r.Min.X, y):gw.pending.PixOffset(r.Max.X, y)])
+	}
+	gw.g.Image = append(gw.g.Image, m)
+	gw.g.Delay = append(gw.g.Delay, cs)
+	gw.g.Disposal = append(gw.g.Disposal, gif.DisposalNone)
+	gw.shown = gw.pending
+}
+
+// encode adds the pending frame, shown until end, and writes the GIF to w.
+func (gw *gifWriter) encode(w io.Writer, end time.Time) error {
+	if gw.pending == nil {
+		return errors.New("no frames")
+	}
+	d := gw.frameDelay(end.Sub(gw.pendingTime))
+	if d < gifHold {
+		d = gifHold
+	}
+	gw.flush(d)
+	gw.g.Config = image.Config{
+		ColorModel: gw.pending.Palette,
+		Width:      gw.pending.Rect.Dx(),
+		Height:     gw.pending.Rect.Dy(),
+	}
+	return gif.EncodeAll(w, &gw.g)
+}
+
+// parseGIFTiming parses the speed and delay query parameters of r.
+func parseGIFTiming(r *http.Request) (speed float64, delay time.Duration, err error) {
+	q := r.URL.Query()
+	speed = 1
+	if s := q.Get("speed"); s != "" {
+		if speed, err = strconv.ParseFloat(s, 64); err != nil || speed <= 0 {
+			return 0, 0, fmt.Errorf("invalid speed %q", s)
+		}
+	}
+	if s := q.Get("delay"); s != "" {
+		if delay, err = time.ParseDuration(s); err != nil || delay < gifMinDelay {
+			return 0, 0, fmt.Errorf("invalid delay %q, want at least %v", s, gifMinDelay)
+		}
+	}
+	return speed, delay, nil
+}
+
+// serveGIF records the screen for the given duration and serves the
+// recording as an animated GIF.
+func (h *handler) serveGIF(w http.ResponseWriter, r *http.Request) {
+	d, err := parseDuration(r, maxAPNGDuration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	speed, delay, err := parseGIFTiming(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fps, err := parseFPS(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Changes invisible in the GIF are skipped right away.
+	t.depth = gifDepth
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	sub := h.capture.subscribe(fps, t)
+	defer sub.close()
+
+	gw := &gifWriter{speed: speed, delay: delay}
+	start := time.Now()
+	for {
+		f, err := sub.next(ctx)
+		if err != nil {
+			if !endRecording(w, r, err, gw.pending != nil) {
+				return
+			}
+			break
+		}
+		ft := f.time
+		if gw.pending == nil {
+			// The first frame is shown from the start of the recording.
+			ft = start
+		}
+		if err = gw.add(f.im, ft); err != nil {
+			log.Printf("%v, ending recording", err)
+			break
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := gw.encode(buf, time.Now()); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Disposition", `inline; filename="srvfb.gif"`)
+	w.Write(buf.Bytes())
+}
+
+// errGIFDone stops reading a recording, once the end of the requested span
+// is reached.
+var errGIFDone = errors.New("done")
+
+// runGIF implements the gif subcommand, which converts a span of a recording
+// into an animated GIF.
+func runGIF(args []string) error {
+	fs := flag.NewFlagSet("gif", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Factor to speed up the playback by")
+	delay := fs.Duration("delay", 0, "Show every frame for this long instead of with its original timing")
+	start := fs.Duration("start", 0, "Offset into the recording to start at")
+	duration := fs.Duration("duration", 0, "Duration of the span to convert. 0 converts everything after -start")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: srvfb gif [<flags>] <output> <recording>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("missing output or recording")
+	}
+	if *speed <= 0 || (*delay != 0 && *delay < gifMinDelay) || *start < 0 || *duration < 0 {
+		return fmt.Errorf("-speed must be positive, -delay at least %v and -start and -duration not negative", gifMinDelay)
+	}
+
+	gw := &gifWriter{speed: *speed, delay: *delay}
+	var (
+		from, to time.Time
+		// last is the last frame before the span.
+		last *frame
+		end  time.Time
+	)
+	err := readRecording(fs.Arg(1), func(f *frame) error {
+		if from.IsZero() {
+			from = f.time.Add(*start)
+			if *duration > 0 {
+				to = from.Add(*duration)
+			}
+		}
+		if f.time.Before(from) {
+			last = f
+			return nil
+		}
+		if !to.IsZero() && f.time.After(to) {
+			return errGIFDone
+		}
+		if last != nil {
+			if err := gw.add(last.im, from); err != nil {
+				return err
+			}
+			last = nil
+		}
+		end = f.time
+		return gw.add(f.im, f.time)
+	})
+	if err != nil && err != errGIFDone {
+		return err
+	}
+	if last != nil {
+		// The span starts after the last frame.
+		if err = gw.add(last.im, from); err != nil {
+			return err
+		}
+	}
+	if !to.IsZero() {
+		end = to
+	}
+
+	out, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err = gw.encode(out, end); err != nil {
+		return err
+	}
+	return out.Close()
+}
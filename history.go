@@ -0,0 +1,254 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/png"
+)
+
+// A history keeps the recently captured frames in memory, compressed like the
+// records of a recording. When it grows beyond max bytes, the oldest frames
+// are dropped, a keyframe and the frames depending on it at a time.
+type history struct {
+	max int
+	// rw encodes the frames. It is only used by run.
+	rw recordWriter
+
+	mu      sync.Mutex
+	entries []historyEntry
+	// size is the total length of the data of entries.
+	size int
+	// first is the number of entries[0]. Frames are numbered consecutively
+	// from the start, so numbers stay valid until the frame is dropped.
+	first uint64
+}
+
+type historyEntry struct {
+	time time.Time
+	key  bool
+	data []byte
+}
+
+// historyFrame is an element of the list served under /history.
+type historyFrame struct {
+	N    uint64    `json:"n"`
+	Time time.Time `json:"time"`
+}
+
+// run adds the frames captured by c to the history. It never returns.
+func (h *history) run(c *capture) {
+	c.follow(func(f *frame) error {
+		if f == nil {
+			// The next frame after a gap is stored as a keyframe.
+			h.rw.reset()
+			return nil
+		}
+		if err := h.add(f); err != nil {
+			log.Printf("Adding frame to history: %v", err)
+			h.rw.reset()
+		}
+		return nil
+	})
+}
+
+// add appends f to the history and drops the oldest frames, if it is full.
+func (h *history) add(f *frame) error {
+	key, data, err := h.rw.encodeFrame(f)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, historyEntry{f.time, key, append([]byte(nil), data...)})
+	h.size += len(data)
+	for h.size > h.max {
+		// Frames can only be dropped together with all frames depending
+		// on them, i.e. up to the next keyframe.
+		i := 1
+		for i < len(h.entries) && !h.entries[i].key {
+			i++
+		}
+		if i == len(h.entries) {
+			// The history only contains a single keyframe. Start a new
+			// one, so the current one can be dropped next time.
+			h.rw.reset()
+			break
+		}
+		for _, e := range h.entries[:i] {
+			h.size -= len(e.data)
+		}
+		n := copy(h.entries, h.entries[i:])
+		for j := n; j < len(h.entries); j++ {
+			h.entries[j] = historyEntry{}
+		}
+		h.entries = h.entries[:n]
+		h.first += uint64(i)
+	}
+	return nil
+}
+
+// list returns the numbers and times of all frames in the history, oldest
+// first.
+func (h *history) list() []historyFrame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := make([]historyFrame, len(h.entries))
+	for i, e := range h.entries {
+		l[i] = historyFrame{h.first + uint64(i), e.time}
+	}
+	return l
+}
+
+// at returns the number of the last frame captured at or before t.
+func (h *history) at(t time.Time) (uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.Search(len(h.entries), func(i int) bool { return h.entries[i].time.After(t) })
+	if i == 0 {
+		return 0, os.ErrNotExist
+	}
+	return h.first + uint64(i-1), nil
+}
+
+// get returns frame n, by decoding it and the frames it depends on.
+func (h *history) get(n uint64) (*frame, error) {
+	h.mu.Lock()
+	if n < h.first || n-h.first >= uint64(len(h.entries)) {
+		h.mu.Unlock()
+		return nil, os.ErrNotExist
+	}
+	i := int(n - h.first)
+	k := i
+	for !h.entries[k].key {
+		k--
+	}
+	// The data of entries is never modified, so it can be decoded without
+	// holding the lock.
+	entries := append([]historyEntry(nil), h.entries[k:i+1]...)
+	h.mu.Unlock()
+
+	var (
+		im  image.Image
+		zr  io.ReadCloser
+		buf []byte
+		err error
+	)
+	for _, e := range entries {
+		r := bytes.NewReader(e.data)
+		if zr == nil {
+			zr, err = zlib.NewReader(r)
+		} else {
+			err = zr.(zlib.Resetter).Reset(r, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if im, buf, err = readRawFrame(bufio.NewReader(zr), im, !e.key, buf); err != nil {
+			return nil, err
+		}
+	}
+	return &frame{time: entries[len(entries)-1].time, im: im}, nil
+}
+
+// parseTime parses a time given as RFC 3339 or in milliseconds since the
+// epoch.
+func parseTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, want RFC 3339 or milliseconds since the epoch", s)
+	}
+	return t, nil
+}
+
+// serveHistory serves the list of frames in the history as JSON under
+// /history, and a frame as PNG under /history/<n> or /history?at=<time>.
+func (h *handler) serveHistory(w http.ResponseWriter, r *http.Request) {
+	if h.history == nil {
+		http.Error(w, "history disabled, use -history", http.StatusNotFound)
+		return
+	}
+	var n uint64
+	if r.URL.Path == "/history" {
+		s := r.URL.Query().Get("at")
+		if s == "" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(h.history.list()); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		t, err := parseTime(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n, err = h.history.at(t); err != nil {
+			http.Error(w, fmt.Sprintf("no frame at %v", t), http.StatusNotFound)
+			return
+		}
+	} else {
+		s := strings.TrimPrefix(r.URL.Path, "/history/")
+		var err error
+		if n, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid frame number %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := h.history.get(n)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("frame %d not found", n), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	im := f.im
+	if !t.identity() {
+		im = t.apply(nil, im, nil)
+	}
+	if im.Bounds().Empty() {
+		http.Error(w, errCropOutside.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Last-Modified", f.time.UTC().Format(http.TimeFormat))
+	h.pngEncoder(png.BestSpeed).Encode(w, im)
+}
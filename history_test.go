@@ -0,0 +1,162 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// checkHistory checks the invariants of h after adding n frames: it starts
+// with a keyframe, size is the total size of the entries and the frames are
+// numbered consecutively.
+func checkHistory(t *testing.T, h *history, n int) {
+	t.Helper()
+	if len(h.entries) == 0 {
+		t.Fatalf("after %d frames: history is empty", n)
+	}
+	if !h.entries[0].key {
+		t.Errorf("after %d frames: history starts with frame %d, which isn't a keyframe", n, h.first)
+	}
+	var size int
+	for _, e := range h.entries {
+		size += len(e.data)
+	}
+	if size != h.size {
+		t.Errorf("after %d frames: size is %d, want %d", n, h.size, size)
+	}
+	if got := h.first + uint64(len(h.entries)); got != uint64(n) {
+		t.Errorf("after %d frames: history ends with frame %d", n, got-1)
+	}
+}
+
+func TestHistoryDrop(t *testing.T) {
+	frames := recordFrames()
+	// Encoding the frames again gives the same sizes.
+	var (
+		rw    recordWriter
+		sizes []int
+	)
+	for _, f := range frames {
+		_, data, err := rw.encodeFrame(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(data))
+	}
+	// The history has room for frames 5 to 12, the keyframes 5 and 8 with
+	// their dependent frames.
+	h := &history{}
+	for _, n := range sizes[5:13] {
+		h.max += n
+	}
+	for i, f := range frames[:13] {
+		if err := h.add(f); err != nil {
+			t.Fatalf("add(%d) = %v", i, err)
+		}
+		checkHistory(t, h, i+1)
+		if !recordKeys[int(h.first)] {
+			t.Errorf("after %d frames: history starts with frame %d, want a keyframe of the recording", i+1, h.first)
+		}
+	}
+	l := h.list()
+	if len(l) != 8 || l[0].N != 5 {
+		t.Fatalf("list() = %v, want frames 5 to 12", l)
+	}
+	for i, hf := range l {
+		if hf.N != uint64(5+i) || !hf.Time.Equal(frames[5+i].time) {
+			t.Errorf("list()[%d] = %v, want frame %d at %v", i, hf, 5+i, frames[5+i].time)
+		}
+	}
+	for n := uint64(3); n < 15; n++ {
+		f, err := h.get(n)
+		if n < 5 || n > 12 {
+			if !os.IsNotExist(err) {
+				t.Errorf("get(%d) = %v, want %v", n, err, os.ErrNotExist)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("get(%d) = %v", n, err)
+			continue
+		}
+		if !f.time.Equal(frames[n].time) {
+			t.Errorf("get(%d) has time %v, want %v", n, f.time, frames[n].time)
+		}
+		if err := sameFrame(f.im, frames[n].im); err != nil {
+			t.Errorf("get(%d): %v", n, err)
+		}
+	}
+
+	// Adding the keyframe 13 drops 5 to 7.
+	if err := h.add(frames[13]); err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, h, 14)
+	if h.first != 8 {
+		t.Errorf("after keyframe 13, history starts with frame %d, want 8", h.first)
+	}
+
+	tcs := []struct {
+		t    time.Time
+		want uint64
+		err  error
+	}{
+		{frames[0].time, 0, os.ErrNotExist},
+		{frames[8].time.Add(-1), 0, os.ErrNotExist},
+		{frames[8].time, 8, nil},
+		{frames[8].time.Add(1), 8, nil},
+		{frames[10].time.Add(-1), 9, nil},
+		{frames[10].time, 10, nil},
+		{frames[13].time, 13, nil},
+		{frames[13].time.Add(time.Hour), 13, nil},
+	}
+	for _, tc := range tcs {
+		if got, err := h.at(tc.t); got != tc.want || err != tc.err {
+			t.Errorf("at(%v) = %d, %v, want %d, %v", tc.t, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestHistorySingleKeyframe(t *testing.T) {
+	// Every keyframe exceeds the history on its own.
+	h := &history{max: 1}
+	if _, err := h.at(time.Now()); err != os.ErrNotExist {
+		t.Errorf("at() of an empty history = %v, want %v", err, os.ErrNotExist)
+	}
+	frames := recordFrames()
+	for i, f := range frames {
+		if err := h.add(f); err != nil {
+			t.Fatalf("add(%d) = %v", i, err)
+		}
+		checkHistory(t, h, i+1)
+		// The previous frame is dropped, once the next one is added as a
+		// keyframe.
+		if len(h.entries) != 1 {
+			t.Fatalf("after %d frames: history has %d frames, want 1", i+1, len(h.entries))
+		}
+		if h.rw.prev != nil {
+			t.Errorf("after %d frames: next frame isn't a keyframe", i+1)
+		}
+		got, err := h.get(uint64(i))
+		if err != nil {
+			t.Fatalf("get(%d) = %v", i, err)
+		}
+		if err := sameFrame(got.im, f.im); err != nil {
+			t.Errorf("get(%d): %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diff detects the regions that changed between consecutive frames.
+package diff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+)
+
+// TileSize is the default edge length of the tiles compared by Changed.
+const TileSize = 32
+
+// Changed compares prev and cur tile by tile and returns the changed regions,
+// as a list of disjoint rectangles sorted top to bottom, left to right. It
+// returns nil, if both images are identical. If they can't be compared, e.g.
+// because their bounds differ, the bounds of cur are returned as a single
+// rectangle.
+//
+// Images of the types *image.Gray, *image.Gray16, *image.RGBA and
+// *image.Paletted are compared efficiently. Other images are compared pixel by
+// pixel.
+func Changed(prev, cur image.Image, tile int) []image.Rectangle {
+	rects := AppendChanged(nil, prev, cur, tile)
+	if len(rects) == 0 {
+		return nil
+	}
+	return rects
+}
+
+// AppendChanged is like Changed, but appends the changed regions to dst and
+// returns the extended slice. It doesn't allocate, if dst has enough capacity
+// and the images are compared efficiently.
+func AppendChanged(dst []image.Rectangle, prev, cur image.Image, tile int) []image.Rectangle {
+	b := cur.Bounds()
+	if b.Empty() {
+		return dst
+	}
+	if prev == nil || prev.Bounds() != b || !sameModel(prev, cur) {
+		return append(dst, b)
+	}
+	if tile <= 0 {
+		tile = TileSize
+	}
+	eq := newTiles(prev, cur)
+
+	var (
+		start = len(dst)
+		rects = dst
+		// open are the rectangles ending in the previous row of tiles,
+		// which can still be extended downwards, and next those of the
+		// current row. They are usually short enough for the arrays.
+		bufs       [2][64]int
+		open, next = bufs[0][:0], bufs[1][:0]
+	)
+	for y := b.Min.Y; y < b.Max.Y; y += tile {
+		next = next[:0]
+		for x := b.Min.X; x < b.Max.X; x += tile {
+			t := image.Rect(x, y, x+tile, y+tile).Intersect(b)
+			if eq.equal(t) {
+				continue
+			}
+			// Extend the previous run of changed tiles in this row, if any.
+			if n := len(rects); len(next) > 0 && next[len(next)-1] == n-1 && rects[n-1].Max.X == t.Min.X && rects[n-1].Min.Y == t.Min.Y {
+				rects[n-1].Max.X = t.Max.X
+				continue
+			}
+			rects = append(rects, t)
+			next = append(next, len(rects)-1)
+		}
+		// Merge runs of this row into runs of the same width in the row
+		// above.
+		for i, j := 0, 0; i < len(next); i++ {
+			r := rects[next[i]]
+			for j < len(open) && rects[open[j]].Min.X < r.Min.X {
+				j++
+			}
+			if j < len(open) && rects[open[j]].Min.X == r.Min.X && rects[open[j]].Max.X == r.Max.X && rects[open[j]].Max.Y == r.Min.Y {
+				rects[open[j]].Max.Y = r.Max.Y
+				rects[next[i]] = image.Rectangle{}
+				next[i] = open[j]
+			}
+		}
+		open, next = next, open
+	}
+
+	// Remove the rectangles which have been merged.
+	out := rects[:start]
+	for _, r := range rects[start:] {
+		if !r.Empty() {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Bounds returns the smallest rectangle containing all rects.
+func Bounds(rects []image.Rectangle) image.Rectangle {
+	var r image.Rectangle
+	for _, rr := range rects {
+		r = r.Union(rr)
+	}
+	return r
+}
+
+// Moved looks for a region of prev with the same content as the region r of
+// cur, offset vertically by at most max pixels, as happens when content is
+// scrolled. It returns the top left corner of that region, preferring the
+// smallest offset, and whether one was found. Only images of the types
+// compared efficiently by Changed are searched.
+func Moved(prev, cur image.Image, r image.Rectangle, max int) (image.Point, bool) {
+	b := cur.Bounds()
+	if prev == nil || prev.Bounds() != b || !r.In(b) || r.Empty() || !sameModel(prev, cur) {
+		return image.Point{}, false
+	}
+	pp, sp, bpp, okp := pixels(prev)
+	pc, sc, bppc, okc := pixels(cur)
+	if !okp || !okc || bpp != bppc {
+		return image.Point{}, false
+	}
+	r = r.Sub(b.Min)
+	row := func(pix []byte, stride, y int) []byte {
+		return pix[y*stride+r.Min.X*bpp : y*stride+r.Max.X*bpp]
+	}
+	for d := 1; d <= max; d++ {
+		for _, dy := range [2]int{d, -d} {
+			if r.Min.Y+dy < 0 || r.Max.Y+dy > b.Dy() {
+				continue
+			}
+			y := r.Min.Y
+			for y < r.Max.Y && bytes.Equal(row(pc, sc, y), row(pp, sp, y+dy)) {
+				y++
+			}
+			if y == r.Max.Y {
+				return image.Pt(r.Min.X, r.Min.Y+dy).Add(b.Min), true
+			}
+		}
+	}
+	return image.Point{}, false
+}
+
+func sameModel(a, b image.Image) bool {
+	// Paletted images are handled first, as converting their palette to a
+	// color.Model allocates.
+	var pa, pb color.Palette
+	if p, ok := a.(*image.Paletted); ok {
+		pa = p.Palette
+	} else if pa, ok = a.ColorModel().(color.Palette); !ok {
+		return a.ColorModel() == b.ColorModel()
+	}
+	if p, ok := b.(*image.Paletted); ok {
+		pb = p.Palette
+	} else if pb, ok = b.ColorModel().(color.Palette); !ok {
+		return false
+	}
+	if len(pa) != len(pb) {
+		return false
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tiles compares tiles of two images.
+type tiles struct {
+	a, b   image.Image
+	pa, pb []byte
+	sa, sb int
+	bpp    int
+	// fast is set, if the pixel data of a and b can be compared directly.
+	fast bool
+	min  image.Point
+}
+
+func newTiles(a, b image.Image) tiles {
+	t := tiles{a: a, b: b, min: a.Bounds().Min}
+	var bppa, bppb int
+	var oka, okb bool
+	t.pa, t.sa, bppa, oka = pixels(a)
+	t.pb, t.sb, bppb, okb = pixels(b)
+	t.bpp, t.fast = bppa, oka && okb && bppa == bppb
+	return t
+}
+
+// equal returns whether the tile r of both images is the same.
+func (t *tiles) equal(r image.Rectangle) bool {
+	if !t.fast {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if t.a.At(x, y) != t.b.At(x, y) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	r = r.Sub(t.min)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		ra := t.pa[y*t.sa+r.Min.X*t.bpp : y*t.sa+r.Max.X*t.bpp]
+		rb := t.pb[y*t.sb+r.Min.X*t.bpp : y*t.sb+r.Max.X*t.bpp]
+		if !bytes.Equal(ra, rb) {
+			return false
+		}
+	}
+	return true
+}
+
+// pixels returns the pixel data, stride and bytes per pixel of m, if it has
+// one of the standard types.
+func pixels(m image.Image) (pix []byte, stride, bpp int, ok bool) {
+	switch m := m.(type) {
+	case *image.Gray:
+		return m.Pix, m.Stride, 1, true
+	case *image.Paletted:
+		return m.Pix, m.Stride, 1, true
+	case *image.Gray16:
+		return m.Pix, m.Stride, 2, true
+	case *image.RGBA:
+		return m.Pix, m.Stride, 4, true
+	default:
+		return nil, 0, 0, false
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestChanged(t *testing.T) {
+	tcs := []struct {
+		name    string
+		bounds  image.Rectangle
+		changed []image.Point
+		want    []image.Rectangle
+	}{
+		{
+			name:   "identical",
+			bounds: image.Rect(0, 0, 100, 70),
+		},
+		{
+			name:    "single tile",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{40, 40}},
+			want:    []image.Rectangle{image.Rect(32, 32, 64, 64)},
+		},
+		{
+			name:    "partial tile at the corner",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{99, 69}},
+			want:    []image.Rectangle{image.Rect(96, 64, 100, 70)},
+		},
+		{
+			name:    "row",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{0, 0}, {40, 0}, {70, 0}, {99, 0}},
+			want:    []image.Rectangle{image.Rect(0, 0, 100, 32)},
+		},
+		{
+			name:    "gap in row",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{0, 0}, {70, 0}},
+			want:    []image.Rectangle{image.Rect(0, 0, 32, 32), image.Rect(64, 0, 96, 32)},
+		},
+		{
+			name:    "right column",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{99, 0}, {99, 40}, {99, 69}},
+			want:    []image.Rectangle{image.Rect(96, 0, 100, 70)},
+		},
+		{
+			name:    "block",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{0, 0}, {40, 0}, {0, 40}, {40, 40}, {0, 69}, {40, 69}},
+			want:    []image.Rectangle{image.Rect(0, 0, 64, 70)},
+		},
+		{
+			name:    "narrower row below",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{0, 0}, {40, 0}, {0, 40}},
+			want:    []image.Rectangle{image.Rect(0, 0, 64, 32), image.Rect(0, 32, 32, 64)},
+		},
+		{
+			name:    "wider row below",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{0, 0}, {0, 40}, {40, 40}},
+			want:    []image.Rectangle{image.Rect(0, 0, 32, 32), image.Rect(0, 32, 64, 64)},
+		},
+		{
+			name:    "two columns",
+			bounds:  image.Rect(0, 0, 100, 70),
+			changed: []image.Point{{0, 0}, {70, 0}, {0, 40}, {70, 40}},
+			want:    []image.Rectangle{image.Rect(0, 0, 32, 64), image.Rect(64, 0, 96, 64)},
+		},
+		{
+			name:    "offset origin",
+			bounds:  image.Rect(10, 20, 110, 90),
+			changed: []image.Point{{10, 20}, {109, 89}},
+			want:    []image.Rectangle{image.Rect(10, 20, 42, 52), image.Rect(106, 84, 110, 90)},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			prev, cur := image.NewGray(tc.bounds), image.NewGray(tc.bounds)
+			for _, p := range tc.changed {
+				cur.SetGray(p.X, p.Y, color.Gray{0xff})
+			}
+			if got := Changed(prev, cur, 32); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Changed() = %v, want %v", got, tc.want)
+			}
+			// AppendChanged keeps the contents of dst and doesn't
+			// allocate, if dst is large enough.
+			dst := make([]image.Rectangle, 1, 8)
+			var got []image.Rectangle
+			n := testing.AllocsPerRun(10, func() {
+				got = AppendChanged(dst[:1], prev, cur, 32)
+			})
+			if want := append(dst[:1:1], tc.want...); !reflect.DeepEqual(got, want) {
+				t.Errorf("AppendChanged() = %v, want %v", got, want)
+			}
+			if n != 0 {
+				t.Errorf("AppendChanged() did %v allocations, want 0", n)
+			}
+		})
+	}
+}
+
+func TestChangedModel(t *testing.T) {
+	b := image.Rect(0, 0, 40, 40)
+	paletted := func(p ...color.Color) *image.Paletted {
+		return image.NewPaletted(b, p)
+	}
+	nrgba := image.NewNRGBA(b)
+	nrgba.Set(35, 5, color.White)
+
+	tcs := []struct {
+		name      string
+		prev, cur image.Image
+		want      []image.Rectangle
+	}{
+		{"no previous image", nil, image.NewGray(b), []image.Rectangle{b}},
+		{"different bounds", image.NewGray(image.Rect(0, 0, 40, 41)), image.NewGray(b), []image.Rectangle{b}},
+		{"different model", image.NewGray16(b), image.NewGray(b), []image.Rectangle{b}},
+		{"equal palettes", paletted(color.Black, color.White), paletted(color.Black, color.White), nil},
+		{"changed palette", paletted(color.Black, color.White), paletted(color.White, color.Black), []image.Rectangle{b}},
+		{"grown palette", paletted(color.Black), paletted(color.Black, color.White), []image.Rectangle{b}},
+		{"pixel by pixel", image.NewNRGBA(b), nrgba, []image.Rectangle{image.Rect(32, 0, 40, 32)}},
+		{"empty", image.NewGray(image.Rectangle{}), image.NewGray(image.Rectangle{}), nil},
+	}
+	for _, tc := range tcs {
+		if got := Changed(tc.prev, tc.cur, 32); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Changed() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// rows returns an image, in which all rows differ.
+func rows(b image.Rectangle) *image.Gray16 {
+	m := image.NewGray16(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			m.SetGray16(x, y, color.Gray16{uint16(y<<8 | x)})
+		}
+	}
+	return m
+}
+
+// scrolled returns m with its content moved up by dy pixels, filling the
+// uncovered rows with white.
+func scrolled(m *image.Gray16, dy int) *image.Gray16 {
+	b := m.Bounds()
+	s := image.NewGray16(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.Gray16{0xffff}
+			if p := image.Pt(x, y+dy); p.In(b) {
+				c = m.Gray16At(p.X, p.Y)
+			}
+			s.SetGray16(x, y, c)
+		}
+	}
+	return s
+}
+
+func TestMoved(t *testing.T) {
+	b := image.Rect(0, 0, 64, 100)
+	tcs := []struct {
+		name   string
+		bounds image.Rectangle
+		dy     int
+		r      image.Rectangle
+		max    int
+		want   image.Point
+		wantOk bool
+	}{
+		{"up", b, 5, image.Rect(0, 10, 64, 40), 8, image.Pt(0, 15), true},
+		{"down", b, -3, image.Rect(0, 10, 64, 40), 8, image.Pt(0, 7), true},
+		{"part of a row", b, 5, image.Rect(8, 10, 16, 20), 8, image.Pt(8, 15), true},
+		{"beyond max", b, 5, image.Rect(0, 10, 64, 40), 4, image.Point{}, false},
+		{"uncovered rows", b, 5, image.Rect(0, 80, 64, 100), 8, image.Point{}, false},
+		{"unmoved", b, 0, image.Rect(0, 10, 64, 40), 8, image.Point{}, false},
+		{"offset origin", image.Rect(10, 50, 74, 150), 5, image.Rect(10, 60, 74, 90), 8, image.Pt(10, 65), true},
+	}
+	for _, tc := range tcs {
+		prev := rows(tc.bounds)
+		cur := scrolled(prev, tc.dy)
+		got, ok := Moved(prev, cur, tc.r, tc.max)
+		if got != tc.want || ok != tc.wantOk {
+			t.Errorf("%s: Moved() = %v, %v, want %v, %v", tc.name, got, ok, tc.want, tc.wantOk)
+		}
+	}
+
+	// Of several matches, the smallest offset is returned.
+	prev := image.NewGray(b)
+	if got, ok := Moved(prev, image.NewGray(b), image.Rect(0, 10, 64, 40), 8); got != image.Pt(0, 11) || !ok {
+		t.Errorf("Moved() on a blank screen = %v, %v, want %v, true", got, ok, image.Pt(0, 11))
+	}
+}
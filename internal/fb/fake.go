@@ -0,0 +1,178 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeInfo is the description of a fake framebuffer device, as stored in the
+// screeninfo.json file.
+type fakeInfo struct {
+	Fix struct {
+		Id          string
+		Type        uint32
+		Visual      *uint32
+		Line_length uint32
+	}
+	Var VarScreeninfo
+	// Cmap is the color map, as a list of 16-bit [red, green, blue] triples.
+	Cmap [][3]uint16
+}
+
+// OpenFake opens a fake framebuffer device, for testing without hardware. dir
+// must contain a file "pixels", holding the raw framebuffer memory, and a file
+// "screeninfo.json", describing its layout. The description has the form
+//
+//	{
+//		"Fix": {"Id": "fake", "Visual": 2, "Line_length": 2816},
+//		"Var": {"Xres": 1404, "Yres": 1872, "Bits_per_pixel": 16, ...},
+//		"Cmap": [[0, 0, 0], [65535, 65535, 65535], ...]
+//	}
+//
+// where "Fix" and "Var" contain the fields of FixScreeninfo and VarScreeninfo.
+// Omitted fields are derived from the others, where possible.
+//
+// To simulate changes of the screen, both files can be modified while the
+// device is open. "screeninfo.json" is parsed again whenever its modification
+// time changes, except for "Fix", which is only read once. "pixels" is mapped
+// into memory, like a real framebuffer, so it must be written in place: It
+// must not be truncated, which makes accessing the image crash the program,
+// and a file renamed over it is not noticed.
+func OpenFake(dir string) (*Device, error) {
+	d := &Device{fake: dir}
+	info, err := d.readFakeInfo()
+	if err != nil {
+		return nil, err
+	}
+	pixels := filepath.Join(dir, "pixels")
+	fd, err := unix.Open(pixels, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", pixels, err)
+	}
+	d.fd = uintptr(fd)
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("stat %s: %v", pixels, err)
+	}
+	if st.Size == 0 || int64(int(st.Size)) != st.Size {
+		unix.Close(fd)
+		return nil, fmt.Errorf("invalid size %d of %s", st.Size, pixels)
+	}
+
+	copy(d.finfo.Id[:len(d.finfo.Id)-1], toInt8(info.Fix.Id))
+	d.finfo.Smem_len = uint32(st.Size)
+	d.finfo.Type = info.Fix.Type
+	d.finfo.Visual = FB_VISUAL_TRUECOLOR
+	if info.Fix.Visual != nil {
+		d.finfo.Visual = *info.Fix.Visual
+	}
+	d.finfo.Line_length = info.Fix.Line_length
+	if d.finfo.Line_length == 0 {
+		d.finfo.Line_length = (info.Var.Xres_virtual*info.Var.Bits_per_pixel + 7) / 8
+	}
+
+	d.mmap, err = unix.Mmap(fd, 0, int(st.Size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("mmap: %v", err)
+	}
+	return d, nil
+}
+
+// WriteFake creates the files of a fake framebuffer device in the existing
+// directory dir, to be opened by OpenFake. info is the description stored in
+// "screeninfo.json" and pix the contents of "pixels".
+func WriteFake(dir, info string, pix []byte) error {
+	if err := os.WriteFile(filepath.Join(dir, "screeninfo.json"), []byte(info), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "pixels"), pix, 0644)
+}
+
+// readFakeInfo returns the description of a fake device. It must not be
+// modified.
+func (d *Device) readFakeInfo() (*fakeInfo, error) {
+	f := filepath.Join(d.fake, "screeninfo.json")
+	fi, err := os.Stat(f)
+	if err != nil {
+		return nil, err
+	}
+	d.fakeMu.Lock()
+	defer d.fakeMu.Unlock()
+	if d.fakeInfo != nil && fi.ModTime().Equal(d.fakeStat.ModTime()) && fi.Size() == d.fakeStat.Size() {
+		return d.fakeInfo, nil
+	}
+	buf, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	info := new(fakeInfo)
+	if err := json.Unmarshal(buf, info); err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	v := &info.Var
+	if v.Xres == 0 || v.Yres == 0 {
+		return nil, fmt.Errorf("%s: no resolution given", f)
+	}
+	if v.Xres_virtual == 0 {
+		v.Xres_virtual = v.Xoffset + v.Xres
+	}
+	if v.Yres_virtual == 0 {
+		v.Yres_virtual = v.Yoffset + v.Yres
+	}
+	d.fakeInfo, d.fakeStat = info, fi
+	return info, nil
+}
+
+func (d *Device) fakeVarScreeninfo() (VarScreeninfo, error) {
+	info, err := d.readFakeInfo()
+	if err != nil {
+		return VarScreeninfo{}, err
+	}
+	return info.Var, nil
+}
+
+func (d *Device) fakeCmap(n int) (color.Palette, error) {
+	info, err := d.readFakeInfo()
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Cmap) < n {
+		return nil, errors.New("FBIOGETCMAP: color map too short")
+	}
+	p := make(color.Palette, n)
+	for i := range p {
+		c := info.Cmap[i]
+		p[i] = color.RGBA64{c[0], c[1], c[2], 0xffff}
+	}
+	return p, nil
+}
+
+func toInt8(s string) []int8 {
+	b := make([]int8, len(s))
+	for i := 0; i < len(s); i++ {
+		b[i] = int8(s[i])
+	}
+	return b
+}
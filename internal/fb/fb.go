@@ -19,15 +19,39 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"os"
+	"strings"
+	"sync"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+// ErrNoVSync is returned by WaitForVSync, if the driver doesn't support
+// waiting for the vertical blank.
+var ErrNoVSync = errors.New("waiting for vsync unsupported")
+
 type Device struct {
 	fd    uintptr
 	mmap  []byte
 	finfo FixScreeninfo
+	// fake is the directory describing a fake device, if opened with
+	// OpenFake.
+	fake string
+	// fakeMu protects fakeInfo, the parsed description of a fake device,
+	// which is parsed again when the modification time or size of its file
+	// (as given by fakeStat) changes.
+	fakeMu   sync.Mutex
+	fakeInfo *fakeInfo
+	fakeStat os.FileInfo
+
+	// mu protects the cached format, which was computed for the var
+	// screeninfo cacheVinfo. Reading the color map takes an ioctl, so it is
+	// only read again when the var screeninfo changes.
+	mu         sync.Mutex
+	cache      *Format
+	cacheVinfo VarScreeninfo
 }
 
 func Open(dev string) (*Device, error) {
@@ -56,6 +80,9 @@ func Open(dev string) (*Device, error) {
 }
 
 func (d *Device) VarScreeninfo() (VarScreeninfo, error) {
+	if d.fake != "" {
+		return d.fakeVarScreeninfo()
+	}
 	var vinfo VarScreeninfo
 	_, _, eno := unix.Syscall(unix.SYS_IOCTL, d.fd, FBIOGET_VSCREENINFO, uintptr(unsafe.Pointer(&vinfo)))
 	if eno != 0 {
@@ -64,29 +91,172 @@ func (d *Device) VarScreeninfo() (VarScreeninfo, error) {
 	return vinfo, nil
 }
 
-func (d *Device) Image() (image.Image, error) {
+// Image returns the currently visible part of the framebuffer. The returned
+// image is backed by the framebuffer memory, so it changes with the screen
+// content.
+func (d *Device) Image() (*Packed, error) {
 	vinfo, err := d.VarScreeninfo()
 	if err != nil {
 		return nil, err
 	}
-	if vinfo.Bits_per_pixel != 16 {
-		return nil, fmt.Errorf("%d bits per pixel unsupported", vinfo.Bits_per_pixel)
+	f, err := d.format(vinfo)
+	if err != nil {
+		return nil, err
 	}
+	stride := int(d.finfo.Line_length)
 	virtual := image.Rect(0, 0, int(vinfo.Xres_virtual), int(vinfo.Yres_virtual))
-	if virtual.Dx()*virtual.Dy()*2 != len(d.mmap) {
+	if (virtual.Dx()*f.BitsPerPixel+7)/8 > stride || virtual.Dy()*stride > len(d.mmap) {
 		return nil, errors.New("virtual resolution doesn't match framebuffer size")
 	}
-	visual := image.Rect(int(vinfo.Xoffset), int(vinfo.Yoffset), int(vinfo.Xres), int(vinfo.Yres))
+	// The visible part of the virtual resolution moves when the display is
+	// panned, e.g. to flip between two buffers.
+	visual := image.Rect(0, 0, int(vinfo.Xres), int(vinfo.Yres)).Add(image.Pt(int(vinfo.Xoffset), int(vinfo.Yoffset)))
 	if !visual.In(virtual) {
 		return nil, errors.New("visual resolution not contained in virtual resolution")
 	}
-	return &image.Gray16{
-		Pix:    d.mmap,
-		Stride: int(d.finfo.Line_length),
+	if visual.Min.X*f.BitsPerPixel%8 != 0 {
+		return nil, errors.New("panning to a fraction of a byte unsupported")
+	}
+	return &Packed{
+		Pix:    d.mmap[visual.Min.Y*stride+visual.Min.X*f.BitsPerPixel/8:],
+		Stride: stride,
 		Rect:   visual,
+		Format: f,
 	}, nil
 }
 
+// WaitForVSync blocks until the next vertical blank of the display, during
+// which the driver doesn't scan out the framebuffer. Copying the framebuffer
+// right afterwards is less likely to catch a partially drawn frame.
+func (d *Device) WaitForVSync() error {
+	if d.fake != "" {
+		return ErrNoVSync
+	}
+	var crtc uint32
+	_, _, eno := unix.Syscall(unix.SYS_IOCTL, d.fd, FBIO_WAITFORVSYNC, uintptr(unsafe.Pointer(&crtc)))
+	switch eno {
+	case 0:
+		return nil
+	case unix.ENOTTY, unix.EINVAL, unix.ENOSYS, unix.EOPNOTSUPP:
+		return ErrNoVSync
+	default:
+		return fmt.Errorf("FBIO_WAITFORVSYNC: %v", eno)
+	}
+}
+
+// Rotation returns the clockwise rotation in degrees (0, 90, 180 or 270), by
+// which the driver reports the display to be rotated relative to the
+// framebuffer memory. Drivers report it either as one of the FB_ROTATE_*
+// constants or in degrees.
+func (d *Device) Rotation() (int, error) {
+	vinfo, err := d.VarScreeninfo()
+	if err != nil {
+		return 0, err
+	}
+	switch vinfo.Rotate {
+	case FB_ROTATE_UR, FB_ROTATE_CW, FB_ROTATE_UD, FB_ROTATE_CCW:
+		return int(vinfo.Rotate) * 90, nil
+	case 90, 180, 270:
+		return int(vinfo.Rotate), nil
+	default:
+		return 0, fmt.Errorf("invalid rotation %d", vinfo.Rotate)
+	}
+}
+
+// format returns the format of the pixels for vinfo.
+func (d *Device) format(vinfo VarScreeninfo) (Format, error) {
+	// Panning doesn't change the format.
+	key := vinfo
+	key.Xoffset, key.Yoffset = 0, 0
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cache != nil && d.cacheVinfo == key {
+		return *d.cache, nil
+	}
+	f, err := d.readFormat(vinfo)
+	if err != nil {
+		return Format{}, err
+	}
+	d.cache, d.cacheVinfo = &f, key
+	return f, nil
+}
+
+func (d *Device) readFormat(vinfo VarScreeninfo) (Format, error) {
+	if d.finfo.Type != FB_TYPE_PACKED_PIXELS {
+		return Format{}, fmt.Errorf("framebuffer type %d unsupported", d.finfo.Type)
+	}
+	f := Format{
+		BitsPerPixel:  int(vinfo.Bits_per_pixel),
+		Grayscale:     vinfo.Grayscale == 1 || d.epaper(),
+		ReversePixels: vinfo.Nonstd&FB_NONSTD_REV_PIX_IN_B != 0,
+		Red:           vinfo.Red,
+		Green:         vinfo.Green,
+		Blue:          vinfo.Blue,
+		Transp:        vinfo.Transp,
+	}
+	switch d.finfo.Visual {
+	case FB_VISUAL_PSEUDOCOLOR, FB_VISUAL_STATIC_PSEUDOCOLOR:
+		if f.BitsPerPixel > 8 {
+			return Format{}, fmt.Errorf("%d bits per pixel unsupported for pseudocolor", f.BitsPerPixel)
+		}
+		p, err := d.cmap(1 << uint(f.BitsPerPixel))
+		if err != nil {
+			return Format{}, err
+		}
+		f.Palette, f.Grayscale = p, false
+	case FB_VISUAL_MONO01:
+		f.Palette, f.Grayscale = color.Palette{color.Gray{0xff}, color.Gray{0}}, false
+	case FB_VISUAL_MONO10:
+		f.Palette, f.Grayscale = color.Palette{color.Gray{0}, color.Gray{0xff}}, false
+	case FB_VISUAL_TRUECOLOR, FB_VISUAL_DIRECTCOLOR:
+		if f.Grayscale && f.BitsPerPixel < 8 {
+			f.Palette = grayPalette(1 << uint(f.BitsPerPixel))
+		}
+	default:
+		if !f.Grayscale {
+			return Format{}, fmt.Errorf("framebuffer visual %d unsupported", d.finfo.Visual)
+		}
+	}
+	return f, f.check()
+}
+
+// cmap reads the first n entries of the color map of the framebuffer.
+func (d *Device) cmap(n int) (color.Palette, error) {
+	if d.fake != "" {
+		return d.fakeCmap(n)
+	}
+	r, g, b := make([]uint16, n), make([]uint16, n), make([]uint16, n)
+	c := Cmap{
+		Len:   uint32(n),
+		Red:   &r[0],
+		Green: &g[0],
+		Blue:  &b[0],
+	}
+	_, _, eno := unix.Syscall(unix.SYS_IOCTL, d.fd, FBIOGETCMAP, uintptr(unsafe.Pointer(&c)))
+	if eno != 0 {
+		return nil, fmt.Errorf("FBIOGETCMAP: %v", eno)
+	}
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.RGBA64{r[i], g[i], b[i], 0xffff}
+	}
+	return p, nil
+}
+
+// epaper returns whether the framebuffer belongs to an e-paper display
+// controller. The reMarkable's EPDC reports RGB565 bitfields, but the panel
+// is grayscale and its pixels are best interpreted as 16-bit gray levels.
+func (d *Device) epaper() bool {
+	id := make([]byte, 0, len(d.finfo.Id))
+	for _, c := range d.finfo.Id {
+		if c == 0 {
+			break
+		}
+		id = append(id, byte(c))
+	}
+	return strings.HasPrefix(string(id), "mxc_epdc")
+}
+
 func (d *Device) Close() error {
 	e1 := unix.Munmap(d.mmap)
 	if e2 := unix.Close(int(d.fd)); e2 != nil {
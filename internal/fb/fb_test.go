@@ -0,0 +1,271 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openFake creates a fake device with the given description and pixels.
+func openFake(t *testing.T, info string, pix []byte) *Device {
+	t.Helper()
+	dir := t.TempDir()
+	if err := WriteFake(dir, info, pix); err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenFake(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// scale scales the value v with the given number of bits to 8 bits.
+func scale(v, bits int) uint8 {
+	return uint8(v * 0xff / (1<<uint(bits) - 1))
+}
+
+func TestPanned(t *testing.T) {
+	const (
+		vw, vh = 8, 8
+		w, h   = 4, 3
+		xo, yo = 2, 4
+	)
+	tcs := []struct {
+		name string
+		id   string
+		bpp  int
+		// fields are the bitfields of red, green and blue.
+		fields string
+		// pixel returns the pixel value at (x, y) of the virtual screen.
+		pixel func(x, y int) uint32
+		// want returns the copied color of the pixel at (x, y) of the
+		// virtual screen.
+		want func(x, y int) color.Color
+	}{
+		{
+			name:   "RGB565",
+			id:     "fake",
+			bpp:    16,
+			fields: `"Red": {"Offset": 11, "Length": 5}, "Green": {"Offset": 5, "Length": 6}, "Blue": {"Offset": 0, "Length": 5}`,
+			pixel:  func(x, y int) uint32 { return uint32(x<<11 | y<<5 | 0x1f) },
+			want:   func(x, y int) color.Color { return color.RGBA{scale(x, 5), scale(y, 6), 0xff, 0xff} },
+		},
+		{
+			name:   "XRGB8888",
+			id:     "fake",
+			bpp:    32,
+			fields: `"Red": {"Offset": 16, "Length": 8}, "Green": {"Offset": 8, "Length": 8}, "Blue": {"Offset": 0, "Length": 8}`,
+			pixel:  func(x, y int) uint32 { return uint32(x<<16 | y<<8 | 0xff) },
+			want:   func(x, y int) color.Color { return color.RGBA{uint8(x), uint8(y), 0xff, 0xff} },
+		},
+		{
+			name:   "Gray16",
+			id:     "fake",
+			bpp:    16,
+			fields: `"Grayscale": 1`,
+			pixel:  func(x, y int) uint32 { return uint32(x<<8 | y) },
+			want:   func(x, y int) color.Color { return color.Gray16{uint16(x<<8 | y)} },
+		},
+		{
+			// The e-paper driver reports RGB565 bitfields, but
+			// the pixels are gray.
+			name:   "epaper",
+			id:     "mxc_epdc_fb",
+			bpp:    16,
+			fields: `"Red": {"Offset": 11, "Length": 5}, "Green": {"Offset": 5, "Length": 6}, "Blue": {"Offset": 0, "Length": 5}`,
+			pixel:  func(x, y int) uint32 { return uint32(x<<8 | y) },
+			want:   func(x, y int) color.Color { return color.Gray16{uint16(x<<8 | y)} },
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			stride := vw * tc.bpp / 8
+			pix := make([]byte, vh*stride)
+			for y := 0; y < vh; y++ {
+				for x := 0; x < vw; x++ {
+					i := y*stride + x*tc.bpp/8
+					if tc.bpp == 16 {
+						binary.LittleEndian.PutUint16(pix[i:], uint16(tc.pixel(x, y)))
+					} else {
+						binary.LittleEndian.PutUint32(pix[i:], tc.pixel(x, y))
+					}
+				}
+			}
+			info := fmt.Sprintf(`{
+				"Fix": {"Id": %q, "Line_length": %d},
+				"Var": {"Xres": %d, "Yres": %d, "Xres_virtual": %d, "Yres_virtual": %d, "Xoffset": %d, "Yoffset": %d, "Bits_per_pixel": %d, %s}
+			}`, tc.id, stride, w, h, vw, vh, xo, yo, tc.bpp, tc.fields)
+			d := openFake(t, info, pix)
+
+			p, err := d.Image()
+			if err != nil {
+				t.Fatalf("Image() = %v", err)
+			}
+			if want := image.Rect(xo, yo, xo+w, yo+h); p.Bounds() != want {
+				t.Fatalf("Image().Bounds() = %v, want %v", p.Bounds(), want)
+			}
+			m := p.Copy(nil)
+			if want := image.Rect(0, 0, w, h); m.Bounds() != want {
+				t.Fatalf("Copy().Bounds() = %v, want %v", m.Bounds(), want)
+			}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					want := tc.want(x+xo, y+yo)
+					if got := m.At(x, y); got != want {
+						t.Errorf("Copy().At(%d, %d) = %v, want %v", x, y, got, want)
+					}
+					if got := p.At(x+xo, y+yo); color.RGBA64Model.Convert(got) != color.RGBA64Model.Convert(want) {
+						t.Errorf("At(%d, %d) = %v, want %v", x+xo, y+yo, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPannedOutside(t *testing.T) {
+	info := `{
+		"Fix": {"Id": "fake"},
+		"Var": {"Xres": 4, "Yres": 4, "Xres_virtual": 4, "Yres_virtual": 8, "Xoffset": 0, "Yoffset": 6, "Bits_per_pixel": 8, "Grayscale": 1}
+	}`
+	d := openFake(t, info, make([]byte, 4*8))
+	if _, err := d.Image(); err == nil {
+		t.Error("Image() succeeded for a visible area outside of the virtual screen")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tcs := []struct {
+		rotate  int
+		want    int
+		wantErr bool
+	}{
+		{rotate: FB_ROTATE_UR, want: 0},
+		{rotate: FB_ROTATE_CW, want: 90},
+		{rotate: FB_ROTATE_UD, want: 180},
+		{rotate: FB_ROTATE_CCW, want: 270},
+		{rotate: 90, want: 90},
+		{rotate: 180, want: 180},
+		{rotate: 270, want: 270},
+		{rotate: 45, wantErr: true},
+	}
+	for _, tc := range tcs {
+		info := fmt.Sprintf(`{
+			"Fix": {"Id": "fake"},
+			"Var": {"Xres": 4, "Yres": 2, "Bits_per_pixel": 8, "Grayscale": 1, "Rotate": %d}
+		}`, tc.rotate)
+		d := openFake(t, info, make([]byte, 8))
+		got, err := d.Rotation()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Rotation() with Rotate %d = %d, want error", tc.rotate, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("Rotation() with Rotate %d = %d, %v, want %d, <nil>", tc.rotate, got, err, tc.want)
+		}
+	}
+}
+
+func TestPaletteCache(t *testing.T) {
+	info := func(xres, xoffset int, cmap string) string {
+		return fmt.Sprintf(`{
+			"Fix": {"Id": "fake", "Visual": %d, "Line_length": 2},
+			"Var": {"Xres": %d, "Yres": 2, "Xres_virtual": 16, "Xoffset": %d, "Bits_per_pixel": 1},
+			"Cmap": %s
+		}`, FB_VISUAL_PSEUDOCOLOR, xres, xoffset, cmap)
+	}
+	const (
+		cmap1 = `[[0, 0, 0], [65535, 65535, 65535]]`
+		cmap2 = `[[65535, 0, 0], [0, 0, 65535]]`
+	)
+	black, red := color.RGBA64{0, 0, 0, 0xffff}, color.RGBA64{0xffff, 0, 0, 0xffff}
+	d := openFake(t, info(8, 0, cmap1), make([]byte, 4))
+
+	steps := []struct {
+		name string
+		info string
+		want color.Color
+	}{
+		{"initial", info(8, 0, cmap1), black},
+		// Panning keeps the cached color map.
+		{"panned", info(8, 8, cmap2), black},
+		// A new mode reads it again.
+		{"mode change", info(16, 0, cmap2), red},
+	}
+	for _, s := range steps {
+		if err := os.WriteFile(filepath.Join(d.fake, "screeninfo.json"), []byte(s.info), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := d.Image()
+		if err != nil {
+			t.Fatalf("%s: Image() = %v", s.name, err)
+		}
+		if got := p.Format.Palette[0]; got != s.want {
+			t.Errorf("%s: Palette[0] = %v, want %v", s.name, got, s.want)
+		}
+	}
+}
+
+func TestFakeReload(t *testing.T) {
+	info := func(xres int) string {
+		return fmt.Sprintf(`{
+			"Fix": {"Id": "fake", "Line_length": 8},
+			"Var": {"Xres": %d, "Yres": 2, "Xres_virtual": 8, "Bits_per_pixel": 8, "Grayscale": 1}
+		}`, xres)
+	}
+	d := openFake(t, info(4), make([]byte, 16))
+	f := filepath.Join(d.fake, "screeninfo.json")
+	fi, err := os.Stat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := fi.ModTime()
+
+	steps := []struct {
+		name  string
+		xres  int
+		mtime time.Time
+		want  int
+	}{
+		{"unchanged mtime", 6, mtime, 4},
+		{"changed mtime", 6, mtime.Add(time.Second), 6},
+	}
+	for _, s := range steps {
+		if err := os.WriteFile(f, []byte(info(s.xres)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, s.mtime, s.mtime); err != nil {
+			t.Fatal(err)
+		}
+		vinfo, err := d.VarScreeninfo()
+		if err != nil {
+			t.Fatalf("%s: VarScreeninfo() = %v", s.name, err)
+		}
+		if int(vinfo.Xres) != s.want {
+			t.Errorf("%s: Xres = %d, want %d", s.name, vinfo.Xres, s.want)
+		}
+	}
+}
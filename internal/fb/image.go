@@ -0,0 +1,325 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fb
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Format describes the layout of a single pixel in the framebuffer.
+type Format struct {
+	BitsPerPixel int
+	// Grayscale is true, if the pixel value is a gray level.
+	Grayscale bool
+	// Palette is non-nil, if pixel values are indices into a color map.
+	Palette color.Palette
+	// ReversePixels is true, if pixels smaller than a byte are packed
+	// starting from the least significant bit. By default, the leftmost
+	// pixel is stored in the most significant bits.
+	ReversePixels bool
+
+	// Red, Green and Blue describe the color channels of pixel values, if
+	// the format is neither grayscale nor paletted.
+	Red    Bitfield
+	Green  Bitfield
+	Blue   Bitfield
+	Transp Bitfield
+}
+
+func (f Format) check() error {
+	switch f.BitsPerPixel {
+	case 1, 2, 4:
+		if f.Palette == nil {
+			return fmt.Errorf("%d bits per pixel unsupported without color map", f.BitsPerPixel)
+		}
+	case 8, 16, 24, 32:
+	default:
+		return fmt.Errorf("%d bits per pixel unsupported", f.BitsPerPixel)
+	}
+	if f.Palette != nil {
+		if f.BitsPerPixel > 8 {
+			return fmt.Errorf("color map unsupported with %d bits per pixel", f.BitsPerPixel)
+		}
+		if len(f.Palette) == 0 || len(f.Palette) > 256 {
+			return fmt.Errorf("invalid color map size %d", len(f.Palette))
+		}
+		return nil
+	}
+	if f.Grayscale {
+		return nil
+	}
+	for _, b := range []Bitfield{f.Red, f.Green, f.Blue, f.Transp} {
+		if b.Right != 0 {
+			return fmt.Errorf("bitfield %+v: msb_right unsupported", b)
+		}
+		if b.Offset+b.Length > uint32(f.BitsPerPixel) {
+			return fmt.Errorf("bitfield %+v exceeds %d bits per pixel", b, f.BitsPerPixel)
+		}
+	}
+	return nil
+}
+
+// grayPalette returns a palette of n evenly spaced gray levels.
+func grayPalette(n int) color.Palette {
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.Gray{uint8(i * 0xff / (n - 1))}
+	}
+	return p
+}
+
+// Packed is an image.Image backed by packed pixels, as laid out in the memory
+// of a framebuffer. Pixel values are little-endian.
+type Packed struct {
+	// Pix holds the packed pixels. The pixel at (x, y) starts at
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)*Format.BitsPerPixel/8].
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+	Format Format
+}
+
+func (p *Packed) ColorModel() color.Model {
+	switch {
+	case p.Format.Palette != nil:
+		return p.Format.Palette
+	case p.Format.Grayscale && p.Format.BitsPerPixel == 8:
+		return color.GrayModel
+	case p.Format.Grayscale:
+		return color.Gray16Model
+	default:
+		return color.RGBAModel
+	}
+}
+
+func (p *Packed) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+func (p *Packed) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return p.ColorModel().Convert(color.Black)
+	}
+	v := p.value(x, y)
+	switch {
+	case p.Format.Palette != nil:
+		if int(v) >= len(p.Format.Palette) {
+			return color.Black
+		}
+		return p.Format.Palette[v]
+	case p.Format.Grayscale && p.Format.BitsPerPixel == 8:
+		return color.Gray{uint8(v)}
+	case p.Format.Grayscale:
+		return color.Gray16{gray16(v, p.Format.BitsPerPixel)}
+	}
+	r, g, b := newChannel(p.Format.Red), newChannel(p.Format.Green), newChannel(p.Format.Blue)
+	return color.RGBA{r.value(v), g.value(v), b.value(v), 0xff}
+}
+
+// ColorIndexAt implements image.PalettedImage. It must only be called, if p
+// is paletted.
+func (p *Packed) ColorIndexAt(x, y int) uint8 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return uint8(p.value(x, y))
+}
+
+// PixOffset returns the index of the first element of Pix that corresponds to
+// the pixel at (x, y). For formats with less than 8 bits per pixel, it is the
+// byte containing the pixel.
+func (p *Packed) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*p.Format.BitsPerPixel/8
+}
+
+// SubImage returns the part of p visible through r. Pixels of the left edge
+// of r must start at a byte boundary.
+func (p *Packed) SubImage(r image.Rectangle) *Packed {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &Packed{Format: p.Format}
+	}
+	return &Packed{
+		Pix:    p.Pix[p.PixOffset(r.Min.X, r.Min.Y):],
+		Stride: p.Stride,
+		Rect:   r,
+		Format: p.Format,
+	}
+}
+
+// value returns the pixel value at (x, y).
+func (p *Packed) value(x, y int) uint32 {
+	bpp := p.Format.BitsPerPixel
+	if bpp >= 8 {
+		return p.pixel(p.PixOffset(x, y))
+	}
+	bit := (x - p.Rect.Min.X) * bpp
+	return uint32(p.Pix[(y-p.Rect.Min.Y)*p.Stride+bit/8]>>p.shift(bit%8)) & (1<<uint(bpp) - 1)
+}
+
+// shift returns the shift of a pixel smaller than a byte, starting at the
+// given bit (counted from the left) in its byte.
+func (p *Packed) shift(bit int) uint {
+	if p.Format.ReversePixels {
+		return uint(bit)
+	}
+	return uint(8 - p.Format.BitsPerPixel - bit)
+}
+
+// pixel returns the value of the pixel starting at Pix[i]. It must only be
+// called for formats with at least 8 bits per pixel.
+func (p *Packed) pixel(i int) uint32 {
+	switch p.Format.BitsPerPixel {
+	case 8:
+		return uint32(p.Pix[i])
+	case 16:
+		return uint32(p.Pix[i]) | uint32(p.Pix[i+1])<<8
+	case 24:
+		return uint32(p.Pix[i]) | uint32(p.Pix[i+1])<<8 | uint32(p.Pix[i+2])<<16
+	default:
+		return uint32(p.Pix[i]) | uint32(p.Pix[i+1])<<8 | uint32(p.Pix[i+2])<<16 | uint32(p.Pix[i+3])<<24
+	}
+}
+
+// Copy copies p into an image of one of the standard types: *image.Paletted,
+// if p is paletted, *image.Gray or *image.Gray16, if p is grayscale with 8 or
+// more bits per pixel, *image.RGBA otherwise. The returned image has its
+// origin at (0, 0). If dst has the correct type, its buffer is reused, if
+// possible.
+//
+// The transparency bits of p are ignored, as the display does not show them
+// either.
+func (p *Packed) Copy(dst image.Image) image.Image {
+	r := image.Rect(0, 0, p.Rect.Dx(), p.Rect.Dy())
+	bpp := p.Format.BitsPerPixel
+
+	switch {
+	case p.Format.Palette != nil:
+		m, _ := dst.(*image.Paletted)
+		if m == nil || cap(m.Pix) < r.Dx()*r.Dy() {
+			m = image.NewPaletted(r, p.Format.Palette)
+		} else {
+			*m = image.Paletted{Pix: m.Pix[:r.Dx()*r.Dy()], Stride: r.Dx(), Rect: r, Palette: p.Format.Palette}
+		}
+		for y := 0; y < r.Dy(); y++ {
+			src := p.Pix[y*p.Stride:]
+			row := m.Pix[y*m.Stride : (y+1)*m.Stride]
+			if bpp == 8 {
+				copy(row, src)
+				continue
+			}
+			mask := uint8(1<<uint(bpp) - 1)
+			for x := range row {
+				bit := x * bpp
+				row[x] = src[bit/8] >> p.shift(bit%8) & mask
+			}
+		}
+		return m
+
+	case p.Format.Grayscale && bpp == 8:
+		m, _ := dst.(*image.Gray)
+		if m == nil || cap(m.Pix) < r.Dx()*r.Dy() {
+			m = image.NewGray(r)
+		} else {
+			*m = image.Gray{Pix: m.Pix[:r.Dx()*r.Dy()], Stride: r.Dx(), Rect: r}
+		}
+		for y := 0; y < r.Dy(); y++ {
+			copy(m.Pix[y*m.Stride:(y+1)*m.Stride], p.Pix[y*p.Stride:])
+		}
+		return m
+
+	case p.Format.Grayscale:
+		g, _ := dst.(*image.Gray16)
+		if g == nil || cap(g.Pix) < 2*r.Dx()*r.Dy() {
+			g = image.NewGray16(r)
+		} else {
+			*g = image.Gray16{Pix: g.Pix[:2*r.Dx()*r.Dy()], Stride: 2 * r.Dx(), Rect: r}
+		}
+		for y := 0; y < r.Dy(); y++ {
+			src := p.Pix[y*p.Stride:]
+			row := g.Pix[y*g.Stride : (y+1)*g.Stride]
+			if bpp == 16 {
+				for i := 0; i < len(row); i += 2 {
+					row[i], row[i+1] = src[i+1], src[i]
+				}
+				continue
+			}
+			for x, i := 0, 0; i < len(row); x, i = x+bpp/8, i+2 {
+				v := gray16(p.pixel(y*p.Stride+x), bpp)
+				row[i], row[i+1] = uint8(v>>8), uint8(v)
+			}
+		}
+		return g
+	}
+
+	m, _ := dst.(*image.RGBA)
+	if m == nil || cap(m.Pix) < 4*r.Dx()*r.Dy() {
+		m = image.NewRGBA(r)
+	} else {
+		*m = image.RGBA{Pix: m.Pix[:4*r.Dx()*r.Dy()], Stride: 4 * r.Dx(), Rect: r}
+	}
+	cr, cg, cb := newChannel(p.Format.Red), newChannel(p.Format.Green), newChannel(p.Format.Blue)
+	for y := 0; y < r.Dy(); y++ {
+		row := m.Pix[y*m.Stride : (y+1)*m.Stride]
+		for i, j := 0, y*p.Stride; i < len(row); i, j = i+4, j+bpp/8 {
+			v := p.pixel(j)
+			row[i+0] = cr.value(v)
+			row[i+1] = cg.value(v)
+			row[i+2] = cb.value(v)
+			row[i+3] = 0xff
+		}
+	}
+	return m
+}
+
+// gray16 scales a gray level of the given bit depth to 16 bits.
+func gray16(v uint32, bits int) uint16 {
+	if bits >= 16 {
+		return uint16(v >> uint(bits-16))
+	}
+	return uint16(v * 0xffff / (1<<uint(bits) - 1))
+}
+
+// channel extracts a single color channel from a pixel value and scales it to
+// 8 bits.
+type channel struct {
+	shift uint32
+	mask  uint32
+	lut   []uint8
+}
+
+func newChannel(b Bitfield) channel {
+	if b.Length == 0 {
+		return channel{lut: []uint8{0}}
+	}
+	c := channel{shift: b.Offset}
+	n := b.Length
+	if n > 8 {
+		c.shift += n - 8
+		n = 8
+	}
+	c.mask = 1<<n - 1
+	c.lut = make([]uint8, c.mask+1)
+	for i := range c.lut {
+		c.lut[i] = uint8(uint32(i) * 0xff / c.mask)
+	}
+	return c
+}
+
+func (c channel) value(v uint32) uint8 {
+	return c.lut[(v>>c.shift)&c.mask]
+}
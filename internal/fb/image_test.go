@@ -0,0 +1,90 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fb
+
+import (
+	"image"
+	"testing"
+)
+
+func TestPackedPaletted(t *testing.T) {
+	tcs := []struct {
+		name    string
+		bpp     int
+		reverse bool
+		// row holds the packed pixels of each row, which are followed by a
+		// byte of padding.
+		row  []byte
+		want []uint8
+	}{
+		{"1bpp", 1, false, []byte{0xb1, 0x80}, []uint8{1, 0, 1, 1, 0, 0, 0, 1, 1}},
+		{"1bpp reversed", 1, true, []byte{0x8d, 0x01}, []uint8{1, 0, 1, 1, 0, 0, 0, 1, 1}},
+		{"2bpp", 2, false, []byte{0x1b, 0x80}, []uint8{0, 1, 2, 3, 2}},
+		{"2bpp reversed", 2, true, []byte{0xe4, 0x02}, []uint8{0, 1, 2, 3, 2}},
+		{"4bpp", 4, false, []byte{0xa3, 0xf0}, []uint8{0xa, 0x3, 0xf}},
+		{"4bpp reversed", 4, true, []byte{0x3a, 0x0f}, []uint8{0xa, 0x3, 0xf}},
+		{"8bpp", 8, false, []byte{7, 0, 0xff}, []uint8{7, 0, 0xff}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			const h = 3
+			stride := len(tc.row) + 1
+			pix := make([]byte, h*stride)
+			for y := 0; y < h; y++ {
+				copy(pix[y*stride:], tc.row)
+				pix[y*stride+len(tc.row)] = 0xff
+			}
+			p := &Packed{
+				Pix:    pix,
+				Stride: stride,
+				Rect:   image.Rect(0, 0, len(tc.want), h),
+				Format: Format{BitsPerPixel: tc.bpp, Palette: grayPalette(1 << uint(tc.bpp)), ReversePixels: tc.reverse},
+			}
+			if err := p.Format.check(); err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < h; y++ {
+				for x, want := range tc.want {
+					if got := p.ColorIndexAt(x, y); got != want {
+						t.Errorf("ColorIndexAt(%d, %d) = %d, want %d", x, y, got, want)
+					}
+				}
+			}
+
+			// The rows below the first, copied into a reused, larger image.
+			dst := image.NewPaletted(image.Rect(0, 0, 16, 16), nil)
+			m, ok := p.SubImage(image.Rect(0, 1, len(tc.want), h)).Copy(dst).(*image.Paletted)
+			if !ok {
+				t.Fatalf("Copy() is no *image.Paletted")
+			}
+			if want := image.Rect(0, 0, len(tc.want), h-1); m.Rect != want {
+				t.Fatalf("Copy().Rect = %v, want %v", m.Rect, want)
+			}
+			if &m.Pix[0] != &dst.Pix[0] {
+				t.Error("Copy() didn't reuse the buffer of dst")
+			}
+			if len(m.Palette) != len(p.Format.Palette) {
+				t.Errorf("Copy() has %d colors, want %d", len(m.Palette), len(p.Format.Palette))
+			}
+			for y := 0; y < h-1; y++ {
+				for x, want := range tc.want {
+					if got := m.ColorIndexAt(x, y); got != want {
+						t.Errorf("Copy().ColorIndexAt(%d, %d) = %d, want %d", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pdf writes PDF documents showing one image per page.
+//
+// Images are embedded losslessly as Flate-compressed grayscale. See the PDF
+// 1.7 reference (ISO 32000-1) for the format.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// DefaultDPI is the resolution used, if Writer.DPI is zero.
+const DefaultDPI = 72
+
+// Object numbers of the document catalog and the page tree, which are written
+// last.
+const (
+	catalogObj = 1
+	pagesObj   = 2
+)
+
+// A Writer writes a PDF document. Pages are written as they are added, the
+// document is completed by Close.
+type Writer struct {
+	// DPI is the resolution images are shown at, which determines the page
+	// size.
+	DPI float64
+
+	w   io.Writer
+	n   int64
+	err error
+	// offsets are the offsets of all objects, indexed by object number
+	// minus one.
+	offsets []int64
+	pages   []int
+	buf     bytes.Buffer
+	zw      *zlib.Writer
+	row     []byte
+}
+
+// NewWriter returns a Writer writing a document to w.
+func NewWriter(w io.Writer) *Writer {
+	pw := &Writer{w: w, offsets: make([]int64, pagesObj)}
+	// The comment with binary characters marks the file as binary.
+	pw.printf("%%PDF-1.5\n%%\xe2\xe3\xcf\xd3\n")
+	return pw
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(w, format, args...)
+}
+
+// newObj allocates a new object number.
+func (w *Writer) newObj() int {
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets)
+}
+
+// beginObj starts the object with number obj at the current offset.
+func (w *Writer) beginObj(obj int) {
+	w.offsets[obj-1] = w.n
+	w.printf("%d 0 obj\n", obj)
+}
+
+// writeStream writes an object with the given dictionary entries and the
+// contents of w.buf as its stream.
+func (w *Writer) writeStream(obj int, dict string) {
+	w.beginObj(obj)
+	if dict != "" {
+		dict += " "
+	}
+	w.printf("<< %s/Length %d >>\nstream\n", dict, w.buf.Len())
+	w.Write(w.buf.Bytes())
+	w.printf("\nendstream\nendobj\n")
+}
+
+// AddPage adds a page showing m. Images of type *image.Gray16 keep their 16
+// bits per pixel, all others are converted to 8-bit gray, which is lossless
+// for gray images.
+func (w *Writer) AddPage(m image.Image) error {
+	if w.err != nil {
+		return w.err
+	}
+	b := m.Bounds()
+	if b.Empty() {
+		return errors.New("pdf: empty image")
+	}
+	w.buf.Reset()
+	if w.zw == nil {
+		w.zw = zlib.NewWriter(&w.buf)
+	} else {
+		w.zw.Reset(&w.buf)
+	}
+	bpc := 8
+	switch m := m.(type) {
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := m.PixOffset(b.Min.X, y)
+			w.zw.Write(m.Pix[i : i+b.Dx()])
+		}
+	case *image.Gray16:
+		bpc = 16
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := m.PixOffset(b.Min.X, y)
+			w.zw.Write(m.Pix[i : i+2*b.Dx()])
+		}
+	case *image.Paletted:
+		var gray [256]byte
+		for i, c := range m.Palette {
+			gray[i] = color.GrayModel.Convert(c).(color.Gray).Y
+		}
+		row := w.rowBuffer(b.Dx())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := m.PixOffset(b.Min.X, y)
+			for x, c := range m.Pix[i : i+b.Dx()] {
+				row[x] = gray[c]
+			}
+			w.zw.Write(row)
+		}
+	default:
+		row := w.rowBuffer(b.Dx())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := range row {
+				row[x] = color.GrayModel.Convert(m.At(b.Min.X+x, y)).(color.Gray).Y
+			}
+			w.zw.Write(row)
+		}
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	img := w.newObj()
+	w.writeStream(img, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent %d /Filter /FlateDecode", b.Dx(), b.Dy(), bpc))
+
+	dpi := w.DPI
+	if dpi <= 0 {
+		dpi = DefaultDPI
+	}
+	width, height := float64(b.Dx())*72/dpi, float64(b.Dy())*72/dpi
+	// Image space is the unit square, which is scaled to the page.
+	w.buf.Reset()
+	fmt.Fprintf(&w.buf, "q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", width, height)
+	contents := w.newObj()
+	w.writeStream(contents, "")
+
+	page := w.newObj()
+	w.beginObj(page)
+	w.printf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n", pagesObj, width, height, img, contents)
+	w.pages = append(w.pages, page)
+	return w.err
+}
+
+// rowBuffer returns a buffer for a row of n gray pixels.
+func (w *Writer) rowBuffer(n int) []byte {
+	if cap(w.row) < n {
+		w.row = make([]byte, n)
+	}
+	return w.row[:n]
+}
+
+// Close completes the document. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.pages) == 0 {
+		return errors.New("pdf: document without pages")
+	}
+	w.beginObj(pagesObj)
+	w.printf("<< /Type /Pages /Kids [")
+	for _, p := range w.pages {
+		w.printf(" %d 0 R", p)
+	}
+	w.printf(" ] /Count %d >>\nendobj\n", len(w.pages))
+	w.beginObj(catalogObj)
+	w.printf("<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", pagesObj)
+
+	xref := w.n
+	w.printf("xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, off := range w.offsets {
+		w.printf("%010d 00000 n \n", off)
+	}
+	w.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.offsets)+1, catalogObj, xref)
+	return w.err
+}
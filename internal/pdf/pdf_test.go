@@ -0,0 +1,244 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A document is a parsed PDF document, as written by Writer.
+type document struct {
+	b []byte
+	// objs are the objects by number, from "n 0 obj\n" to "endobj\n".
+	objs map[int][]byte
+	root int
+}
+
+var (
+	startxrefRE = regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`)
+	trailerRE   = regexp.MustCompile(`^trailer\n<< /Size (\d+) /Root (\d+) 0 R >>\n`)
+	lengthRE    = regexp.MustCompile(`/Length (\d+) >>\nstream\n`)
+)
+
+// parse parses b, following the cross-reference table to all objects.
+func parse(b []byte) (*document, error) {
+	m := startxrefRE.FindSubmatch(b)
+	if m == nil {
+		return nil, fmt.Errorf("no startxref at the end")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	rest := b[xref:]
+	var n int
+	if _, err := fmt.Sscanf(string(rest), "xref\n0 %d\n", &n); err != nil {
+		return nil, fmt.Errorf("no xref table at offset %d: %v", xref, err)
+	}
+	rest = rest[len(fmt.Sprintf("xref\n0 %d\n", n)):]
+	// Every entry has exactly 20 bytes.
+	if len(rest) < 20*n {
+		return nil, fmt.Errorf("xref table with %d entries truncated", n)
+	}
+	if e := string(rest[:20]); e != "0000000000 65535 f \n" {
+		return nil, fmt.Errorf("xref entry 0 is %q", e)
+	}
+	d := &document{b: b, objs: make(map[int][]byte)}
+	for i := 1; i < n; i++ {
+		e := string(rest[20*i : 20*i+20])
+		var off int
+		if _, err := fmt.Sscanf(e, "%010d 00000 n \n", &off); err != nil || len(e) != 20 {
+			return nil, fmt.Errorf("xref entry %d is %q", i, e)
+		}
+		hdr := fmt.Sprintf("%d 0 obj\n", i)
+		if off >= xref || !bytes.HasPrefix(b[off:], []byte(hdr)) {
+			return nil, fmt.Errorf("xref entry %d points to %q, not the object", i, b[off:off+10])
+		}
+		obj := b[off+len(hdr):]
+		if end := bytes.Index(obj, []byte("endobj\n")); end < 0 {
+			return nil, fmt.Errorf("object %d doesn't end", i)
+		} else {
+			d.objs[i] = obj[:end]
+		}
+	}
+	m = trailerRE.FindSubmatch(rest[20*n:])
+	if m == nil {
+		return nil, fmt.Errorf("no trailer after xref table")
+	}
+	if size, _ := strconv.Atoi(string(m[1])); size != n {
+		return nil, fmt.Errorf("trailer has /Size %d, xref table %d entries", size, n)
+	}
+	d.root, _ = strconv.Atoi(string(m[2]))
+	return d, nil
+}
+
+// dict returns the value of the entry key in the dictionary of obj, which
+// must be a single token or array, or "".
+func (d *document) dict(obj int, key string) string {
+	m := regexp.MustCompile(`/` + key + ` (\[[^]]*\]|\d+ 0 R|[^ >]+)`).FindSubmatch(d.objs[obj])
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+// ref returns the object number referred to by the entry key of obj.
+func (d *document) ref(obj int, key string) int {
+	var n int
+	fmt.Sscanf(d.dict(obj, key), "%d 0 R", &n)
+	return n
+}
+
+// stream returns the decompressed stream of obj.
+func (d *document) stream(obj int) ([]byte, error) {
+	o := d.objs[obj]
+	m := lengthRE.FindSubmatchIndex(o)
+	if m == nil {
+		return nil, fmt.Errorf("object %d has no stream", obj)
+	}
+	n, _ := strconv.Atoi(string(o[m[2]:m[3]]))
+	s := o[m[1]:]
+	if len(s) < n || string(s[n:]) != "\nendstream\n" {
+		return nil, fmt.Errorf("stream of object %d doesn't have length %d", obj, n)
+	}
+	s = s[:n]
+	if d.dict(obj, "Filter") != "/FlateDecode" {
+		return s, nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+func TestWriter(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 30, 20))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	gray16 := image.NewGray16(image.Rect(0, 0, 10, 10))
+	for i := range gray16.Pix {
+		gray16.Pix[i] = uint8(3 * i)
+	}
+	pal := image.NewPaletted(image.Rect(0, 0, 7, 5), color.Palette{color.Black, color.White, color.Gray{0x80}})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i % 3)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = 0xff
+	}
+	pages := []struct {
+		m   image.Image
+		bpc int
+		pix []byte
+	}{
+		{gray.SubImage(image.Rect(10, 5, 20, 15)), 8, nil},
+		{gray16, 16, gray16.Pix},
+		{pal, 8, bytes.Repeat([]byte{0, 0xff, 0x80}, 35)[:35]},
+		{rgba, 8, bytes.Repeat([]byte{0xff}, 16)},
+	}
+	for y := 5; y < 15; y++ {
+		pages[0].pix = append(pages[0].pix, gray.Pix[gray.PixOffset(10, y):gray.PixOffset(20, y)]...)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.DPI = 144
+	for i, p := range pages {
+		if err := w.AddPage(p.m); err != nil {
+			t.Fatalf("AddPage(%d) = %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-1.5\n")) {
+		t.Errorf("document doesn't start with a PDF header")
+	}
+	d, err := parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.root != catalogObj || d.dict(d.root, "Type") != "/Catalog" {
+		t.Fatalf("trailer refers to object %d as root, want the catalog %d", d.root, catalogObj)
+	}
+	tree := d.ref(d.root, "Pages")
+	if d.dict(tree, "Type") != "/Pages" {
+		t.Fatalf("catalog refers to object %d as /Pages, which isn't a page tree", tree)
+	}
+	if got := d.dict(tree, "Count"); got != strconv.Itoa(len(pages)) {
+		t.Errorf("page tree has /Count %s, want %d", got, len(pages))
+	}
+	kids := strings.Fields(strings.Trim(d.dict(tree, "Kids"), "[]"))
+	if len(kids) != 3*len(pages) {
+		t.Fatalf("page tree has /Kids %v, want %d pages", kids, len(pages))
+	}
+	for i, p := range pages {
+		page, _ := strconv.Atoi(kids[3*i])
+		if d.dict(page, "Type") != "/Page" || d.ref(page, "Parent") != tree {
+			t.Errorf("page %d: object %d isn't a page in the tree: %s", i, page, d.objs[page])
+			continue
+		}
+		b := p.m.Bounds()
+		box := fmt.Sprintf("[0 0 %.2f %.2f]", float64(b.Dx())/2, float64(b.Dy())/2)
+		if got := d.dict(page, "MediaBox"); got != box {
+			t.Errorf("page %d has /MediaBox %s, want %s", i, got, box)
+		}
+		img := d.ref(page, "Im0")
+		wantDict := map[string]string{
+			"Subtype":          "/Image",
+			"Width":            strconv.Itoa(b.Dx()),
+			"Height":           strconv.Itoa(b.Dy()),
+			"ColorSpace":       "/DeviceGray",
+			"BitsPerComponent": strconv.Itoa(p.bpc),
+		}
+		for k, v := range wantDict {
+			if got := d.dict(img, k); got != v {
+				t.Errorf("page %d: image has /%s %s, want %s", i, k, got, v)
+			}
+		}
+		pix, err := d.stream(img)
+		if err != nil {
+			t.Errorf("page %d: %v", i, err)
+		} else if !bytes.Equal(pix, p.pix) {
+			t.Errorf("page %d: image has pixels %x, want %x", i, pix, p.pix)
+		}
+		contents, err := d.stream(d.ref(page, "Contents"))
+		if err != nil {
+			t.Errorf("page %d: %v", i, err)
+		} else if want := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", float64(b.Dx())/2, float64(b.Dy())/2); string(contents) != want {
+			t.Errorf("page %d has contents %q, want %q", i, contents, want)
+		}
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	w := NewWriter(io.Discard)
+	if err := w.AddPage(image.NewGray(image.Rect(0, 0, 0, 10))); err == nil {
+		t.Error("AddPage(empty image) succeeds")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close() without pages succeeds")
+	}
+}
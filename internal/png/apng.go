@@ -0,0 +1,211 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"time"
+)
+
+// APNG dispose and blend operations, see
+// https://wiki.mozilla.org/APNG_Specification
+const (
+	apngDisposeNone = 0
+	apngBlendSource = 0
+)
+
+// An Animation writes an animated PNG (APNG). The first frame determines the
+// size and the color type of the animation. Later frames can cover any part
+// of it and replace its content there.
+//
+// The number of frames has to be written before the image data, so the
+// compressed frames are buffered until Close is called, which writes the
+// animation to the underlying writer.
+type Animation struct {
+	enc *Encoder
+	w   io.Writer
+	e   *encoder
+	// head contains the chunks before acTL, buf the ones after it.
+	head   bytes.Buffer
+	buf    bytes.Buffer
+	bounds image.Rectangle
+	pal    color.Palette
+	frames uint32
+	err    error
+}
+
+// NewAnimation returns an Animation writing to w with the options of enc.
+func (enc *Encoder) NewAnimation(w io.Writer) *Animation {
+	var e *encoder
+	if enc.BufferPool != nil {
+		e = (*encoder)(enc.BufferPool.Get())
+	}
+	if e == nil {
+		e = &encoder{}
+	}
+	e.enc = enc
+	e.err = nil
+	return &Animation{enc: enc, w: w, e: e}
+}
+
+// WriteFrame adds m to the animation, which is shown for the given delay. The
+// bounds of m have to be contained in the ones of the first frame and it has
+// to be encodable in the color type of the first frame. In particular, if the
+// first frame is paletted, all frames must be paletted with the same palette.
+func (a *Animation) WriteFrame(m image.Image, delay time.Duration) error {
+	if a.err != nil {
+		return a.err
+	}
+	e := a.e
+	e.m = m
+	b := m.Bounds()
+	if a.frames == 0 {
+		mw, mh := int64(b.Dx()), int64(b.Dy())
+		if mw <= 0 || mh <= 0 || mw >= 1<<32 || mh >= 1<<32 {
+			a.err = FormatError("invalid image size: " + strconv.FormatInt(mw, 10) + "x" + strconv.FormatInt(mh, 10))
+			return a.err
+		}
+		a.bounds = b
+		e.cb, a.pal = colorType(m)
+		e.seq = 0
+		e.fdAT = false
+		e.w = &a.head
+		io.WriteString(e.w, pngHeader)
+		e.writeIHDR()
+		if a.pal != nil {
+			e.writePLTEAndTRNS(a.pal)
+		}
+		e.w = &a.buf
+	} else {
+		if b.Empty() || !b.In(a.bounds) {
+			a.err = FormatError("frame " + b.String() + " outside of animation " + a.bounds.String())
+			return a.err
+		}
+		if a.pal != nil && !samePalette(a.pal, m) {
+			a.err = UnsupportedError("frame with different palette")
+			return a.err
+		}
+		e.fdAT = true
+	}
+	a.writeFCTL(b, delay)
+	e.writeIDATs()
+	a.frames++
+	a.err = e.err
+	return a.err
+}
+
+// Len returns the number of bytes buffered so far, which Close writes.
+func (a *Animation) Len() int {
+	return a.head.Len() + a.buf.Len()
+}
+
+// writeFCTL writes the frame control chunk for a frame with bounds b.
+func (a *Animation) writeFCTL(b image.Rectangle, delay time.Duration) {
+	e := a.e
+	num, den := apngDelay(delay)
+	binary.BigEndian.PutUint32(e.tmp[0:4], e.seq)
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(e.tmp[8:12], uint32(b.Dy()))
+	binary.BigEndian.PutUint32(e.tmp[12:16], uint32(b.Min.X-a.bounds.Min.X))
+	binary.BigEndian.PutUint32(e.tmp[16:20], uint32(b.Min.Y-a.bounds.Min.Y))
+	binary.BigEndian.PutUint16(e.tmp[20:22], num)
+	binary.BigEndian.PutUint16(e.tmp[22:24], den)
+	e.tmp[24] = apngDisposeNone
+	e.tmp[25] = apngBlendSource
+	e.writeChunk(e.tmp[:26], "fcTL")
+	e.seq++
+}
+
+// Close writes the animation to the underlying writer. It doesn't close the
+// underlying writer.
+func (a *Animation) Close() error {
+	if a.e == nil {
+		return a.err
+	}
+	if a.enc.BufferPool != nil {
+		defer a.enc.BufferPool.Put((*EncoderBuffer)(a.e))
+	}
+	e := a.e
+	a.e = nil
+	if a.err != nil {
+		return a.err
+	}
+	if a.frames == 0 {
+		a.err = FormatError("animation without frames")
+		return a.err
+	}
+	if _, a.err = a.w.Write(a.head.Bytes()); a.err != nil {
+		return a.err
+	}
+	e.w = a.w
+	binary.BigEndian.PutUint32(e.tmp[0:4], a.frames)
+	// Loop forever.
+	binary.BigEndian.PutUint32(e.tmp[4:8], 0)
+	e.writeChunk(e.tmp[:8], "acTL")
+	if e.err != nil {
+		a.err = e.err
+		return a.err
+	}
+	if _, a.err = a.w.Write(a.buf.Bytes()); a.err != nil {
+		return a.err
+	}
+	e.writeIEND()
+	a.err = e.err
+	return a.err
+}
+
+// writeFDAT writes b to a frame data chunk.
+func (e *encoder) writeFDAT(b []byte) {
+	e.chunk = append(e.chunk[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(e.chunk, e.seq)
+	e.chunk = append(e.chunk, b...)
+	e.writeChunk(e.chunk, "fdAT")
+	e.seq++
+}
+
+// apngDelay returns the numerator and denominator of d in seconds, in the
+// finest unit that fits.
+func apngDelay(d time.Duration) (num, den uint16) {
+	if d < 0 {
+		d = 0
+	}
+	for _, unit := range []time.Duration{time.Millisecond, 10 * time.Millisecond, time.Second} {
+		if n := (d + unit/2) / unit; n <= 0xffff {
+			return uint16(n), uint16(time.Second / unit)
+		}
+	}
+	return 0xffff, 1
+}
+
+// samePalette returns whether m is paletted with the palette p.
+func samePalette(p color.Palette, m image.Image) bool {
+	_, q := colorType(m)
+	if len(p) != len(q) {
+		return false
+	}
+	for i := range p {
+		r0, g0, b0, a0 := p[i].RGBA()
+		r1, g1, b1, a1 := q[i].RGBA()
+		if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+			return false
+		}
+	}
+	return true
+}
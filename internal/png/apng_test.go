@@ -0,0 +1,312 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A testChunk is a chunk of an encoded PNG.
+type testChunk struct {
+	typ  string
+	data []byte
+}
+
+// readChunks splits the PNG b into its chunks, checking the signature and the
+// CRCs.
+func readChunks(b []byte) ([]testChunk, error) {
+	if !bytes.HasPrefix(b, []byte(pngHeader)) {
+		return nil, fmt.Errorf("missing PNG signature")
+	}
+	b = b[len(pngHeader):]
+	var cs []testChunk
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated chunk after %d chunks", len(cs))
+		}
+		n := binary.BigEndian.Uint32(b[:4])
+		if uint64(len(b)) < 12+uint64(n) {
+			return nil, fmt.Errorf("truncated chunk after %d chunks", len(cs))
+		}
+		c := testChunk{string(b[4:8]), b[8 : 8+n]}
+		if got, want := binary.BigEndian.Uint32(b[8+n:]), crc32.ChecksumIEEE(b[4:8+n]); got != want {
+			return nil, fmt.Errorf("%s chunk has CRC %#x, want %#x", c.typ, got, want)
+		}
+		cs = append(cs, c)
+		b = b[12+n:]
+	}
+	return cs, nil
+}
+
+// appendChunk appends a chunk of type typ with the given data to b.
+func appendChunk(b []byte, typ string, data []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	b = append(b, n[:]...)
+	start := len(b)
+	b = append(b, typ...)
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(b[start:]))
+	return append(b, n[:]...)
+}
+
+// chunkOrder returns the types of cs, with runs of the same type collapsed.
+func chunkOrder(cs []testChunk) string {
+	var typs []string
+	for i, c := range cs {
+		if i == 0 || cs[i-1].typ != c.typ {
+			typs = append(typs, c.typ)
+		}
+	}
+	return strings.Join(typs, " ")
+}
+
+// A testFrame is a frame of an animation, as described by its fcTL chunk.
+type testFrame struct {
+	bounds   image.Rectangle
+	num, den uint16
+	dispose  byte
+	blend    byte
+	// data is the concatenated content of the IDAT or fdAT chunks.
+	data []byte
+}
+
+func TestAnimation(t *testing.T) {
+	r := image.Rect(0, 0, 32, 24)
+	subs := []struct {
+		r     image.Rectangle
+		delay time.Duration
+	}{
+		{r, 100 * time.Millisecond},
+		{image.Rect(4, 2, 20, 12), 1500 * time.Microsecond},
+		{image.Rect(31, 23, 32, 24), 2 * time.Second},
+	}
+	for _, m := range testImages(r) {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			var (
+				buf    bytes.Buffer
+				frames []image.Image
+			)
+			a := (&Encoder{CompressionLevel: BestSpeed}).NewAnimation(&buf)
+			for _, s := range subs {
+				f := m.(interface {
+					SubImage(image.Rectangle) image.Image
+				}).SubImage(s.r)
+				if err := a.WriteFrame(f, s.delay); err != nil {
+					t.Fatalf("WriteFrame(%v) = %v", s.r, err)
+				}
+				frames = append(frames, f)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("WriteFrame() wrote %d bytes before Close()", buf.Len())
+			}
+			n := a.Len()
+			if err := a.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+			// Close adds acTL and IEND to the buffered chunks.
+			if got, want := buf.Len(), n+12+8+12; got != want {
+				t.Errorf("Close() wrote %d bytes, want Len() + 32 = %d", got, want)
+			}
+
+			// The animation can be decoded as a still image of its first frame.
+			got, err := stdpng.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("image/png can't decode the output: %v", err)
+			}
+			if err := sameImage(got, m); err != nil {
+				t.Errorf("first frame: %v", err)
+			}
+
+			cs, err := readChunks(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "IHDR acTL fcTL IDAT fcTL fdAT fcTL fdAT IEND"
+			if _, ok := m.(*image.Paletted); ok {
+				want = "IHDR PLTE acTL fcTL IDAT fcTL fdAT fcTL fdAT IEND"
+			}
+			if got := chunkOrder(cs); got != want {
+				t.Fatalf("chunks are %q, want %q", got, want)
+			}
+
+			var (
+				seq uint32
+				fs  []testFrame
+			)
+			checkSeq := func(c testChunk) {
+				if got := binary.BigEndian.Uint32(c.data); got != seq {
+					t.Errorf("%s chunk has sequence number %d, want %d", c.typ, got, seq)
+				}
+				seq++
+			}
+			for _, c := range cs {
+				switch c.typ {
+				case "acTL":
+					if got := binary.BigEndian.Uint32(c.data[0:4]); got != uint32(len(subs)) {
+						t.Errorf("acTL has %d frames, want %d", got, len(subs))
+					}
+					if got := binary.BigEndian.Uint32(c.data[4:8]); got != 0 {
+						t.Errorf("acTL has %d plays, want 0", got)
+					}
+				case "fcTL":
+					checkSeq(c)
+					d := c.data
+					x, y := int(binary.BigEndian.Uint32(d[12:16])), int(binary.BigEndian.Uint32(d[16:20]))
+					w, h := int(binary.BigEndian.Uint32(d[4:8])), int(binary.BigEndian.Uint32(d[8:12]))
+					fs = append(fs, testFrame{
+						bounds:  image.Rect(x, y, x+w, y+h),
+						num:     binary.BigEndian.Uint16(d[20:22]),
+						den:     binary.BigEndian.Uint16(d[22:24]),
+						dispose: d[24],
+						blend:   d[25],
+					})
+				case "IDAT":
+					f := &fs[len(fs)-1]
+					f.data = append(f.data, c.data...)
+				case "fdAT":
+					checkSeq(c)
+					f := &fs[len(fs)-1]
+					f.data = append(f.data, c.data[4:]...)
+				}
+			}
+			if len(fs) != len(subs) {
+				t.Fatalf("%d fcTL chunks, want %d", len(fs), len(subs))
+			}
+
+			for i, f := range fs {
+				s := subs[i]
+				if f.bounds != s.r {
+					t.Errorf("frame %d has bounds %v, want %v", i, f.bounds, s.r)
+				}
+				num, den := apngDelay(s.delay)
+				if f.num != num || f.den != den {
+					t.Errorf("frame %d has delay %d/%d, want %d/%d", i, f.num, f.den, num, den)
+				}
+				if f.dispose != apngDisposeNone || f.blend != apngBlendSource {
+					t.Errorf("frame %d has dispose %d and blend %d, want %d and %d", i, f.dispose, f.blend, apngDisposeNone, apngBlendSource)
+				}
+				// Decode the frame as a PNG of its own.
+				ihdr := append([]byte(nil), cs[0].data...)
+				binary.BigEndian.PutUint32(ihdr[0:4], uint32(f.bounds.Dx()))
+				binary.BigEndian.PutUint32(ihdr[4:8], uint32(f.bounds.Dy()))
+				b := appendChunk([]byte(pngHeader), "IHDR", ihdr)
+				if cs[1].typ == "PLTE" {
+					b = appendChunk(b, "PLTE", cs[1].data)
+				}
+				b = appendChunk(b, "IDAT", f.data)
+				b = appendChunk(b, "IEND", nil)
+				got, err := stdpng.Decode(bytes.NewReader(b))
+				if err != nil {
+					t.Errorf("frame %d: image/png can't decode it: %v", i, err)
+					continue
+				}
+				if err := sameImage(got, frames[i]); err != nil {
+					t.Errorf("frame %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAnimationErrors(t *testing.T) {
+	r := image.Rect(0, 0, 16, 16)
+	pal := func(p color.Palette) image.Image {
+		return image.NewPaletted(r, p)
+	}
+	tcs := []struct {
+		name   string
+		frames []image.Image
+		want   string
+	}{
+		{"NoFrames", nil, "png.FormatError"},
+		{"EmptyFirst", []image.Image{image.NewGray(image.Rectangle{})}, "png.FormatError"},
+		{"Empty", []image.Image{image.NewGray(r), image.NewGray(image.Rect(4, 4, 4, 8))}, "png.FormatError"},
+		{"Outside", []image.Image{image.NewGray(r), image.NewGray(image.Rect(8, 8, 17, 16))}, "png.FormatError"},
+		{"Before", []image.Image{image.NewGray(r.Add(image.Pt(1, 1))), image.NewGray(image.Rect(0, 0, 2, 2))}, "png.FormatError"},
+		{"Palette", []image.Image{
+			pal(color.Palette{color.Black, color.White}),
+			pal(color.Palette{color.White, color.Black}),
+		}, "png.UnsupportedError"},
+		{"PaletteSize", []image.Image{
+			pal(color.Palette{color.Black, color.White}),
+			pal(color.Palette{color.Black, color.White, color.Gray{0x80}}),
+		}, "png.UnsupportedError"},
+		{"Unpaletted", []image.Image{
+			pal(color.Palette{color.Black, color.White}),
+			image.NewGray(r),
+		}, "png.UnsupportedError"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			a := new(Encoder).NewAnimation(&buf)
+			var err error
+			for _, f := range tc.frames {
+				if err = a.WriteFrame(f, time.Second); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = a.Close()
+			} else if cerr := a.Close(); cerr != err {
+				t.Errorf("Close() = %v, want %v", cerr, err)
+			}
+			if got := fmt.Sprintf("%T", err); got != tc.want {
+				t.Errorf("error is %s (%v), want %s", got, err, tc.want)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("failed animation wrote %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestAPNGDelay(t *testing.T) {
+	tcs := []struct {
+		d        time.Duration
+		num, den uint16
+	}{
+		{-time.Second, 0, 1000},
+		{0, 0, 1000},
+		{400 * time.Microsecond, 0, 1000},
+		{1500 * time.Microsecond, 2, 1000},
+		{100 * time.Millisecond, 100, 1000},
+		{65535 * time.Millisecond, 65535, 1000},
+		{65535*time.Millisecond + 499*time.Microsecond, 65535, 1000},
+		{65535*time.Millisecond + 500*time.Microsecond, 6554, 100},
+		{65536 * time.Millisecond, 6554, 100},
+		{655350 * time.Millisecond, 65535, 100},
+		{655355 * time.Millisecond, 655, 1},
+		{time.Hour, 3600, 1},
+		{65535 * time.Second, 65535, 1},
+		{65535*time.Second + 500*time.Millisecond, 0xffff, 1},
+		{100 * time.Hour, 0xffff, 1},
+	}
+	for _, tc := range tcs {
+		if num, den := apngDelay(tc.d); num != tc.num || den != tc.den {
+			t.Errorf("apngDelay(%v) = %d/%d, want %d/%d", tc.d, num, den, tc.num, tc.den)
+		}
+	}
+}
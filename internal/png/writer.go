@@ -6,13 +6,19 @@ package png
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"compress/zlib"
 	"encoding/binary"
+	"hash"
+	"hash/adler32"
 	"hash/crc32"
 	"image"
 	"image/color"
 	"io"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // Encoder configures encoding PNG images.
@@ -22,6 +28,11 @@ type Encoder struct {
 	// BufferPool optionally specifies a buffer pool to get temporary
 	// EncoderBuffers when encoding an image.
 	BufferPool EncoderBufferPool
+
+	// Stripes optionally specifies the number of horizontal stripes, which
+	// are filtered and compressed concurrently. Values less than 2 encode the
+	// image on the calling goroutine.
+	Stripes int
 }
 
 // EncoderBufferPool is an interface for getting and returning temporary
@@ -44,8 +55,15 @@ type encoder struct {
 	header  [8]byte
 	footer  [4]byte
 	tmp     [4 * 256]byte
-	cr      [nFilter][]uint8
-	pr      []uint8
+	rows    rowWriter
+	stripes []*stripe
+	wg      sync.WaitGroup
+	// If fdAT is set, image data is written to fdAT chunks of an
+	// animation instead of IDAT chunks. seq is the sequence number of the
+	// next animation chunk and chunk a buffer for its data.
+	fdAT    bool
+	seq     uint32
+	chunk   []byte
 	zw      *zlib.Writer
 	zwLevel int
 	bw      *bufio.Writer
@@ -106,10 +124,9 @@ func (e *encoder) writeChunk(b []byte, name string) {
 	e.header[5] = name[1]
 	e.header[6] = name[2]
 	e.header[7] = name[3]
-	crc := crc32.NewIEEE()
-	crc.Write(e.header[4:8])
-	crc.Write(b)
-	binary.BigEndian.PutUint32(e.footer[:4], crc.Sum32())
+	crc := crc32.Update(0, crc32.IEEETable, e.header[4:8])
+	crc = crc32.Update(crc, crc32.IEEETable, b)
+	binary.BigEndian.PutUint32(e.footer[:4], crc)
 
 	_, e.err = e.w.Write(e.header[:8])
 	if e.err != nil {
@@ -172,7 +189,7 @@ func (e *encoder) writePLTEAndTRNS(p color.Palette) {
 	}
 	last := -1
 	for i, c := range p {
-		c1 := color.NRGBAModel.Convert(c).(color.NRGBA)
+		c1 := toNRGBA(c)
 		e.tmp[3*i+0] = c1.R
 		e.tmp[3*i+1] = c1.G
 		e.tmp[3*i+2] = c1.B
@@ -187,6 +204,25 @@ func (e *encoder) writePLTEAndTRNS(p color.Palette) {
 	}
 }
 
+// toNRGBA is like color.NRGBAModel.Convert, but doesn't allocate.
+func toNRGBA(c color.Color) color.NRGBA {
+	if c, ok := c.(color.NRGBA); ok {
+		return c
+	}
+	r, g, b, a := c.RGBA()
+	switch a {
+	case 0xffff:
+		return color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}
+	case 0:
+		return color.NRGBA{}
+	}
+	// Since Color.RGBA returns an alpha-premultiplied color, we should have r <= a && g <= a && b <= a.
+	r = (r * 0xffff) / a
+	g = (g * 0xffff) / a
+	b = (b * 0xffff) / a
+	return color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
 // An encoder is an io.Writer that satisfies writes by writing PNG IDAT chunks,
 // including an 8-byte header and 4-byte CRC checksum per Write call. Such calls
 // should be relatively infrequent, since writeIDATs uses a bufio.Writer.
@@ -194,7 +230,11 @@ func (e *encoder) writePLTEAndTRNS(p color.Palette) {
 // This method should only be called from writeIDATs (via writeImage).
 // No other code should treat an encoder as an io.Writer.
 func (e *encoder) Write(b []byte) (int, error) {
-	e.writeChunk(b, "IDAT")
+	if e.fdAT {
+		e.writeFDAT(b)
+	} else {
+		e.writeChunk(b, "IDAT")
+	}
 	if e.err != nil {
 		return 0, e.err
 	}
@@ -301,227 +341,465 @@ func zeroMemory(v []uint8) {
 	}
 }
 
-func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) error {
-	if e.zw == nil || e.zwLevel != level {
-		zw, err := zlib.NewWriterLevel(w, level)
-		if err != nil {
-			return err
-		}
-		e.zw = zw
-		e.zwLevel = level
-	} else {
-		e.zw.Reset(w)
-	}
-	defer e.zw.Close()
-
-	bitsPerPixel := 0
-
+// bitsPerPixel returns the number of bits per pixel of the color type cb.
+func bitsPerPixel(cb int) int {
 	switch cb {
 	case cbG8:
-		bitsPerPixel = 8
+		return 8
 	case cbTC8:
-		bitsPerPixel = 24
+		return 24
 	case cbP8:
-		bitsPerPixel = 8
+		return 8
 	case cbP4:
-		bitsPerPixel = 4
+		return 4
 	case cbP2:
-		bitsPerPixel = 2
+		return 2
 	case cbP1:
-		bitsPerPixel = 1
+		return 1
 	case cbTCA8:
-		bitsPerPixel = 32
+		return 32
 	case cbTC16:
-		bitsPerPixel = 48
+		return 48
 	case cbTCA16:
-		bitsPerPixel = 64
+		return 64
 	case cbG16:
-		bitsPerPixel = 16
+		return 16
 	}
+	return 0
+}
 
+// rowWriter converts, filters and writes consecutive rows of an image.
+type rowWriter struct {
 	// cr[*] and pr are the bytes for the current and previous row.
 	// cr[0] is unfiltered (or equivalently, filtered with the ftNone filter).
 	// cr[ft], for non-zero filter types ft, are buffers for transforming cr[0] under the
 	// other PNG filter types. These buffers are allocated once and re-used for each row.
 	// The +1 is for the per-row filter type, which is at cr[*][0].
+	cr [nFilter][]uint8
+	pr []uint8
+}
+
+// reset prepares rw for writing rows of m, starting at row y.
+func (rw *rowWriter) reset(m image.Image, cb int, y int) {
 	b := m.Bounds()
-	sz := 1 + (bitsPerPixel*b.Dx()+7)/8
-	for i := range e.cr {
-		if cap(e.cr[i]) < sz {
-			e.cr[i] = make([]uint8, sz)
+	sz := 1 + (bitsPerPixel(cb)*b.Dx()+7)/8
+	for i := range rw.cr {
+		if cap(rw.cr[i]) < sz {
+			rw.cr[i] = make([]uint8, sz)
 		} else {
-			e.cr[i] = e.cr[i][:sz]
+			rw.cr[i] = rw.cr[i][:sz]
 		}
-		e.cr[i][0] = uint8(i)
+		rw.cr[i][0] = uint8(i)
 	}
-	cr := e.cr
-	if cap(e.pr) < sz {
-		e.pr = make([]uint8, sz)
+	if cap(rw.pr) < sz {
+		rw.pr = make([]uint8, sz)
 	} else {
-		e.pr = e.pr[:sz]
-		zeroMemory(e.pr)
+		rw.pr = rw.pr[:sz]
+		zeroMemory(rw.pr)
 	}
-	pr := e.pr
+	// Rows are filtered relative to the previous row, which is all zeros
+	// for the first one.
+	if y > b.Min.Y {
+		convertRow(rw.pr, m, cb, y-1)
+	}
+}
 
-	gray, _ := m.(*image.Gray)
-	gray16, _ := m.(*image.Gray16)
-	rgba, _ := m.(*image.RGBA)
-	paletted, _ := m.(*image.Paletted)
-	nrgba, _ := m.(*image.NRGBA)
+// writeRows writes the rows y0 to y1 (exclusive) of m. reset must have been
+// called with y0 before.
+func (rw *rowWriter) writeRows(w io.Writer, m image.Image, cb int, level int, y0, y1 int) error {
+	for y := y0; y < y1; y++ {
+		convertRow(rw.cr[0], m, cb, y)
 
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		// Convert from colors to bytes.
-		i := 1
-		switch cb {
-		case cbG8:
-			if gray != nil {
-				offset := (y - b.Min.Y) * gray.Stride
-				copy(cr[0][1:], gray.Pix[offset:offset+b.Dx()])
-			} else {
-				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.GrayModel.Convert(m.At(x, y)).(color.Gray)
-					cr[0][i] = c.Y
-					i++
-				}
-			}
-		case cbTC8:
-			// We have previously verified that the alpha value is fully opaque.
-			cr0 := cr[0]
-			stride, pix := 0, []byte(nil)
-			if rgba != nil {
-				stride, pix = rgba.Stride, rgba.Pix
-			} else if nrgba != nil {
-				stride, pix = nrgba.Stride, nrgba.Pix
+		// Apply the filter.
+		// Skip filter for NoCompression and paletted images (cbP8) as
+		// "filters are rarely useful on palette images" and will result
+		// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
+		f := ftNone
+		if level != zlib.NoCompression && cb != cbP8 && cb != cbP4 && cb != cbP2 && cb != cbP1 {
+			// Since we skip paletted images we don't have to worry about
+			// bitsPerPixel not being a multiple of 8
+			bpp := bitsPerPixel(cb) / 8
+			f = filter(&rw.cr, rw.pr, bpp)
+		}
+
+		// Write the compressed bytes.
+		if _, err := w.Write(rw.cr[f]); err != nil {
+			return err
+		}
+
+		// The current row for y is the previous row for y+1.
+		rw.pr, rw.cr[0] = rw.cr[0], rw.pr
+	}
+	return nil
+}
+
+// convertRow converts row y of m to bytes in the format of cb and stores them
+// in cr0[1:].
+func convertRow(cr0 []uint8, m image.Image, cb int, y int) {
+	b := m.Bounds()
+	i := 1
+	switch cb {
+	case cbG8:
+		if gray, ok := m.(*image.Gray); ok {
+			offset := (y - b.Min.Y) * gray.Stride
+			copy(cr0[1:], gray.Pix[offset:offset+b.Dx()])
+		} else {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.GrayModel.Convert(m.At(x, y)).(color.Gray)
+				cr0[i] = c.Y
+				i++
 			}
-			if stride != 0 {
-				j0 := (y - b.Min.Y) * stride
-				j1 := j0 + b.Dx()*4
-				for j := j0; j < j1; j += 4 {
-					cr0[i+0] = pix[j+0]
-					cr0[i+1] = pix[j+1]
-					cr0[i+2] = pix[j+2]
-					i += 3
-				}
-			} else {
-				for x := b.Min.X; x < b.Max.X; x++ {
-					r, g, b, _ := m.At(x, y).RGBA()
-					cr0[i+0] = uint8(r >> 8)
-					cr0[i+1] = uint8(g >> 8)
-					cr0[i+2] = uint8(b >> 8)
-					i += 3
-				}
+		}
+	case cbTC8:
+		// We have previously verified that the alpha value is fully opaque.
+		stride, pix := 0, []byte(nil)
+		if rgba, ok := m.(*image.RGBA); ok {
+			stride, pix = rgba.Stride, rgba.Pix
+		} else if nrgba, ok := m.(*image.NRGBA); ok {
+			stride, pix = nrgba.Stride, nrgba.Pix
+		}
+		if stride != 0 {
+			j0 := (y - b.Min.Y) * stride
+			j1 := j0 + b.Dx()*4
+			for j := j0; j < j1; j += 4 {
+				cr0[i+0] = pix[j+0]
+				cr0[i+1] = pix[j+1]
+				cr0[i+2] = pix[j+2]
+				i += 3
 			}
-		case cbP8:
-			if paletted != nil {
-				offset := (y - b.Min.Y) * paletted.Stride
-				copy(cr[0][1:], paletted.Pix[offset:offset+b.Dx()])
-			} else {
-				pi := m.(image.PalettedImage)
-				for x := b.Min.X; x < b.Max.X; x++ {
-					cr[0][i] = pi.ColorIndexAt(x, y)
-					i += 1
-				}
+		} else {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, b, _ := m.At(x, y).RGBA()
+				cr0[i+0] = uint8(r >> 8)
+				cr0[i+1] = uint8(g >> 8)
+				cr0[i+2] = uint8(b >> 8)
+				i += 3
 			}
-
-		case cbP4, cbP2, cbP1:
+		}
+	case cbP8:
+		if paletted, ok := m.(*image.Paletted); ok {
+			offset := (y - b.Min.Y) * paletted.Stride
+			copy(cr0[1:], paletted.Pix[offset:offset+b.Dx()])
+		} else {
 			pi := m.(image.PalettedImage)
-
-			var a uint8
-			var c int
 			for x := b.Min.X; x < b.Max.X; x++ {
-				a = a<<uint(bitsPerPixel) | pi.ColorIndexAt(x, y)
-				c++
-				if c == 8/bitsPerPixel {
-					cr[0][i] = a
-					i += 1
-					a = 0
-					c = 0
-				}
-			}
-			if c != 0 {
-				for c != 8/bitsPerPixel {
-					a = a << uint(bitsPerPixel)
-					c++
-				}
-				cr[0][i] = a
+				cr0[i] = pi.ColorIndexAt(x, y)
+				i += 1
 			}
+		}
 
-		case cbTCA8:
-			if nrgba != nil {
-				offset := (y - b.Min.Y) * nrgba.Stride
-				copy(cr[0][1:], nrgba.Pix[offset:offset+b.Dx()*4])
-			} else {
-				// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
-				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
-					cr[0][i+0] = c.R
-					cr[0][i+1] = c.G
-					cr[0][i+2] = c.B
-					cr[0][i+3] = c.A
-					i += 4
-				}
+	case cbP4, cbP2, cbP1:
+		pi := m.(image.PalettedImage)
+		bitsPerPixel := bitsPerPixel(cb)
+
+		var a uint8
+		var c int
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a = a<<uint(bitsPerPixel) | pi.ColorIndexAt(x, y)
+			c++
+			if c == 8/bitsPerPixel {
+				cr0[i] = a
+				i += 1
+				a = 0
+				c = 0
 			}
-		case cbG16:
-			if gray16 != nil {
-				offset := (y - b.Min.Y) * gray16.Stride
-				copy(cr[0][1:], gray16.Pix[offset:offset+gray16.Stride])
-			} else {
-				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
-					cr[0][i+0] = uint8(c.Y >> 8)
-					cr[0][i+1] = uint8(c.Y)
-					i += 2
-				}
+		}
+		if c != 0 {
+			for c != 8/bitsPerPixel {
+				a = a << uint(bitsPerPixel)
+				c++
 			}
-		case cbTC16:
-			// We have previously verified that the alpha value is fully opaque.
+			cr0[i] = a
+		}
+
+	case cbTCA8:
+		if nrgba, ok := m.(*image.NRGBA); ok {
+			offset := (y - b.Min.Y) * nrgba.Stride
+			copy(cr0[1:], nrgba.Pix[offset:offset+b.Dx()*4])
+		} else {
+			// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
 			for x := b.Min.X; x < b.Max.X; x++ {
-				r, g, b, _ := m.At(x, y).RGBA()
-				cr[0][i+0] = uint8(r >> 8)
-				cr[0][i+1] = uint8(r)
-				cr[0][i+2] = uint8(g >> 8)
-				cr[0][i+3] = uint8(g)
-				cr[0][i+4] = uint8(b >> 8)
-				cr[0][i+5] = uint8(b)
-				i += 6
+				c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+				cr0[i+0] = c.R
+				cr0[i+1] = c.G
+				cr0[i+2] = c.B
+				cr0[i+3] = c.A
+				i += 4
 			}
-		case cbTCA16:
-			// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
+		}
+	case cbG16:
+		if gray16, ok := m.(*image.Gray16); ok {
+			offset := (y - b.Min.Y) * gray16.Stride
+			copy(cr0[1:], gray16.Pix[offset:offset+2*b.Dx()])
+		} else {
 			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
-				cr[0][i+0] = uint8(c.R >> 8)
-				cr[0][i+1] = uint8(c.R)
-				cr[0][i+2] = uint8(c.G >> 8)
-				cr[0][i+3] = uint8(c.G)
-				cr[0][i+4] = uint8(c.B >> 8)
-				cr[0][i+5] = uint8(c.B)
-				cr[0][i+6] = uint8(c.A >> 8)
-				cr[0][i+7] = uint8(c.A)
-				i += 8
+				c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
+				cr0[i+0] = uint8(c.Y >> 8)
+				cr0[i+1] = uint8(c.Y)
+				i += 2
 			}
 		}
+	case cbTC16:
+		// We have previously verified that the alpha value is fully opaque.
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			cr0[i+0] = uint8(r >> 8)
+			cr0[i+1] = uint8(r)
+			cr0[i+2] = uint8(g >> 8)
+			cr0[i+3] = uint8(g)
+			cr0[i+4] = uint8(b >> 8)
+			cr0[i+5] = uint8(b)
+			i += 6
+		}
+	case cbTCA16:
+		// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+			cr0[i+0] = uint8(c.R >> 8)
+			cr0[i+1] = uint8(c.R)
+			cr0[i+2] = uint8(c.G >> 8)
+			cr0[i+3] = uint8(c.G)
+			cr0[i+4] = uint8(c.B >> 8)
+			cr0[i+5] = uint8(c.B)
+			cr0[i+6] = uint8(c.A >> 8)
+			cr0[i+7] = uint8(c.A)
+			i += 8
+		}
+	}
+}
 
-		// Apply the filter.
-		// Skip filter for NoCompression and paletted images (cbP8) as
-		// "filters are rarely useful on palette images" and will result
-		// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
-		f := ftNone
-		if level != zlib.NoCompression && cb != cbP8 && cb != cbP4 && cb != cbP2 && cb != cbP1 {
-			// Since we skip paletted images we don't have to worry about
-			// bitsPerPixel not being a multiple of 8
-			bpp := bitsPerPixel / 8
-			f = filter(&cr, pr, bpp)
+func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) error {
+	if e.zw == nil || e.zwLevel != level {
+		zw, err := zlib.NewWriterLevel(w, level)
+		if err != nil {
+			return err
 		}
+		e.zw = zw
+		e.zwLevel = level
+	} else {
+		e.zw.Reset(w)
+	}
+	defer e.zw.Close()
 
-		// Write the compressed bytes.
-		if _, err := e.zw.Write(cr[f]); err != nil {
+	b := m.Bounds()
+	e.rows.reset(m, cb, b.Min.Y)
+	return e.rows.writeRows(e.zw, m, cb, level, b.Min.Y, b.Max.Y)
+}
+
+// minStripeHeight is the minimum number of rows per stripe. Smaller stripes
+// compress worse without a noticeable speedup.
+const minStripeHeight = 16
+
+// A stripe is a range of rows of an image, which is compressed independently
+// of the other stripes.
+type stripe struct {
+	// m, cb, level, y0, y1 and last describe what to encode. They are set
+	// before the stripe is sent to a worker, which calls wg.Done when it is
+	// done.
+	m      image.Image
+	cb     int
+	level  int
+	y0, y1 int
+	last   bool
+	wg     *sync.WaitGroup
+
+	rows    rowWriter
+	fw      *flate.Writer
+	fwLevel int
+	buf     bytes.Buffer
+	// sum is the Adler-32 checksum of the uncompressed data and n its
+	// length.
+	sum hash.Hash32
+	n   int64
+	err error
+}
+
+func (s *stripe) Write(p []byte) (int, error) {
+	s.sum.Write(p)
+	s.n += int64(len(p))
+	return s.fw.Write(p)
+}
+
+// encode compresses the rows y0 to y1 (exclusive) of m into s.buf. If last is
+// not set, the deflate stream is ended with a sync flush, so that another
+// stream can be appended to it. Otherwise it is terminated.
+func (s *stripe) encode() {
+	s.buf.Reset()
+	s.n = 0
+	if s.sum == nil {
+		s.sum = adler32.New()
+	} else {
+		s.sum.Reset()
+	}
+	if s.fw == nil || s.fwLevel != s.level {
+		if s.fw, s.err = flate.NewWriter(&s.buf, s.level); s.err != nil {
+			return
+		}
+		s.fwLevel = s.level
+	} else {
+		s.fw.Reset(&s.buf)
+	}
+	s.rows.reset(s.m, s.cb, s.y0)
+	if s.err = s.rows.writeRows(s, s.m, s.cb, s.level, s.y0, s.y1); s.err != nil {
+		return
+	}
+	if s.last {
+		s.err = s.fw.Close()
+	} else {
+		s.err = s.fw.Flush()
+	}
+}
+
+// Stripes are encoded by a set of worker goroutines shared by all encoders,
+// so encoding doesn't allocate for starting goroutines. There are as many
+// workers as the largest number of stripes requested so far. Once no encoder
+// used them for stripeIdle, they exit.
+var (
+	stripeMu      sync.Mutex
+	stripeWorkers int
+	// stripeUsers is the number of encoders currently encoding stripes.
+	// Workers don't exit while it is positive, so all stripes are
+	// received.
+	stripeUsers int
+	stripeIdle  = time.Minute
+	stripeWork  = make(chan *stripe)
+)
+
+// startStripeWorkers makes sure there are at least n workers, until
+// stopStripeWorkers is called.
+func startStripeWorkers(n int) {
+	stripeMu.Lock()
+	defer stripeMu.Unlock()
+	stripeUsers++
+	for ; stripeWorkers < n; stripeWorkers++ {
+		go stripeWorker(stripeIdle)
+	}
+}
+
+// stopStripeWorkers allows the workers to exit, once they are idle.
+func stopStripeWorkers() {
+	stripeMu.Lock()
+	defer stripeMu.Unlock()
+	stripeUsers--
+}
+
+func stripeWorker(idle time.Duration) {
+	t := time.NewTimer(idle)
+	for {
+		select {
+		case s := <-stripeWork:
+			s.encode()
+			// Don't keep the image alive.
+			s.m = nil
+			s.wg.Done()
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+		case <-t.C:
+			stripeMu.Lock()
+			if stripeUsers == 0 {
+				stripeWorkers--
+				stripeMu.Unlock()
+				return
+			}
+			stripeMu.Unlock()
+		}
+		stripeMu.Lock()
+		idle = stripeIdle
+		stripeMu.Unlock()
+		t.Reset(idle)
+	}
+}
+
+// writeImageStripes is like writeImage, but splits the image into n stripes,
+// which are compressed concurrently. A sync flush aligns the end of each but
+// the last stripe's deflate data to a byte boundary, so they can be
+// concatenated into a single zlib stream.
+func (e *encoder) writeImageStripes(w io.Writer, m image.Image, cb int, level int, n int) error {
+	b := m.Bounds()
+	if max := b.Dy() / minStripeHeight; n > max {
+		n = max
+	}
+	if n < 2 {
+		return e.writeImage(w, m, cb, level)
+	}
+	for len(e.stripes) < n {
+		e.stripes = append(e.stripes, new(stripe))
+	}
+	startStripeWorkers(n)
+	defer stopStripeWorkers()
+
+	e.wg.Add(n)
+	for i, s := range e.stripes[:n] {
+		s.m, s.cb, s.level = m, cb, level
+		s.y0 = b.Min.Y + i*b.Dy()/n
+		s.y1 = b.Min.Y + (i+1)*b.Dy()/n
+		s.last = i == n-1
+		s.wg = &e.wg
+		stripeWork <- s
+	}
+	e.wg.Wait()
+
+	binary.BigEndian.PutUint16(e.tmp[:2], zlibHeader(level))
+	if _, err := w.Write(e.tmp[:2]); err != nil {
+		return err
+	}
+	var sum uint32 = 1
+	for _, s := range e.stripes[:n] {
+		if s.err != nil {
+			return s.err
+		}
+		if _, err := w.Write(s.buf.Bytes()); err != nil {
 			return err
 		}
+		sum = adler32Combine(sum, s.sum.Sum32(), s.n)
+	}
+	binary.BigEndian.PutUint32(e.tmp[:4], sum)
+	_, err := w.Write(e.tmp[:4])
+	return err
+}
 
-		// The current row for y is the previous row for y+1.
-		pr, cr[0] = cr[0], pr
+// zlibHeader returns the two byte header zlib.Writer writes for level.
+func zlibHeader(level int) uint16 {
+	h := uint16(0x78) << 8
+	switch level {
+	case zlib.NoCompression, zlib.HuffmanOnly, zlib.BestSpeed:
+		h |= 0 << 6
+	case 2, 3, 4, 5:
+		h |= 1 << 6
+	case 6, zlib.DefaultCompression:
+		h |= 2 << 6
+	default:
+		h |= 3 << 6
 	}
-	return nil
+	return h + 31 - h%31
+}
+
+// adler32Combine returns the Adler-32 checksum of the concatenation of two
+// byte sequences, given their checksums and the length of the second one.
+func adler32Combine(sum1, sum2 uint32, len2 int64) uint32 {
+	const mod = 65521
+	rem := uint32(len2 % mod)
+	a := sum1 & 0xffff
+	b := (rem * a) % mod
+	a += (sum2 & 0xffff) + mod - 1
+	b += (sum1 >> 16) + (sum2 >> 16) + mod - rem
+	if a >= mod {
+		a -= mod
+	}
+	if a >= mod {
+		a -= mod
+	}
+	if b >= 2*mod {
+		b -= 2 * mod
+	}
+	if b >= mod {
+		b -= mod
+	}
+	return a | b<<16
 }
 
 // Write the actual image data to one or more IDAT chunks.
@@ -534,7 +812,11 @@ func (e *encoder) writeIDATs() {
 	} else {
 		e.bw.Reset(e)
 	}
-	e.err = e.writeImage(e.bw, e.m, e.cb, levelToZlib(e.enc.CompressionLevel))
+	if e.enc.Stripes > 1 {
+		e.err = e.writeImageStripes(e.bw, e.m, e.cb, levelToZlib(e.enc.CompressionLevel), e.enc.Stripes)
+	} else {
+		e.err = e.writeImage(e.bw, e.m, e.cb, levelToZlib(e.enc.CompressionLevel))
+	}
 	if e.err != nil {
 		return
 	}
@@ -567,6 +849,44 @@ func Encode(w io.Writer, m image.Image) error {
 	return e.Encode(w, m)
 }
 
+// colorType returns the color type to encode m with and its palette, if it is
+// paletted.
+func colorType(m image.Image) (cb int, pal color.Palette) {
+	// cbP8 encoding needs PalettedImage's ColorIndexAt method.
+	if p, ok := m.(*image.Paletted); ok {
+		// Avoid allocating for converting the palette to a color.Model.
+		pal = p.Palette
+	} else if _, ok := m.(image.PalettedImage); ok {
+		pal, _ = m.ColorModel().(color.Palette)
+	}
+	if pal != nil {
+		if len(pal) <= 2 {
+			return cbP1, pal
+		} else if len(pal) <= 4 {
+			return cbP2, pal
+		} else if len(pal) <= 16 {
+			return cbP4, pal
+		}
+		return cbP8, pal
+	}
+	switch m.ColorModel() {
+	case color.GrayModel:
+		return cbG8, nil
+	case color.Gray16Model:
+		return cbG16, nil
+	case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
+		if opaque(m) {
+			return cbTC8, nil
+		}
+		return cbTCA8, nil
+	default:
+		if opaque(m) {
+			return cbTC16, nil
+		}
+		return cbTCA16, nil
+	}
+}
+
 // Encode writes the Image m to w in PNG format.
 func (enc *Encoder) Encode(w io.Writer, m image.Image) error {
 	// Obviously, negative widths and heights are invalid. Furthermore, the PNG
@@ -593,42 +913,10 @@ func (enc *Encoder) Encode(w io.Writer, m image.Image) error {
 	e.enc = enc
 	e.w = w
 	e.m = m
+	e.fdAT = false
 
 	var pal color.Palette
-	// cbP8 encoding needs PalettedImage's ColorIndexAt method.
-	if _, ok := m.(image.PalettedImage); ok {
-		pal, _ = m.ColorModel().(color.Palette)
-	}
-	if pal != nil {
-		if len(pal) <= 2 {
-			e.cb = cbP1
-		} else if len(pal) <= 4 {
-			e.cb = cbP2
-		} else if len(pal) <= 16 {
-			e.cb = cbP4
-		} else {
-			e.cb = cbP8
-		}
-	} else {
-		switch m.ColorModel() {
-		case color.GrayModel:
-			e.cb = cbG8
-		case color.Gray16Model:
-			e.cb = cbG16
-		case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
-			if opaque(m) {
-				e.cb = cbTC8
-			} else {
-				e.cb = cbTCA8
-			}
-		default:
-			if opaque(m) {
-				e.cb = cbTC16
-			} else {
-				e.cb = cbTCA16
-			}
-		}
-	}
+	e.cb, pal = colorType(m)
 
 	_, e.err = io.WriteString(w, pngHeader)
 	e.writeIHDR()
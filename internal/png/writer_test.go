@@ -0,0 +1,216 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package png
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testImages returns images of all frame types, with content exercising all
+// filters.
+func testImages(r image.Rectangle) []image.Image {
+	rnd := rand.New(rand.NewSource(1))
+	gray := image.NewGray(r)
+	gray16 := image.NewGray16(r)
+	rgba := image.NewRGBA(r)
+	pal := image.NewPaletted(r, color.Palette{color.Black, color.White, color.Gray{0x80}, color.RGBA{0xff, 0, 0, 0xff}})
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			// Smooth gradients in the left half, noise in the right one.
+			v := uint16(x*0x101 + y*0x37)
+			if x-r.Min.X > r.Dx()/2 {
+				v = uint16(rnd.Intn(0x10000))
+			}
+			gray.SetGray(x, y, color.Gray{uint8(v >> 8)})
+			gray16.SetGray16(x, y, color.Gray16{v})
+			rgba.SetRGBA(x, y, color.RGBA{uint8(v >> 8), uint8(v), uint8(x ^ y), 0xff})
+			pal.SetColorIndex(x, y, uint8(v%4))
+		}
+	}
+	return []image.Image{gray, gray16, rgba, pal}
+}
+
+func TestEncodeStripes(t *testing.T) {
+	sizes := []image.Rectangle{
+		image.Rect(0, 0, 1, 1),
+		image.Rect(0, 0, 37, 15),
+		image.Rect(0, 0, 101, 100),
+		image.Rect(3, 5, 64, 260),
+	}
+	for _, r := range sizes {
+		for _, m := range testImages(r) {
+			for _, stripes := range []int{1, 2, 3, 8} {
+				for _, level := range []CompressionLevel{DefaultCompression, BestSpeed, BestCompression, NoCompression} {
+					name := fmt.Sprintf("%T/%v/stripes=%d/level=%d", m, r, stripes, level)
+					enc := &Encoder{CompressionLevel: level, Stripes: stripes}
+					buf := new(bytes.Buffer)
+					if err := enc.Encode(buf, m); err != nil {
+						t.Fatalf("%s: Encode() = %v", name, err)
+					}
+					got, err := stdpng.Decode(buf)
+					if err != nil {
+						t.Fatalf("%s: image/png can't decode the output: %v", name, err)
+					}
+					if err := sameImage(got, m); err != nil {
+						t.Errorf("%s: %v", name, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// sameImage returns an error, if got doesn't have the size and colors of want.
+func sameImage(got, want image.Image) error {
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Size() != wb.Size() {
+		return fmt.Errorf("decoded size %v, want %v", gb.Size(), wb.Size())
+	}
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			g := color.RGBA64Model.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			w := color.RGBA64Model.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			if g != w {
+				return fmt.Errorf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return nil
+}
+
+// BenchmarkEncodeStripes compares encoding a screen of the reMarkable in a
+// single stripe with encoding it in several stripes. The benefit depends on
+// the number of CPUs.
+func BenchmarkEncodeStripes(b *testing.B) {
+	// Mostly white, with some handwriting-like noise.
+	m := image.NewGray16(image.Rect(0, 0, 1404, 1872))
+	rnd := rand.New(rand.NewSource(1))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+	for i := 0; i < 2000; i++ {
+		x, y := rnd.Intn(1380), rnd.Intn(1850)
+		for j := 0; j < 20; j++ {
+			m.SetGray16(x+j, y+j/2, color.Gray16{uint16(rnd.Intn(0x10000))})
+		}
+	}
+	for _, stripes := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("stripes=%d", stripes), func(b *testing.B) {
+			enc := &Encoder{CompressionLevel: BestSpeed, Stripes: stripes}
+			b.SetBytes(int64(len(m.Pix)))
+			for i := 0; i < b.N; i++ {
+				if err := enc.Encode(io.Discard, m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// testPool is an EncoderBufferPool holding a single buffer. Unlike a
+// sync.Pool, it never drops it.
+type testPool struct {
+	b *EncoderBuffer
+}
+
+func (p *testPool) Get() *EncoderBuffer {
+	b := p.b
+	p.b = nil
+	return b
+}
+
+func (p *testPool) Put(b *EncoderBuffer) {
+	p.b = b
+}
+
+func TestEncodeAllocs(t *testing.T) {
+	for _, m := range testImages(image.Rect(0, 0, 200, 150)) {
+		for _, stripes := range []int{1, 4} {
+			enc := &Encoder{CompressionLevel: BestSpeed, BufferPool: new(testPool), Stripes: stripes}
+			// The first run allocates the buffers.
+			if err := enc.Encode(io.Discard, m); err != nil {
+				t.Fatal(err)
+			}
+			n := testing.AllocsPerRun(10, func() {
+				enc.Encode(io.Discard, m)
+			})
+			if n != 0 {
+				t.Errorf("Encode(%T) with %d stripes: %v allocations, want 0", m, stripes, n)
+			}
+		}
+	}
+}
+
+func TestStripeWorkersExit(t *testing.T) {
+	stripeMu.Lock()
+	idle, before := stripeIdle, stripeWorkers
+	stripeIdle = 10 * time.Millisecond
+	stripeMu.Unlock()
+	defer func() {
+		stripeMu.Lock()
+		stripeIdle = idle
+		stripeMu.Unlock()
+	}()
+	workers := func() int {
+		stripeMu.Lock()
+		defer stripeMu.Unlock()
+		return stripeWorkers
+	}
+
+	// Request more stripes than before, to start new workers.
+	n := before + 2
+	m := testImages(image.Rect(0, 0, 64, n*minStripeHeight))[1]
+	enc := &Encoder{CompressionLevel: BestSpeed, Stripes: n}
+	var want bytes.Buffer
+	if err := enc.Encode(&want, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := workers(); got < n {
+		t.Fatalf("%d workers for %d stripes", got, n)
+	}
+	for deadline := time.Now().Add(5 * time.Second); workers() > before; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers still running, want at most %d", workers(), before)
+		}
+	}
+	// Exited workers are started again.
+	var got bytes.Buffer
+	if err := enc.Encode(&got, m); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("Encode() after workers exited differs")
+	}
+}
+
+func BenchmarkEncodePool(b *testing.B) {
+	m := testImages(image.Rect(0, 0, 1404, 1872))[1]
+	enc := &Encoder{CompressionLevel: BestSpeed, BufferPool: new(testPool)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(m.(*image.Gray16).Pix)))
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(io.Discard, m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
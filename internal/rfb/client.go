@@ -0,0 +1,217 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rfb
+
+import (
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ServerInit describes the framebuffer of the server.
+type ServerInit struct {
+	Width  int
+	Height int
+	Format PixelFormat
+	Name   string
+}
+
+// ClientHandshake performs the client side of the handshake, up to and
+// including the ServerInit message. It supports servers speaking versions
+// 3.3, 3.7 and 3.8 of the protocol. If the server requires VNC
+// authentication, password is used.
+func ClientHandshake(rw io.ReadWriter, password string) (*ServerInit, error) {
+	var v [12]byte
+	if _, err := io.ReadFull(rw, v[:]); err != nil {
+		return nil, err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(v[:]), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 || minor < 3 {
+		return nil, fmt.Errorf("unsupported protocol version %q", v)
+	}
+	switch {
+	case minor >= 8:
+		minor = 8
+	case minor >= 7:
+		minor = 7
+	default:
+		minor = 3
+	}
+	if _, err := fmt.Fprintf(rw, "RFB 003.%03d\n", minor); err != nil {
+		return nil, err
+	}
+
+	var sec uint8
+	if minor == 3 {
+		var t uint32
+		if err := binary.Read(rw, binary.BigEndian, &t); err != nil {
+			return nil, err
+		}
+		if t == SecInvalid {
+			return nil, readReason(rw)
+		}
+		sec = uint8(t)
+	} else {
+		var n [1]byte
+		if _, err := io.ReadFull(rw, n[:]); err != nil {
+			return nil, err
+		}
+		if n[0] == 0 {
+			return nil, readReason(rw)
+		}
+		types := make([]byte, n[0])
+		if _, err := io.ReadFull(rw, types); err != nil {
+			return nil, err
+		}
+		for _, t := range types {
+			if t == SecNone || (t == SecVNCAuth && sec != SecNone) {
+				sec = t
+			}
+		}
+		if sec == SecInvalid {
+			return nil, fmt.Errorf("unsupported security types %v", types)
+		}
+		if _, err := rw.Write([]byte{sec}); err != nil {
+			return nil, err
+		}
+	}
+
+	switch sec {
+	case SecNone:
+	case SecVNCAuth:
+		if err := vncAuth(rw, password); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported security type %d", sec)
+	}
+	if sec == SecVNCAuth || minor >= 8 {
+		var res uint32
+		if err := binary.Read(rw, binary.BigEndian, &res); err != nil {
+			return nil, err
+		}
+		if res != 0 {
+			if minor >= 8 {
+				return nil, readReason(rw)
+			}
+			return nil, errors.New("authentication failed")
+		}
+	}
+
+	// ClientInit: Ask to share the screen with other clients.
+	if _, err := rw.Write([]byte{1}); err != nil {
+		return nil, err
+	}
+	var b [24]byte
+	if _, err := io.ReadFull(rw, b[:]); err != nil {
+		return nil, err
+	}
+	si := &ServerInit{
+		Width:  int(binary.BigEndian.Uint16(b[0:])),
+		Height: int(binary.BigEndian.Uint16(b[2:])),
+		Format: unmarshalPixelFormat(b[4:20]),
+	}
+	n := binary.BigEndian.Uint32(b[20:])
+	if n > maxNameLength {
+		return nil, fmt.Errorf("desktop name too long: %d bytes", n)
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(rw, name); err != nil {
+		return nil, err
+	}
+	si.Name = string(name)
+	return si, nil
+}
+
+// readReason reads the reason for a failed handshake and returns it as an
+// error.
+func readReason(r io.Reader) error {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	if n > maxReasonLength {
+		return fmt.Errorf("reason too long: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return fmt.Errorf("server refused connection: %s", b)
+}
+
+// vncAuth answers the challenge of VNC authentication, which is encrypted
+// with DES, using the password as the key. For historical reasons, the bits
+// of every byte of the key are reversed.
+func vncAuth(rw io.ReadWriter, password string) error {
+	var challenge [16]byte
+	if _, err := io.ReadFull(rw, challenge[:]); err != nil {
+		return err
+	}
+	var key [8]byte
+	copy(key[:], password)
+	for i, b := range key {
+		var r uint8
+		for j := 0; j < 8; j++ {
+			r = r<<1 | b>>uint(j)&1
+		}
+		key[i] = r
+	}
+	c, err := des.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	c.Encrypt(challenge[:8], challenge[:8])
+	c.Encrypt(challenge[8:], challenge[8:])
+	_, err = rw.Write(challenge[:])
+	return err
+}
+
+// WriteSetPixelFormat asks the server to send pixels in the given format.
+func WriteSetPixelFormat(w io.Writer, pf PixelFormat) error {
+	b := make([]byte, 20)
+	b[0] = msgSetPixelFormat
+	copy(b[4:], pf.marshal())
+	_, err := w.Write(b)
+	return err
+}
+
+// WriteSetEncodings announces the encodings supported by the client, in order
+// of preference.
+func WriteSetEncodings(w io.Writer, encs []int32) error {
+	b := make([]byte, 4+4*len(encs))
+	b[0] = msgSetEncodings
+	binary.BigEndian.PutUint16(b[2:], uint16(len(encs)))
+	for i, enc := range encs {
+		binary.BigEndian.PutUint32(b[4+4*i:], uint32(enc))
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// WriteFramebufferUpdateRequest requests an update of the given region.
+func WriteFramebufferUpdateRequest(w io.Writer, req FramebufferUpdateRequest) error {
+	b := make([]byte, 10)
+	b[0] = msgFramebufferUpdateRequest
+	b[1] = flag(req.Incremental)
+	binary.BigEndian.PutUint16(b[2:], req.X)
+	binary.BigEndian.PutUint16(b[4:], req.Y)
+	binary.BigEndian.PutUint16(b[6:], req.Width)
+	binary.BigEndian.PutUint16(b[8:], req.Height)
+	_, err := w.Write(b)
+	return err
+}
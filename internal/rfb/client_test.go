@@ -0,0 +1,231 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rfb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A step of a scripted server. It sends send and then expects to read
+// expect.
+type step struct {
+	send   []byte
+	expect []byte
+}
+
+// serve runs the script on c.
+func serve(c io.ReadWriter, script []step) error {
+	for _, s := range script {
+		if _, err := c.Write(s.send); err != nil {
+			return err
+		}
+		got := make([]byte, len(s.expect))
+		if _, err := io.ReadFull(c, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, s.expect) {
+			return fmt.Errorf("client sent %q, want %q", got, s.expect)
+		}
+	}
+	return nil
+}
+
+func u32(v uint32) []byte {
+	return []byte{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}
+}
+
+func reason(s string) []byte {
+	return cat(u32(uint32(len(s))), []byte(s))
+}
+
+func TestClientHandshake(t *testing.T) {
+	// The response to the challenge 0x00, 0x01, ... 0x0f for the password
+	// "secret", as computed by
+	//	openssl enc -des-ecb -nopad -K cea6c64ea62e0000
+	// where the key has the bits of every byte of the password reversed.
+	challenge := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	response, _ := hex.DecodeString("ee22539f33a5983ec12f9c2edbc995dd")
+
+	var init bytes.Buffer
+	if err := WriteServerInit(&init, 1404, 1872, DefaultFormat, "reMarkable"); err != nil {
+		t.Fatal(err)
+	}
+	want := &ServerInit{Width: 1404, Height: 1872, Format: DefaultFormat, Name: "reMarkable"}
+
+	tcs := []struct {
+		name     string
+		password string
+		script   []step
+		// wantErr is a substring of the expected error, if any.
+		wantErr string
+	}{
+		{
+			name: "3.8 without authentication",
+			script: []step{
+				{[]byte("RFB 003.008\n"), []byte("RFB 003.008\n")},
+				{[]byte{1, SecNone}, []byte{SecNone}},
+				{u32(0), []byte{1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name:     "3.8 with VNC authentication",
+			password: "secret",
+			script: []step{
+				{[]byte("RFB 003.008\n"), []byte("RFB 003.008\n")},
+				{[]byte{1, SecVNCAuth}, []byte{SecVNCAuth}},
+				{challenge, response},
+				{u32(0), []byte{1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name:     "3.8 with rejected password",
+			password: "secret",
+			script: []step{
+				{[]byte("RFB 003.008\n"), []byte("RFB 003.008\n")},
+				{[]byte{1, SecVNCAuth}, []byte{SecVNCAuth}},
+				{challenge, response},
+				{cat(u32(1), reason("wrong password")), nil},
+			},
+			wantErr: "wrong password",
+		},
+		{
+			name: "no authentication preferred",
+			script: []step{
+				{[]byte("RFB 003.008\n"), []byte("RFB 003.008\n")},
+				{[]byte{3, SecVNCAuth, SecNone, 16}, []byte{SecNone}},
+				{u32(0), []byte{1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name: "unsupported security types",
+			script: []step{
+				{[]byte("RFB 003.008\n"), []byte("RFB 003.008\n")},
+				{[]byte{2, 16, 19}, nil},
+			},
+			wantErr: "unsupported security types",
+		},
+		{
+			name: "3.8 refused",
+			script: []step{
+				{[]byte("RFB 003.008\n"), []byte("RFB 003.008\n")},
+				{cat([]byte{0}, reason("too many clients")), nil},
+			},
+			wantErr: "too many clients",
+		},
+		{
+			name: "3.7 without security result",
+			script: []step{
+				{[]byte("RFB 003.007\n"), []byte("RFB 003.007\n")},
+				{[]byte{1, SecNone}, []byte{SecNone, 1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name:     "3.7 with VNC authentication",
+			password: "secret",
+			script: []step{
+				{[]byte("RFB 003.007\n"), []byte("RFB 003.007\n")},
+				{[]byte{1, SecVNCAuth}, []byte{SecVNCAuth}},
+				{challenge, response},
+				{u32(0), []byte{1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name:     "3.3 with VNC authentication",
+			password: "secret",
+			script: []step{
+				{[]byte("RFB 003.003\n"), []byte("RFB 003.003\n")},
+				{cat(u32(SecVNCAuth), challenge), response},
+				{u32(0), []byte{1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name:     "3.3 with rejected password",
+			password: "secret",
+			script: []step{
+				{[]byte("RFB 003.003\n"), []byte("RFB 003.003\n")},
+				{cat(u32(SecVNCAuth), challenge), response},
+				{u32(1), nil},
+			},
+			wantErr: "authentication failed",
+		},
+		{
+			name: "3.3 refused",
+			script: []step{
+				{[]byte("RFB 003.003\n"), []byte("RFB 003.003\n")},
+				{cat(u32(SecInvalid), reason("go away")), nil},
+			},
+			wantErr: "go away",
+		},
+		{
+			name: "newer minor version",
+			script: []step{
+				{[]byte("RFB 003.889\n"), []byte("RFB 003.008\n")},
+				{[]byte{1, SecNone}, []byte{SecNone}},
+				{u32(0), []byte{1}},
+				{init.Bytes(), nil},
+			},
+		},
+		{
+			name: "version 4",
+			script: []step{
+				{[]byte("RFB 004.001\n"), nil},
+			},
+			wantErr: "unsupported protocol version",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			errc := make(chan error, 1)
+			go func() {
+				err := serve(server, tc.script)
+				// Unblock the client, if it deviates from the script.
+				server.Close()
+				errc <- err
+			}()
+
+			got, err := ClientHandshake(client, tc.password)
+			client.Close()
+			if serr := <-errc; serr != nil {
+				t.Fatalf("server: %v", serr)
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("ClientHandshake() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ClientHandshake() = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ClientHandshake() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// A Decoder reads the messages sent by a server and applies framebuffer
+// updates to an image.
+type Decoder struct {
+	format PixelFormat
+	// zin holds the data of ZRLE rectangles not yet consumed by zr. All ZRLE
+	// rectangles of a connection form a single zlib stream.
+	zin bytes.Buffer
+	zr  io.ReadCloser
+	buf []byte
+}
+
+// NewDecoder returns a Decoder for pixels in the given format, which must
+// have passed Check.
+func NewDecoder(pf PixelFormat) *Decoder {
+	return &Decoder{format: pf}
+}
+
+// Encodings returns the encodings supported by the Decoder, in order of
+// preference.
+func (d *Decoder) Encodings() []int32 {
+	return []int32{EncZRLE, EncCopyRect, EncRaw, EncDesktopSize}
+}
+
+// ReadUpdate reads messages sent by the server, until it has read a
+// FramebufferUpdate, which it applies to m. If the server changes the size of
+// the framebuffer, a new image is returned. Other messages are ignored.
+func (d *Decoder) ReadUpdate(r io.Reader, m *image.RGBA) (*image.RGBA, error) {
+	for {
+		var t [1]byte
+		if _, err := io.ReadFull(r, t[:]); err != nil {
+			return m, err
+		}
+		switch t[0] {
+		case msgFramebufferUpdate:
+			return d.readUpdate(r, m)
+		case msgSetColorMapEntries:
+			var b [5]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return m, err
+			}
+			if _, err := io.CopyN(io.Discard, r, 6*int64(binary.BigEndian.Uint16(b[3:]))); err != nil {
+				return m, err
+			}
+		case msgBell:
+		case msgServerCutText:
+			var b [7]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return m, err
+			}
+			n := binary.BigEndian.Uint32(b[3:])
+			if n > maxCutText {
+				return m, fmt.Errorf("cut text too long: %d bytes", n)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+				return m, err
+			}
+		default:
+			return m, fmt.Errorf("unknown server message type %d", t[0])
+		}
+	}
+}
+
+func (d *Decoder) readUpdate(r io.Reader, m *image.RGBA) (*image.RGBA, error) {
+	var b [3]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return m, err
+	}
+	for n := binary.BigEndian.Uint16(b[1:]); n > 0; n-- {
+		var h [12]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return m, err
+		}
+		x, y := int(binary.BigEndian.Uint16(h[0:])), int(binary.BigEndian.Uint16(h[2:]))
+		rect := image.Rect(x, y, x+int(binary.BigEndian.Uint16(h[4:])), y+int(binary.BigEndian.Uint16(h[6:])))
+		enc := int32(binary.BigEndian.Uint32(h[8:]))
+		if enc == EncDesktopSize {
+			m = image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			continue
+		}
+		if !rect.In(m.Rect) {
+			return m, fmt.Errorf("rectangle %v outside of framebuffer %v", rect, m.Rect)
+		}
+		var err error
+		switch enc {
+		case EncRaw:
+			err = d.readRaw(r, m, rect)
+		case EncCopyRect:
+			err = d.readCopyRect(r, m, rect)
+		case EncZRLE:
+			err = d.readZRLE(r, m, rect)
+		default:
+			err = fmt.Errorf("unsupported encoding %d", enc)
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func (d *Decoder) readRaw(r io.Reader, m *image.RGBA, rect image.Rectangle) error {
+	size := int(d.format.BitsPerPixel / 8)
+	d.buf = grow(d.buf, rect.Dx()*size)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		if _, err := io.ReadFull(r, d.buf); err != nil {
+			return err
+		}
+		row := m.Pix[m.PixOffset(rect.Min.X, y):]
+		for i := 0; i < len(d.buf); i += size {
+			d.set(row[i/size*4:], d.format.pixel(d.buf[i:i+size]))
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) readCopyRect(r io.Reader, m *image.RGBA, rect image.Rectangle) error {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	src := image.Pt(int(binary.BigEndian.Uint16(b[0:])), int(binary.BigEndian.Uint16(b[2:])))
+	if !rect.Sub(rect.Min).Add(src).In(m.Rect) {
+		return fmt.Errorf("CopyRect source %v outside of framebuffer %v", src, m.Rect)
+	}
+	// Source and destination may overlap, so copy rows in the right order.
+	n := 4 * rect.Dx()
+	if src.Y < rect.Min.Y {
+		for y := rect.Dy() - 1; y >= 0; y-- {
+			copy(m.Pix[m.PixOffset(rect.Min.X, rect.Min.Y+y):][:n], m.Pix[m.PixOffset(src.X, src.Y+y):][:n])
+		}
+	} else {
+		for y := 0; y < rect.Dy(); y++ {
+			copy(m.Pix[m.PixOffset(rect.Min.X, rect.Min.Y+y):][:n], m.Pix[m.PixOffset(src.X, src.Y+y):][:n])
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) readZRLE(r io.Reader, m *image.RGBA, rect image.Rectangle) error {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(b[:])
+	if n > maxZRLERectBytes {
+		return fmt.Errorf("ZRLE rectangle too large: %d bytes", n)
+	}
+	if _, err := io.CopyN(&d.zin, r, int64(n)); err != nil {
+		return err
+	}
+	if d.zr == nil {
+		// zin implements io.ByteReader, so the zlib reader doesn't read
+		// ahead of the data of the current rectangle.
+		zr, err := zlib.NewReader(&d.zin)
+		if err != nil {
+			return err
+		}
+		d.zr = zr
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y += zrleTileSize {
+		for x := rect.Min.X; x < rect.Max.X; x += zrleTileSize {
+			t := image.Rect(x, y, x+zrleTileSize, y+zrleTileSize).Intersect(rect)
+			if err := d.readZRLETile(m, t); err != nil {
+				return fmt.Errorf("ZRLE: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) readZRLETile(m *image.RGBA, t image.Rectangle) error {
+	sub, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	w, n := t.Dx(), t.Dx()*t.Dy()
+	// set sets the i-th pixel of the tile.
+	set := func(i int, v uint32) {
+		d.set(m.Pix[m.PixOffset(t.Min.X+i%w, t.Min.Y+i/w):], v)
+	}
+
+	var pal [128]uint32
+	switch {
+	case sub == 0:
+		for i := 0; i < n; i++ {
+			v, err := d.readCPixel()
+			if err != nil {
+				return err
+			}
+			set(i, v)
+		}
+	case sub == 1:
+		v, err := d.readCPixel()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			set(i, v)
+		}
+	case sub <= 16:
+		for i := range pal[:sub] {
+			if pal[i], err = d.readCPixel(); err != nil {
+				return err
+			}
+		}
+		bits := uint(4)
+		switch {
+		case sub <= 2:
+			bits = 1
+		case sub <= 4:
+			bits = 2
+		}
+		row := make([]byte, (w*int(bits)+7)/8)
+		for y := 0; y < t.Dy(); y++ {
+			if _, err := io.ReadFull(d.zr, row); err != nil {
+				return err
+			}
+			for x := 0; x < w; x++ {
+				bit := uint(x) * bits
+				set(y*w+x, pal[row[bit/8]>>(8-bits-bit%8)&(1<<bits-1)])
+			}
+		}
+	case sub == 128:
+		for i := 0; i < n; {
+			v, err := d.readCPixel()
+			if err != nil {
+				return err
+			}
+			l, err := d.readRunLength()
+			if err != nil {
+				return err
+			}
+			if l > n-i {
+				return fmt.Errorf("run of %d pixels exceeds tile", l)
+			}
+			for ; l > 0; l-- {
+				set(i, v)
+				i++
+			}
+		}
+	case sub >= 130:
+		for i := range pal[:sub-128] {
+			if pal[i], err = d.readCPixel(); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < n; {
+			c, err := d.readByte()
+			if err != nil {
+				return err
+			}
+			l := 1
+			if c&128 != 0 {
+				if l, err = d.readRunLength(); err != nil {
+					return err
+				}
+			}
+			if l > n-i {
+				return fmt.Errorf("run of %d pixels exceeds tile", l)
+			}
+			for ; l > 0; l-- {
+				set(i, pal[c&127])
+				i++
+			}
+		}
+	default:
+		return fmt.Errorf("invalid subencoding %d", sub)
+	}
+	return nil
+}
+
+func (d *Decoder) readByte() (uint8, error) {
+	var b [1]byte
+	_, err := io.ReadFull(d.zr, b[:])
+	return b[0], err
+}
+
+func (d *Decoder) readCPixel() (uint32, error) {
+	var p [4]byte
+	size, off := d.format.cpixel()
+	if _, err := io.ReadFull(d.zr, p[off:off+size]); err != nil {
+		return 0, err
+	}
+	return d.format.pixel(p[:d.format.BitsPerPixel/8]), nil
+}
+
+func (d *Decoder) readRunLength() (int, error) {
+	n := 1
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(b)
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
+
+// set sets the RGBA pixel at the start of p to the pixel value v.
+func (d *Decoder) set(p []byte, v uint32) {
+	p[0], p[1], p[2] = d.format.Unpack(v)
+	p[3] = 0xff
+}
@@ -0,0 +1,382 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+)
+
+// zrleTileSize is the size of the tiles ZRLE rectangles are divided into.
+const zrleTileSize = 64
+
+// An Encoder writes FramebufferUpdate messages to a single client. It
+// converts pixels into the format requested by the client and chooses the
+// best encoding the client supports.
+type Encoder struct {
+	format PixelFormat
+	// lut maps 8-bit values of each color channel to their part of a pixel
+	// value in format.
+	lut       [3][256]uint32
+	encodings map[int32]bool
+
+	// ZRLE uses a single zlib stream for the whole connection.
+	zbuf bytes.Buffer
+	zw   *zlib.Writer
+
+	pix   []uint32
+	buf   []byte
+	pal   []uint32
+	index map[uint32]int
+}
+
+// NewEncoder returns an Encoder, which sends raw pixels in DefaultFormat until
+// the client chooses otherwise.
+func NewEncoder() *Encoder {
+	e := &Encoder{index: make(map[uint32]int)}
+	e.SetPixelFormat(DefaultFormat)
+	return e
+}
+
+// SetPixelFormat sets the pixel format of the client. It must have passed
+// Check.
+func (e *Encoder) SetPixelFormat(pf PixelFormat) {
+	e.format = pf
+	for i := range e.lut[0] {
+		c := uint8(i)
+		e.lut[0][i] = scale(c, pf.RedMax) << pf.RedShift
+		e.lut[1][i] = scale(c, pf.GreenMax) << pf.GreenShift
+		e.lut[2][i] = scale(c, pf.BlueMax) << pf.BlueShift
+	}
+}
+
+// SetEncodings sets the encodings supported by the client.
+func (e *Encoder) SetEncodings(encs []int32) {
+	e.encodings = make(map[int32]bool)
+	for _, enc := range encs {
+		e.encodings[enc] = true
+	}
+}
+
+// Supports returns whether the client supports the given encoding.
+func (e *Encoder) Supports(enc int32) bool {
+	return enc == EncRaw || e.encodings[enc]
+}
+
+// A Rect is a rectangle of a FramebufferUpdate.
+type Rect struct {
+	image.Rectangle
+	// If Copy is true, the rectangle is sent using CopyRect, with Src being
+	// the top left corner of the area of the framebuffer of the client to
+	// copy from. The client must support CopyRect.
+	Copy bool
+	Src  image.Point
+}
+
+// WriteUpdate writes a FramebufferUpdate, sending the given rectangles of m.
+// If resize is true, the client is first told to resize its framebuffer to
+// the bounds of m, which requires it to support DesktopSize. The origin of m
+// must be at (0, 0).
+func (e *Encoder) WriteUpdate(w io.Writer, m image.Image, resize bool, rects []Rect) error {
+	n := len(rects)
+	if resize {
+		n++
+	}
+	hdr := []byte{msgFramebufferUpdate, 0, uint8(n >> 8), uint8(n)}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if resize {
+		b := m.Bounds()
+		if err := writeRectHeader(w, image.Rect(0, 0, b.Dx(), b.Dy()), EncDesktopSize); err != nil {
+			return err
+		}
+	}
+	for _, r := range rects {
+		var err error
+		switch {
+		case r.Copy:
+			if err = writeRectHeader(w, r.Rectangle, EncCopyRect); err == nil {
+				var b [4]byte
+				binary.BigEndian.PutUint16(b[0:], uint16(r.Src.X))
+				binary.BigEndian.PutUint16(b[2:], uint16(r.Src.Y))
+				_, err = w.Write(b[:])
+			}
+		case e.Supports(EncZRLE):
+			err = e.writeZRLE(w, m, r.Rectangle)
+		default:
+			err = e.writeRaw(w, m, r.Rectangle)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRectHeader(w io.Writer, r image.Rectangle, enc int32) error {
+	var b [12]byte
+	binary.BigEndian.PutUint16(b[0:], uint16(r.Min.X))
+	binary.BigEndian.PutUint16(b[2:], uint16(r.Min.Y))
+	binary.BigEndian.PutUint16(b[4:], uint16(r.Dx()))
+	binary.BigEndian.PutUint16(b[6:], uint16(r.Dy()))
+	binary.BigEndian.PutUint32(b[8:], uint32(enc))
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (e *Encoder) writeRaw(w io.Writer, m image.Image, r image.Rectangle) error {
+	if err := writeRectHeader(w, r, EncRaw); err != nil {
+		return err
+	}
+	pix := e.pixels(m, r)
+	size := int(e.format.BitsPerPixel / 8)
+	e.buf = grow(e.buf, len(pix)*size)
+	for i, v := range pix {
+		e.format.putPixel(e.buf[i*size:(i+1)*size], v)
+	}
+	_, err := w.Write(e.buf)
+	return err
+}
+
+func (e *Encoder) writeZRLE(w io.Writer, m image.Image, r image.Rectangle) error {
+	if err := writeRectHeader(w, r, EncZRLE); err != nil {
+		return err
+	}
+	if e.zw == nil {
+		e.zw, _ = zlib.NewWriterLevel(&e.zbuf, zlib.BestSpeed)
+	}
+	e.zbuf.Reset()
+	for y := r.Min.Y; y < r.Max.Y; y += zrleTileSize {
+		for x := r.Min.X; x < r.Max.X; x += zrleTileSize {
+			t := image.Rect(x, y, x+zrleTileSize, y+zrleTileSize).Intersect(r)
+			if _, err := e.zw.Write(e.zrleTile(e.pixels(m, t), t.Dx(), t.Dy())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := e.zw.Flush(); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(e.zbuf.Len()))
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(e.zbuf.Bytes())
+	return err
+}
+
+// zrleTile returns the encoding of a single ZRLE tile, choosing the smallest
+// of the raw, solid, packed palette, plain RLE and palette RLE subencodings.
+func (e *Encoder) zrleTile(pix []uint32, w, h int) []byte {
+	cp, _ := e.format.cpixel()
+
+	// Collect the palette (up to the 127 colors usable by palette RLE) and
+	// the sizes of both RLE subencodings in one pass.
+	for k := range e.index {
+		delete(e.index, k)
+	}
+	e.pal = e.pal[:0]
+	plainRLE, paletteRLE := 1, 1
+	for i := 0; i < len(pix); {
+		j := i + 1
+		for j < len(pix) && pix[j] == pix[i] {
+			j++
+		}
+		plainRLE += cp + runLength(j-i)
+		paletteRLE++
+		if j-i > 1 {
+			paletteRLE += runLength(j - i)
+		}
+		if len(e.pal) <= 127 {
+			if _, ok := e.index[pix[i]]; !ok {
+				e.index[pix[i]] = len(e.pal)
+				e.pal = append(e.pal, pix[i])
+			}
+		}
+		i = j
+	}
+
+	b := e.buf[:0]
+	if len(e.pal) == 1 {
+		return e.appendCPixel(append(b, 1), pix[0])
+	}
+
+	sub, size := 0, 1+len(pix)*cp
+	bits := 0
+	if len(e.pal) <= 16 {
+		switch {
+		case len(e.pal) <= 2:
+			bits = 1
+		case len(e.pal) <= 4:
+			bits = 2
+		default:
+			bits = 4
+		}
+		if s := 1 + len(e.pal)*cp + (w*bits+7)/8*h; s < size {
+			sub, size = len(e.pal), s
+		}
+	}
+	if plainRLE < size {
+		sub, size = 128, plainRLE
+	}
+	if len(e.pal) <= 127 {
+		if s := len(e.pal)*cp + paletteRLE; s < size {
+			sub, size = 128+len(e.pal), s
+		}
+	}
+
+	b = append(b, uint8(sub))
+	switch {
+	case sub == 0:
+		for _, v := range pix {
+			b = e.appendCPixel(b, v)
+		}
+	case sub <= 16:
+		for _, v := range e.pal {
+			b = e.appendCPixel(b, v)
+		}
+		for y := 0; y < h; y++ {
+			var c uint8
+			n := 0
+			for _, v := range pix[y*w : (y+1)*w] {
+				c = c<<uint(bits) | uint8(e.index[v])
+				if n += bits; n == 8 {
+					b, c, n = append(b, c), 0, 0
+				}
+			}
+			if n > 0 {
+				b = append(b, c<<uint(8-n))
+			}
+		}
+	case sub == 128:
+		for i := 0; i < len(pix); {
+			j := i + 1
+			for j < len(pix) && pix[j] == pix[i] {
+				j++
+			}
+			b = appendRunLength(e.appendCPixel(b, pix[i]), j-i)
+			i = j
+		}
+	default:
+		for _, v := range e.pal {
+			b = e.appendCPixel(b, v)
+		}
+		for i := 0; i < len(pix); {
+			j := i + 1
+			for j < len(pix) && pix[j] == pix[i] {
+				j++
+			}
+			if j-i == 1 {
+				b = append(b, uint8(e.index[pix[i]]))
+			} else {
+				b = appendRunLength(append(b, 128|uint8(e.index[pix[i]])), j-i)
+			}
+			i = j
+		}
+	}
+	e.buf = b
+	return b
+}
+
+// runLength returns the number of bytes needed to encode a run of n pixels.
+func runLength(n int) int {
+	return (n-1)/255 + 1
+}
+
+func appendRunLength(b []byte, n int) []byte {
+	for n--; n >= 255; n -= 255 {
+		b = append(b, 255)
+	}
+	return append(b, uint8(n))
+}
+
+func (e *Encoder) appendCPixel(b []byte, v uint32) []byte {
+	var p [4]byte
+	size, off := e.format.cpixel()
+	e.format.putPixel(p[:e.format.BitsPerPixel/8], v)
+	return append(b, p[off:off+size]...)
+}
+
+// pixels returns the pixel values of the rectangle r of m, in the format of
+// the client.
+func (e *Encoder) pixels(m image.Image, r image.Rectangle) []uint32 {
+	n := r.Dx() * r.Dy()
+	if cap(e.pix) < n {
+		e.pix = make([]uint32, n)
+	}
+	pix := e.pix[:n]
+	lr, lg, lb := &e.lut[0], &e.lut[1], &e.lut[2]
+	i := 0
+	switch m := m.(type) {
+	case *image.Gray:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for _, v := range m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)] {
+				pix[i] = lr[v] | lg[v] | lb[v]
+				i++
+			}
+		}
+	case *image.Gray16:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+			for j := 0; j < len(row); j += 2 {
+				v := row[j]
+				pix[i] = lr[v] | lg[v] | lb[v]
+				i++
+			}
+		}
+	case *image.Paletted:
+		var lut [256]uint32
+		for j, c := range m.Palette {
+			rgba := color.RGBAModel.Convert(c).(color.RGBA)
+			lut[j] = lr[rgba.R] | lg[rgba.G] | lb[rgba.B]
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for _, v := range m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)] {
+				pix[i] = lut[v]
+				i++
+			}
+		}
+	case *image.RGBA:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+			for j := 0; j < len(row); j += 4 {
+				pix[i] = lr[row[j]] | lg[row[j+1]] | lb[row[j+2]]
+				i++
+			}
+		}
+	default:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
+				pix[i] = lr[c.R] | lg[c.G] | lb[c.B]
+				i++
+			}
+		}
+	}
+	return pix
+}
+
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rfb
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Patterns of the test image, one per column of ZRLE tiles, each making the
+// encoder choose a different subencoding.
+var tilePatterns = []struct {
+	name string
+	// sub is the expected subencoding. For palette subencodings, it is
+	// the size of the palette.
+	sub uint8
+	at  func(x, y int) color.RGBA
+}{
+	{"solid", 1, func(x, y int) color.RGBA {
+		return color.RGBA{10, 20, 30, 0xff}
+	}},
+	{"packed palette, 1 bit", 2, func(x, y int) color.RGBA {
+		return gray(uint8((x + y) % 2 * 0xff))
+	}},
+	{"packed palette, 4 bits", 5, func(x, y int) color.RGBA {
+		return gray(uint8((x*7 + y*13) % 5 * 50))
+	}},
+	{"plain RLE", 128, func(x, y int) color.RGBA {
+		i := (y*zrleTileSize + x) / 16
+		return color.RGBA{uint8(i), uint8(i * 3), 0, 0xff}
+	}},
+	{"palette RLE", 128 + 20, func(x, y int) color.RGBA {
+		return gray(uint8((y*zrleTileSize + x) / 8 % 20 * 10))
+	}},
+	{"raw", 0, noise},
+}
+
+func gray(v uint8) color.RGBA {
+	return color.RGBA{v, v, v, 0xff}
+}
+
+func noise(x, y int) color.RGBA {
+	h := uint32(x*31+y*17) * 2654435761
+	return color.RGBA{uint8(h >> 24), uint8(h >> 16), uint8(h >> 8), 0xff}
+}
+
+// testImage returns an image with a column of tiles for every pattern,
+// followed by a partial column and row of noise.
+func testImage() *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, len(tilePatterns)*zrleTileSize+30, zrleTileSize+20))
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := noise(x, y)
+			if i := x / zrleTileSize; i < len(tilePatterns) && y < zrleTileSize {
+				c = tilePatterns[i].at(x%zrleTileSize, y)
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestZRLESubencodings(t *testing.T) {
+	e := NewEncoder()
+	m := testImage()
+	for i, p := range tilePatterns {
+		r := image.Rect(i*zrleTileSize, 0, (i+1)*zrleTileSize, zrleTileSize)
+		if sub := e.zrleTile(e.pixels(m, r), r.Dx(), r.Dy())[0]; sub != p.sub {
+			t.Errorf("%s: tile encoded with subencoding %d, want %d", p.name, sub, p.sub)
+		}
+	}
+}
+
+// quantize returns c as sent in the pixel format pf.
+func quantize(c color.RGBA, pf PixelFormat) color.RGBA {
+	q := func(v uint8, max uint16) uint8 {
+		return unscale(scale(v, max), max)
+	}
+	return color.RGBA{q(c.R, pf.RedMax), q(c.G, pf.GreenMax), q(c.B, pf.BlueMax), 0xff}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	formats := []struct {
+		name string
+		pf   PixelFormat
+	}{
+		{"default", DefaultFormat},
+		{"32 bits, big endian", PixelFormat{BitsPerPixel: 32, Depth: 24, BigEndian: true, TrueColor: true, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}},
+		{"32 bits, high bytes", PixelFormat{BitsPerPixel: 32, Depth: 24, TrueColor: true, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 24, GreenShift: 16, BlueShift: 8}},
+		{"32 bits, 30 bit depth", PixelFormat{BitsPerPixel: 32, Depth: 30, TrueColor: true, RedMax: 1023, GreenMax: 1023, BlueMax: 1023, RedShift: 20, GreenShift: 10, BlueShift: 0}},
+		{"RGB565", PixelFormat{BitsPerPixel: 16, Depth: 16, TrueColor: true, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}},
+		{"RGB565, big endian", PixelFormat{BitsPerPixel: 16, Depth: 16, BigEndian: true, TrueColor: true, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}},
+		{"BGR233", PixelFormat{BitsPerPixel: 8, Depth: 8, TrueColor: true, RedMax: 7, GreenMax: 7, BlueMax: 3, RedShift: 0, GreenShift: 3, BlueShift: 6}},
+	}
+	encodings := []struct {
+		name string
+		encs []int32
+	}{
+		{"ZRLE", []int32{EncZRLE, EncCopyRect, EncDesktopSize}},
+		{"raw", []int32{EncDesktopSize}},
+	}
+	for _, f := range formats {
+		for _, enc := range encodings {
+			t.Run(fmt.Sprintf("%s/%s", f.name, enc.name), func(t *testing.T) {
+				if err := f.pf.Check(); err != nil {
+					t.Fatal(err)
+				}
+				e, d := NewEncoder(), NewDecoder(f.pf)
+				e.SetPixelFormat(f.pf)
+				e.SetEncodings(enc.encs)
+
+				m := testImage()
+				b := m.Bounds()
+				var (
+					conn bytes.Buffer
+					got  *image.RGBA
+				)
+				// Messages other than updates are skipped.
+				conn.Write([]byte{msgBell})
+				conn.Write([]byte{msgServerCutText, 0, 0, 0, 0, 0, 0, 3, 'f', 'o', 'o'})
+				conn.Write([]byte{msgSetColorMapEntries, 0, 0, 0, 0, 1, 1, 2, 3, 4, 5, 6})
+
+				// The first update sends the whole screen, the second only
+				// some changes. ZRLE rectangles of both share a zlib
+				// stream.
+				changed := image.Rect(70, 10, 200, 50)
+				updates := []struct {
+					resize bool
+					rects  []Rect
+				}{
+					{true, []Rect{{Rectangle: b}}},
+					{false, []Rect{{Rectangle: changed}, {Rectangle: image.Rect(0, b.Max.Y-1, 1, b.Max.Y)}}},
+				}
+				for i, u := range updates {
+					if i > 0 {
+						for y := changed.Min.Y; y < changed.Max.Y; y++ {
+							for x := changed.Min.X; x < changed.Max.X; x++ {
+								m.SetRGBA(x, y, noise(y, x))
+							}
+						}
+						m.SetRGBA(0, b.Max.Y-1, color.RGBA{0xff, 0, 0, 0xff})
+					}
+					if err := e.WriteUpdate(&conn, m, u.resize, u.rects); err != nil {
+						t.Fatalf("WriteUpdate() = %v", err)
+					}
+					var err error
+					if got, err = d.ReadUpdate(&conn, got); err != nil {
+						t.Fatalf("ReadUpdate() = %v", err)
+					}
+					if conn.Len() != 0 {
+						t.Fatalf("%d bytes left after ReadUpdate()", conn.Len())
+					}
+					if got.Bounds() != b {
+						t.Fatalf("ReadUpdate() returned image with bounds %v, want %v", got.Bounds(), b)
+					}
+					for y := b.Min.Y; y < b.Max.Y; y++ {
+						for x := b.Min.X; x < b.Max.X; x++ {
+							if c, want := got.RGBAAt(x, y), quantize(m.RGBAAt(x, y), f.pf); c != want {
+								t.Fatalf("update %d: pixel (%d, %d) = %v, want %v", i, x, y, c, want)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
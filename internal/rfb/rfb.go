@@ -0,0 +1,383 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rfb implements the parts of the remote framebuffer protocol, as
+// used by VNC, needed to serve and view a screen. It is specified in RFC 6143.
+package rfb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the version message of RFB 3.8.
+const ProtocolVersion = "RFB 003.008\n"
+
+// Security types.
+const (
+	SecInvalid = 0
+	SecNone    = 1
+	SecVNCAuth = 2
+)
+
+// Encodings of rectangles in a FramebufferUpdate.
+const (
+	EncRaw         int32 = 0
+	EncCopyRect    int32 = 1
+	EncZRLE        int32 = 16
+	EncDesktopSize int32 = -223
+)
+
+// Client to server message types.
+const (
+	msgSetPixelFormat           = 0
+	msgSetEncodings             = 2
+	msgFramebufferUpdateRequest = 3
+	msgKeyEvent                 = 4
+	msgPointerEvent             = 5
+	msgClientCutText            = 6
+)
+
+// Server to client message types.
+const (
+	msgFramebufferUpdate  = 0
+	msgSetColorMapEntries = 1
+	msgBell               = 2
+	msgServerCutText      = 3
+)
+
+// Limits on the length of variable-sized messages.
+const (
+	maxCutText       = 1 << 20
+	maxSetEncodings  = 1 << 10
+	maxNameLength    = 1 << 12
+	maxReasonLength  = 1 << 12
+	maxZRLERectBytes = 1 << 26
+)
+
+// PixelFormat describes how pixel values are sent over the wire.
+type PixelFormat struct {
+	BitsPerPixel uint8
+	Depth        uint8
+	BigEndian    bool
+	TrueColor    bool
+	RedMax       uint16
+	GreenMax     uint16
+	BlueMax      uint16
+	RedShift     uint8
+	GreenShift   uint8
+	BlueShift    uint8
+}
+
+// DefaultFormat is 32-bit little-endian XRGB, which is what servers
+// usually announce.
+var DefaultFormat = PixelFormat{
+	BitsPerPixel: 32,
+	Depth:        24,
+	TrueColor:    true,
+	RedMax:       255,
+	GreenMax:     255,
+	BlueMax:      255,
+	RedShift:     16,
+	GreenShift:   8,
+	BlueShift:    0,
+}
+
+func (pf PixelFormat) marshal() []byte {
+	b := make([]byte, 16)
+	b[0] = pf.BitsPerPixel
+	b[1] = pf.Depth
+	b[2] = flag(pf.BigEndian)
+	b[3] = flag(pf.TrueColor)
+	binary.BigEndian.PutUint16(b[4:], pf.RedMax)
+	binary.BigEndian.PutUint16(b[6:], pf.GreenMax)
+	binary.BigEndian.PutUint16(b[8:], pf.BlueMax)
+	b[10] = pf.RedShift
+	b[11] = pf.GreenShift
+	b[12] = pf.BlueShift
+	return b
+}
+
+func unmarshalPixelFormat(b []byte) PixelFormat {
+	return PixelFormat{
+		BitsPerPixel: b[0],
+		Depth:        b[1],
+		BigEndian:    b[2] != 0,
+		TrueColor:    b[3] != 0,
+		RedMax:       binary.BigEndian.Uint16(b[4:]),
+		GreenMax:     binary.BigEndian.Uint16(b[6:]),
+		BlueMax:      binary.BigEndian.Uint16(b[8:]),
+		RedShift:     b[10],
+		GreenShift:   b[11],
+		BlueShift:    b[12],
+	}
+}
+
+// Check returns an error, if pf is not supported.
+func (pf PixelFormat) Check() error {
+	switch pf.BitsPerPixel {
+	case 8, 16, 32:
+	default:
+		return fmt.Errorf("unsupported bits per pixel %d", pf.BitsPerPixel)
+	}
+	if !pf.TrueColor {
+		return errors.New("color map pixel formats are unsupported")
+	}
+	for _, c := range []struct {
+		max   uint16
+		shift uint8
+	}{{pf.RedMax, pf.RedShift}, {pf.GreenMax, pf.GreenShift}, {pf.BlueMax, pf.BlueShift}} {
+		if c.max == 0 || c.max&(c.max+1) != 0 {
+			return fmt.Errorf("invalid color maximum %d", c.max)
+		}
+		if uint64(c.max)<<c.shift >= 1<<pf.BitsPerPixel {
+			return fmt.Errorf("color maximum %d shifted by %d exceeds %d bits per pixel", c.max, c.shift, pf.BitsPerPixel)
+		}
+	}
+	return nil
+}
+
+// Unpack returns the 8-bit color components of the pixel value v.
+func (pf PixelFormat) Unpack(v uint32) (r, g, b uint8) {
+	return unscale(v>>pf.RedShift, pf.RedMax), unscale(v>>pf.GreenShift, pf.GreenMax), unscale(v>>pf.BlueShift, pf.BlueMax)
+}
+
+func scale(c uint8, max uint16) uint32 {
+	return (uint32(c)*uint32(max) + 127) / 255
+}
+
+func unscale(v uint32, max uint16) uint8 {
+	v &= uint32(max)
+	return uint8((v*255 + uint32(max)/2) / uint32(max))
+}
+
+// putPixel writes the pixel value v into b, which has length n.
+func (pf PixelFormat) putPixel(b []byte, v uint32) {
+	switch {
+	case len(b) == 1:
+		b[0] = uint8(v)
+	case len(b) == 2 && pf.BigEndian:
+		binary.BigEndian.PutUint16(b, uint16(v))
+	case len(b) == 2:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case pf.BigEndian:
+		binary.BigEndian.PutUint32(b, v)
+	default:
+		binary.LittleEndian.PutUint32(b, v)
+	}
+}
+
+// pixel reads a pixel value from b, which has length BitsPerPixel/8.
+func (pf PixelFormat) pixel(b []byte) uint32 {
+	switch {
+	case len(b) == 1:
+		return uint32(b[0])
+	case len(b) == 2 && pf.BigEndian:
+		return uint32(binary.BigEndian.Uint16(b))
+	case len(b) == 2:
+		return uint32(binary.LittleEndian.Uint16(b))
+	case pf.BigEndian:
+		return binary.BigEndian.Uint32(b)
+	default:
+		return binary.LittleEndian.Uint32(b)
+	}
+}
+
+// cpixel returns the size of a compressed pixel, as used by ZRLE, and the
+// offset of its bytes in a full pixel.
+func (pf PixelFormat) cpixel() (size, offset int) {
+	if !pf.TrueColor || pf.BitsPerPixel != 32 || pf.Depth > 24 {
+		return int(pf.BitsPerPixel / 8), 0
+	}
+	mask := uint32(pf.RedMax)<<pf.RedShift | uint32(pf.GreenMax)<<pf.GreenShift | uint32(pf.BlueMax)<<pf.BlueShift
+	switch {
+	case mask&0xff000000 == 0 && !pf.BigEndian, mask&0xff == 0 && pf.BigEndian:
+		return 3, 0
+	case mask&0xff000000 == 0 && pf.BigEndian, mask&0xff == 0 && !pf.BigEndian:
+		return 3, 1
+	default:
+		return 4, 0
+	}
+}
+
+func flag(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ServerHandshake performs the server side of the handshake, up to and
+// including the ClientInit message, without requiring authentication. It
+// supports clients speaking versions 3.3, 3.7 and 3.8 of the protocol.
+func ServerHandshake(rw io.ReadWriter) error {
+	if _, err := io.WriteString(rw, ProtocolVersion); err != nil {
+		return err
+	}
+	var v [12]byte
+	if _, err := io.ReadFull(rw, v[:]); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(v[:]), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("unsupported protocol version %q", v)
+	}
+	if minor < 7 {
+		// Version 3.3: The server decides on the security type.
+		if err := binary.Write(rw, binary.BigEndian, uint32(SecNone)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := rw.Write([]byte{1, SecNone}); err != nil {
+			return err
+		}
+		var sec [1]byte
+		if _, err := io.ReadFull(rw, sec[:]); err != nil {
+			return err
+		}
+		if sec[0] != SecNone {
+			return fmt.Errorf("unsupported security type %d", sec[0])
+		}
+		// Version 3.7 has no SecurityResult for SecNone.
+		if minor >= 8 {
+			if err := binary.Write(rw, binary.BigEndian, uint32(0)); err != nil {
+				return err
+			}
+		}
+	}
+	// ClientInit only contains the shared flag, which we ignore, as we
+	// always share the screen.
+	var shared [1]byte
+	_, err := io.ReadFull(rw, shared[:])
+	return err
+}
+
+// WriteServerInit writes the ServerInit message.
+func WriteServerInit(w io.Writer, width, height int, pf PixelFormat, name string) error {
+	b := make([]byte, 24+len(name))
+	binary.BigEndian.PutUint16(b[0:], uint16(width))
+	binary.BigEndian.PutUint16(b[2:], uint16(height))
+	copy(b[4:], pf.marshal())
+	binary.BigEndian.PutUint32(b[20:], uint32(len(name)))
+	copy(b[24:], name)
+	_, err := w.Write(b)
+	return err
+}
+
+// SetPixelFormat is sent by the client to choose the format of pixel values.
+type SetPixelFormat struct {
+	Format PixelFormat
+}
+
+// SetEncodings is sent by the client to announce the encodings it supports,
+// in order of preference.
+type SetEncodings struct {
+	Encodings []int32
+}
+
+// FramebufferUpdateRequest is sent by the client to request an update of the
+// given region.
+type FramebufferUpdateRequest struct {
+	Incremental bool
+	X, Y        uint16
+	Width       uint16
+	Height      uint16
+}
+
+// KeyEvent is sent by the client, if a key is pressed or released.
+type KeyEvent struct {
+	Down bool
+	Key  uint32
+}
+
+// PointerEvent is sent by the client, if the pointer moves or a button is
+// pressed or released.
+type PointerEvent struct {
+	Buttons uint8
+	X, Y    uint16
+}
+
+// ClientCutText is sent by the client, if it has new text in its cut buffer.
+type ClientCutText struct {
+	Text []byte
+}
+
+// ReadClientMessage reads a single message sent by the client. It returns one
+// of *SetPixelFormat, *SetEncodings, *FramebufferUpdateRequest, *KeyEvent,
+// *PointerEvent or *ClientCutText.
+func ReadClientMessage(r io.Reader) (interface{}, error) {
+	var t [1]byte
+	if _, err := io.ReadFull(r, t[:]); err != nil {
+		return nil, err
+	}
+	switch t[0] {
+	case msgSetPixelFormat:
+		var b [19]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		return &SetPixelFormat{unmarshalPixelFormat(b[3:])}, nil
+	case msgSetEncodings:
+		var b [3]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		if n > maxSetEncodings {
+			return nil, fmt.Errorf("too many encodings: %d", n)
+		}
+		m := &SetEncodings{make([]int32, n)}
+		return m, binary.Read(r, binary.BigEndian, m.Encodings)
+	case msgFramebufferUpdateRequest:
+		var b [9]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		return &FramebufferUpdateRequest{
+			Incremental: b[0] != 0,
+			X:           binary.BigEndian.Uint16(b[1:]),
+			Y:           binary.BigEndian.Uint16(b[3:]),
+			Width:       binary.BigEndian.Uint16(b[5:]),
+			Height:      binary.BigEndian.Uint16(b[7:]),
+		}, nil
+	case msgKeyEvent:
+		var b [7]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		return &KeyEvent{b[0] != 0, binary.BigEndian.Uint32(b[3:])}, nil
+	case msgPointerEvent:
+		var b [5]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		return &PointerEvent{b[0], binary.BigEndian.Uint16(b[1:]), binary.BigEndian.Uint16(b[3:])}, nil
+	case msgClientCutText:
+		var b [7]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(b[3:])
+		if n > maxCutText {
+			return nil, fmt.Errorf("cut text too long: %d bytes", n)
+		}
+		m := &ClientCutText{make([]byte, n)}
+		_, err := io.ReadFull(r, m.Text)
+		return m, err
+	default:
+		return nil, fmt.Errorf("unknown client message type %d", t[0])
+	}
+}
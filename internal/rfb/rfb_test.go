@@ -0,0 +1,233 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rfb
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// conn is a connection reading the scripted messages of the peer from r and
+// recording what is written to it in w.
+type conn struct {
+	io.Reader
+	w bytes.Buffer
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func cat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+func TestServerHandshake(t *testing.T) {
+	version := []byte(ProtocolVersion)
+	tcs := []struct {
+		name string
+		// in is sent by the client.
+		in []byte
+		// want is sent by the server.
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "3.3",
+			in:   []byte("RFB 003.003\n\x01"),
+			want: cat(version, []byte{0, 0, 0, SecNone}),
+		},
+		{
+			name: "3.7",
+			in:   []byte("RFB 003.007\n\x01\x01"),
+			want: cat(version, []byte{1, SecNone}),
+		},
+		{
+			name: "3.8",
+			in:   []byte("RFB 003.008\n\x01\x00"),
+			want: cat(version, []byte{1, SecNone, 0, 0, 0, 0}),
+		},
+		{
+			name: "newer minor version",
+			in:   []byte("RFB 003.889\n\x01\x01"),
+			want: cat(version, []byte{1, SecNone, 0, 0, 0, 0}),
+		},
+		{
+			name:    "unsupported security type",
+			in:      []byte("RFB 003.008\n\x02"),
+			want:    cat(version, []byte{1, SecNone}),
+			wantErr: true,
+		},
+		{
+			name:    "version 4",
+			in:      []byte("RFB 004.000\n"),
+			want:    version,
+			wantErr: true,
+		},
+		{
+			name:    "no version",
+			in:      []byte("GET / HTTP/1.1\r\n"),
+			want:    version,
+			wantErr: true,
+		},
+		{
+			name:    "missing ClientInit",
+			in:      []byte("RFB 003.008\n\x01"),
+			want:    cat(version, []byte{1, SecNone, 0, 0, 0, 0}),
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &conn{Reader: bytes.NewReader(tc.in)}
+			err := ServerHandshake(c)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ServerHandshake() = %v, want error: %v", err, tc.wantErr)
+			}
+			if !bytes.Equal(c.w.Bytes(), tc.want) {
+				t.Errorf("ServerHandshake() sent %q, want %q", c.w.Bytes(), tc.want)
+			}
+		})
+	}
+}
+
+func TestReadClientMessage(t *testing.T) {
+	tcs := []struct {
+		name    string
+		in      []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "SetPixelFormat",
+			in:   []byte{0, 0, 0, 0, 16, 16, 1, 1, 0, 31, 0, 63, 0, 31, 11, 5, 0, 0, 0, 0},
+			want: &SetPixelFormat{PixelFormat{
+				BitsPerPixel: 16,
+				Depth:        16,
+				BigEndian:    true,
+				TrueColor:    true,
+				RedMax:       31,
+				GreenMax:     63,
+				BlueMax:      31,
+				RedShift:     11,
+				GreenShift:   5,
+			}},
+		},
+		{
+			name: "SetEncodings",
+			in:   []byte{2, 0, 0, 3, 0, 0, 0, 16, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0x21},
+			want: &SetEncodings{[]int32{EncZRLE, EncCopyRect, EncDesktopSize}},
+		},
+		{
+			name: "SetEncodings without encodings",
+			in:   []byte{2, 0, 0, 0},
+			want: &SetEncodings{[]int32{}},
+		},
+		{
+			name:    "SetEncodings with too many encodings",
+			in:      []byte{2, 0, 0xff, 0xff},
+			wantErr: true,
+		},
+		{
+			name: "FramebufferUpdateRequest",
+			in:   []byte{3, 1, 0, 10, 1, 0, 2, 0, 0, 3},
+			want: &FramebufferUpdateRequest{Incremental: true, X: 10, Y: 256, Width: 512, Height: 3},
+		},
+		{
+			name: "KeyEvent",
+			in:   []byte{4, 1, 0, 0, 0, 0, 0xff, 0x0d},
+			want: &KeyEvent{Down: true, Key: 0xff0d},
+		},
+		{
+			name: "PointerEvent",
+			in:   []byte{5, 5, 1, 2, 0, 3},
+			want: &PointerEvent{Buttons: 5, X: 258, Y: 3},
+		},
+		{
+			name: "ClientCutText",
+			in:   []byte{6, 0, 0, 0, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'},
+			want: &ClientCutText{[]byte("hello")},
+		},
+		{
+			name:    "ClientCutText too long",
+			in:      []byte{6, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff},
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			in:      []byte{3, 1, 0, 10},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			in:      []byte{7},
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bytes.NewReader(tc.in)
+			got, err := ReadClientMessage(r)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ReadClientMessage() = %#v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadClientMessage() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ReadClientMessage() = %#v, want %#v", got, tc.want)
+			}
+			if r.Len() != 0 {
+				t.Errorf("ReadClientMessage() left %d bytes unread", r.Len())
+			}
+		})
+	}
+}
+
+// TestClientMessages checks that messages written by a client are read back
+// unchanged by the server.
+func TestClientMessages(t *testing.T) {
+	var b bytes.Buffer
+	pf := PixelFormat{BitsPerPixel: 8, Depth: 8, TrueColor: true, RedMax: 7, GreenMax: 7, BlueMax: 3, GreenShift: 3, BlueShift: 6}
+	req := FramebufferUpdateRequest{X: 1, Y: 2, Width: 3, Height: 4}
+	encs := NewDecoder(pf).Encodings()
+	if err := WriteSetPixelFormat(&b, pf); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSetEncodings(&b, encs); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFramebufferUpdateRequest(&b, req); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []interface{}{&SetPixelFormat{pf}, &SetEncodings{encs}, &req} {
+		got, err := ReadClientMessage(&b)
+		if err != nil {
+			t.Fatalf("ReadClientMessage() = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadClientMessage() = %#v, want %#v", got, want)
+		}
+	}
+}
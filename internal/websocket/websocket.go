@@ -0,0 +1,274 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package websocket implements the server side of the WebSocket protocol, as
+// specified in RFC 6455, as far as needed to push messages to browsers.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes of frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// closeTimeout is the time Close waits for pending writes.
+const closeTimeout = time.Second
+
+// maxMessageSize is the maximum size of messages accepted from the client.
+const maxMessageSize = 1 << 20
+
+// acceptGUID is appended to the key of the client to compute the accept key
+// of the handshake.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A Conn is a WebSocket connection. Writes may happen concurrently to reads,
+// but only one goroutine may read at a time.
+type Conn struct {
+	c  net.Conn
+	r  *bufio.Reader
+	mu sync.Mutex
+	w  *bufio.Writer
+	// closed is set after a close frame has been sent.
+	closed bool
+}
+
+// Upgrade upgrades the HTTP request r to a WebSocket connection. If r is not
+// a valid WebSocket handshake, an error is returned and an HTTP error response
+// has been written to w.
+//
+// Browsers don't apply the same-origin policy to WebSockets, so handshakes
+// from pages of a different origin than r.Host are rejected. Requests without
+// an Origin header don't come from browsers and are accepted.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" || !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket handshake expected", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported WebSocket version %q", v)
+	}
+	if o := r.Header.Get("Origin"); o != "" && !sameOrigin(o, r.Host) {
+		http.Error(w, "Cross-origin WebSocket handshake", http.StatusForbidden)
+		return nil, fmt.Errorf("cross-origin WebSocket handshake from %q", o)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid Sec-WebSocket-Key %q", key)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("can't hijack connection")
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &Conn{c: c, r: rw.Reader, w: rw.Writer}, nil
+}
+
+// sameOrigin returns whether the host of the URL in the Origin header o is
+// host.
+func sameOrigin(o, host string) bool {
+	u, err := url.Parse(o)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+// hasToken returns whether the comma-separated list in the header field k
+// contains tok, ignoring case.
+func hasToken(h http.Header, k, tok string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(k)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), tok) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteBinary sends p as a single binary message.
+func (c *Conn) WriteBinary(p []byte) error {
+	return c.writeFrame(opBinary, p)
+}
+
+// WriteText sends s as a single text message.
+func (c *Conn) WriteText(s string) error {
+	return c.writeFrame(opText, []byte(s))
+}
+
+func (c *Conn) writeFrame(op byte, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New("write on closed WebSocket")
+	}
+	// Frames sent by the server are not masked.
+	hdr := []byte{0x80 | op, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	n := 2
+	switch {
+	case len(p) < 126:
+		hdr[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(p)))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(p)))
+		n = 10
+	}
+	if _, err := c.w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(p); err != nil {
+		return err
+	}
+	if op == opClose {
+		c.closed = true
+	}
+	return c.w.Flush()
+}
+
+// ReadMessage reads the next data message sent by the client. Control frames
+// are handled transparently. If the client closes the connection, io.EOF is
+// returned.
+func (c *Conn) ReadMessage() (text bool, p []byte, err error) {
+	var msgOp byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return false, nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return false, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// Echo the status code, as required by the protocol.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(opClose, payload)
+			return false, nil, io.EOF
+		case opText, opBinary:
+			if msgOp != 0 {
+				return false, nil, errors.New("expected continuation frame")
+			}
+			msgOp = op
+		case opContinuation:
+			if msgOp == 0 {
+				return false, nil, errors.New("unexpected continuation frame")
+			}
+		default:
+			return false, nil, fmt.Errorf("unknown opcode %#x", op)
+		}
+		if len(p)+len(payload) > maxMessageSize {
+			return false, nil, errors.New("message too large")
+		}
+		p = append(p, payload...)
+		if fin {
+			return msgOp == opText, p, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("unexpected reserved bits")
+	}
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked frame from client")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= opClose && (n > 125 || !fin) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	if n > maxMessageSize {
+		return false, 0, nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// Close sends a close frame, if none has been sent yet, and closes the
+// underlying connection.
+func (c *Conn) Close() error {
+	c.c.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(opClose, nil)
+	return c.c.Close()
+}
@@ -0,0 +1,339 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		c.WriteText("hello")
+		c.Close()
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// The example handshake of RFC 6455.
+	const (
+		key    = "dGhlIHNhbXBsZSBub25jZQ=="
+		accept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	)
+	valid := func() http.Header {
+		return http.Header{
+			"Connection":            {"Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+			"Sec-Websocket-Key":     {key},
+		}
+	}
+	with := func(k, v string) http.Header {
+		h := valid()
+		if v == "" {
+			h.Del(k)
+		} else {
+			h.Set(k, v)
+		}
+		return h
+	}
+	tcs := []struct {
+		name   string
+		method string
+		header http.Header
+		want   int
+	}{
+		{"valid", "GET", valid(), http.StatusSwitchingProtocols},
+		{"same origin", "GET", with("Origin", "http://"+host), http.StatusSwitchingProtocols},
+		{"connection token list", "GET", with("Connection", "keep-alive, upgrade"), http.StatusSwitchingProtocols},
+		{"other origin", "GET", with("Origin", "http://evil.example"), http.StatusForbidden},
+		{"other port", "GET", with("Origin", "http://"+strings.Split(host, ":")[0]+":1"), http.StatusForbidden},
+		{"opaque origin", "GET", with("Origin", "null"), http.StatusForbidden},
+		{"POST", "POST", valid(), http.StatusBadRequest},
+		{"missing Connection", "GET", with("Connection", ""), http.StatusBadRequest},
+		{"missing Upgrade", "GET", with("Upgrade", ""), http.StatusBadRequest},
+		{"other Upgrade", "GET", with("Upgrade", "h2c"), http.StatusBadRequest},
+		{"missing version", "GET", with("Sec-Websocket-Version", ""), http.StatusUpgradeRequired},
+		{"old version", "GET", with("Sec-Websocket-Version", "8"), http.StatusUpgradeRequired},
+		{"missing key", "GET", with("Sec-Websocket-Key", ""), http.StatusBadRequest},
+		{"short key", "GET", with("Sec-Websocket-Key", "c2hvcnQ="), http.StatusBadRequest},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req, err := http.NewRequest(tc.method, srv.URL+"/ws", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = tc.header
+			if err := req.Write(c); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(c)
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %s, want %d", resp.Status, tc.want)
+			}
+			switch resp.StatusCode {
+			case http.StatusUpgradeRequired:
+				if v := resp.Header.Get("Sec-WebSocket-Version"); v != "13" {
+					t.Errorf("Sec-WebSocket-Version = %q, want 13", v)
+				}
+			case http.StatusSwitchingProtocols:
+				if a := resp.Header.Get("Sec-WebSocket-Accept"); a != accept {
+					t.Errorf("Sec-WebSocket-Accept = %q, want %q", a, accept)
+				}
+				msg := make([]byte, 7)
+				if _, err := io.ReadFull(br, msg); err != nil {
+					t.Fatal(err)
+				}
+				if want := []byte("\x81\x05hello"); !bytes.Equal(msg, want) {
+					t.Errorf("got frame %q, want %q", msg, want)
+				}
+			}
+		})
+	}
+}
+
+// clientFrame returns a frame as sent by a client, masked with mask, if it is
+// not nil.
+func clientFrame(fin bool, op byte, p []byte, mask []byte) []byte {
+	b := []byte{op, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch {
+	case len(p) < 126:
+		b[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		b[1] = 126
+		b = append(b, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(p)))
+	default:
+		b[1] = 127
+		b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[2:], uint64(len(p)))
+	}
+	if mask == nil {
+		return append(b, p...)
+	}
+	b[1] |= 0x80
+	b = append(b, mask...)
+	for i, c := range p {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// newConn returns a Conn reading in and writing to out.
+func newConn(in []byte, out *bytes.Buffer) *Conn {
+	return &Conn{r: bufio.NewReader(bytes.NewReader(in)), w: bufio.NewWriter(out)}
+}
+
+func payload(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i * 7)
+	}
+	return p
+}
+
+func TestWriteFrame(t *testing.T) {
+	tcs := []struct {
+		n   int
+		hdr []byte
+	}{
+		{0, []byte{0x82, 0}},
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0, 126}},
+		{0xffff, []byte{0x82, 126, 0xff, 0xff}},
+		{0x10000, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, tc := range tcs {
+		var out bytes.Buffer
+		p := payload(tc.n)
+		if err := newConn(nil, &out).WriteBinary(p); err != nil {
+			t.Fatalf("WriteBinary(%d bytes) = %v", tc.n, err)
+		}
+		if want := append(tc.hdr, p...); !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("WriteBinary(%d bytes) wrote header %x, want %x", tc.n, out.Bytes()[:len(tc.hdr)], tc.hdr)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	big := payload(70000)
+	tcs := []struct {
+		name     string
+		in       [][]byte
+		wantText bool
+		want     []byte
+		// wantOut is what the server is expected to send.
+		wantOut []byte
+		wantErr error
+	}{
+		{
+			name:     "text",
+			in:       [][]byte{clientFrame(true, opText, []byte("hello"), mask)},
+			wantText: true,
+			want:     []byte("hello"),
+		},
+		{
+			name: "16-bit length",
+			in:   [][]byte{clientFrame(true, opBinary, payload(300), mask)},
+			want: payload(300),
+		},
+		{
+			name: "64-bit length",
+			in:   [][]byte{clientFrame(true, opBinary, big, mask)},
+			want: big,
+		},
+		{
+			name: "fragmented",
+			in: [][]byte{
+				clientFrame(false, opBinary, []byte("frag"), mask),
+				clientFrame(false, opContinuation, []byte("men"), mask),
+				clientFrame(true, opContinuation, []byte("ted"), mask),
+			},
+			want: []byte("fragmented"),
+		},
+		{
+			name: "ping between fragments",
+			in: [][]byte{
+				clientFrame(false, opText, []byte("a"), mask),
+				clientFrame(true, opPing, []byte("ping"), mask),
+				clientFrame(true, opPong, []byte("pong"), mask),
+				clientFrame(true, opContinuation, []byte("b"), mask),
+			},
+			wantText: true,
+			want:     []byte("ab"),
+			wantOut:  []byte("\x8a\x04ping"),
+		},
+		{
+			name:    "close",
+			in:      [][]byte{clientFrame(true, opClose, []byte("\x03\xe8bye"), mask)},
+			wantOut: []byte("\x88\x02\x03\xe8"),
+			wantErr: io.EOF,
+		},
+		{
+			name:    "close without status",
+			in:      [][]byte{clientFrame(true, opClose, nil, mask)},
+			wantOut: []byte("\x88\x00"),
+			wantErr: io.EOF,
+		},
+		{
+			name: "unmasked",
+			in:   [][]byte{clientFrame(true, opText, []byte("hello"), nil)},
+		},
+		{
+			name: "reserved bits",
+			in:   [][]byte{append([]byte{0xc1}, clientFrame(true, opText, []byte("x"), mask)[1:]...)},
+		},
+		{
+			name: "long control frame",
+			in:   [][]byte{clientFrame(true, opPing, payload(126), mask)},
+		},
+		{
+			name: "fragmented control frame",
+			in:   [][]byte{clientFrame(false, opPing, nil, mask)},
+		},
+		{
+			name: "unexpected continuation",
+			in:   [][]byte{clientFrame(true, opContinuation, []byte("x"), mask)},
+		},
+		{
+			name: "missing continuation",
+			in: [][]byte{
+				clientFrame(false, opText, []byte("x"), mask),
+				clientFrame(true, opText, []byte("y"), mask),
+			},
+		},
+		{
+			name: "unknown opcode",
+			in:   [][]byte{clientFrame(true, 0x3, nil, mask)},
+		},
+		{
+			name: "too large",
+			in:   [][]byte{clientFrame(true, opBinary, payload(maxMessageSize+1), mask)},
+		},
+		{
+			name: "truncated",
+			in:   [][]byte{clientFrame(true, opBinary, payload(300), mask)[:100]},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := newConn(bytes.Join(tc.in, nil), &out)
+			text, p, err := c.ReadMessage()
+			if tc.want == nil {
+				if err == nil || (tc.wantErr != nil && err != tc.wantErr) {
+					t.Errorf("ReadMessage() = %v, %q, %v, want error %v", text, p, err, tc.wantErr)
+				}
+			} else if err != nil || text != tc.wantText || !bytes.Equal(p, tc.want) {
+				t.Errorf("ReadMessage() = %v, %s, %v, want %v, %s, <nil>", text, abbrev(p), err, tc.wantText, abbrev(tc.want))
+			}
+			if !bytes.Equal(out.Bytes(), tc.wantOut) {
+				t.Errorf("server sent %q, want %q", out.Bytes(), tc.wantOut)
+			}
+		})
+	}
+}
+
+// abbrev formats p for error messages.
+func abbrev(p []byte) string {
+	if len(p) > 16 {
+		return fmt.Sprintf("%q... (%d bytes)", p[:16], len(p))
+	}
+	return fmt.Sprintf("%q", p)
+}
+
+func TestClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &Conn{c: server, r: bufio.NewReader(server), w: bufio.NewWriter(server)}
+	go c.Close()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x88, 0}; !bytes.Equal(got, want) {
+		t.Errorf("Close() sent %x, want %x", got, want)
+	}
+	if err := c.WriteText("late"); err == nil {
+		t.Error("WriteText() after Close() succeeded")
+	}
+}
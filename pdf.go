@@ -0,0 +1,165 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Merovius/srvfb/internal/pdf"
+	"github.com/Merovius/srvfb/internal/png"
+)
+
+// pdfDPI is the resolution of the reMarkable's screen. Pages of PDFs have the
+// size of the device by default.
+const pdfDPI = 226
+
+// servePDF serves a PDF containing all archived pages, followed by the
+// current screen.
+func (h *handler) servePDF(w http.ResponseWriter, r *http.Request) {
+	var pages [][]byte
+	if h.archive != nil {
+		list, err := h.archive.list()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		for _, p := range list {
+			b, err := h.archive.get(p.Name)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			pages = append(pages, b)
+		}
+	}
+	sub := h.capture.subscribe(0, transform{})
+	f, err := sub.next(r.Context())
+	sub.close()
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	pw := pdf.NewWriter(buf)
+	pw.DPI = pdfDPI
+	for _, b := range pages {
+		im, err := png.Decode(bytes.NewReader(b))
+		if err == nil {
+			err = pw.AddPage(im)
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = pw.AddPage(f.im); err == nil {
+		err = pw.Close()
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="srvfb.pdf"`)
+	w.Write(buf.Bytes())
+}
+
+// runPDF implements the pdf subcommand, which puts PNG images, like archived
+// pages, and the pages of recordings into a PDF.
+func runPDF(args []string) error {
+	fs := flag.NewFlagSet("pdf", flag.ExitOnError)
+	dpi := fs.Float64("dpi", pdfDPI, "Resolution of the images, which determines the page size")
+	pageTurn := fs.Float64("page-turn", 0.5, "Fraction of the screen, which has to change at once to detect a page turn in recordings")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: srvfb pdf [<flags>] <output> <input>...")
+		fmt.Fprintln(fs.Output(), "Inputs are PNG images or recordings made with -record. Every page of a recording is added, as detected by -page-turn, followed by its last frame.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("missing output or inputs")
+	}
+
+	out, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	pw := pdf.NewWriter(out)
+	pw.DPI = *dpi
+	for _, name := range fs.Args()[1:] {
+		rec, err := isRecording(name)
+		if err != nil {
+			return err
+		}
+		if rec {
+			err = recordingPages(name, *pageTurn, pw.AddPage)
+		} else {
+			err = pngPage(name, pw.AddPage)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = pw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// recordingPages calls add with the last frame of every page of the given
+// recording.
+func recordingPages(name string, pageTurn float64, add func(image.Image) error) error {
+	d := &pageDetector{pageTurn: pageTurn}
+	var last *frame
+	err := readRecording(name, func(f *frame) error {
+		last = f
+		if page := d.next(f); page != nil {
+			return add(page.im)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return add(last.im)
+}
+
+// pngPage calls add with the PNG image in the given file.
+func pngPage(name string, add func(image.Image) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	im, err := png.Decode(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return add(im)
+}
@@ -0,0 +1,595 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// version is the latest version of the raw protocol. Clients request it via
+// the version query parameter, the default being version 1.
+//
+// A version 1 stream starts with a part containing a rawHeader, followed by
+// one part per frame, containing its pixels.
+//
+// In a version 2 stream, every part contains a single frame, starting with a
+// rawFrameHeader. It is followed by Colors palette entries, as four bytes of
+// non-premultiplied RGBA each, and Rects changed rectangles. Each rectangle is
+// a rawRect, followed by its pixels, row by row without padding. The first
+// frame and every frame changing the resolution or pixel format update the
+// whole screen.
+//
+// Version 2 streams can be compressed, by passing compress=zlib. The server
+// confirms this via the Srvfb-Compression response header. Every part is then
+// compressed separately with zlib, and the pixels of every frame that keeps
+// the resolution and pixel format of its predecessor are XORed with the
+// previous content of the screen before compression. This makes unchanged
+// pixels zero, which compresses very well.
+const version = 2
+
+type rawHeader struct {
+	Version      uint8
+	BitsPerPixel uint8
+	Stride       uint16
+	Width        uint32
+	Height       uint32
+}
+
+type rawFrameHeader struct {
+	Version      uint8
+	BitsPerPixel uint8
+	Colors       uint16
+	Seq          uint64
+	// Time is the capture time in nanoseconds since the unix epoch.
+	Time   int64
+	Width  uint32
+	Height uint32
+	Rects  uint32
+}
+
+type rawRect struct {
+	X      uint32
+	Y      uint32
+	Width  uint32
+	Height uint32
+}
+
+func (h *handler) serveRaw(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Not a Flusher")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	v := 1
+	switch s := r.URL.Query().Get("version"); s {
+	case "", "1":
+	case "2":
+		v = 2
+	default:
+		http.Error(w, fmt.Sprintf("unsupported version %q", s), http.StatusBadRequest)
+		return
+	}
+
+	var compress bool
+	switch s := r.URL.Query().Get("compress"); s {
+	case "", "none":
+	case "zlib":
+		if v < 2 {
+			http.Error(w, "compression requires version 2", http.StatusBadRequest)
+			return
+		}
+		compress = true
+	default:
+		http.Error(w, fmt.Sprintf("unsupported compression %q", s), http.StatusBadRequest)
+		return
+	}
+
+	fps, err := parseFPS(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub := h.capture.subscribe(fps, t)
+	defer sub.close()
+	f, err := sub.next(r.Context())
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	if f.im.Bounds().Empty() {
+		http.Error(w, errCropOutside.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=endofsection")
+	if compress {
+		w.Header().Set("Srvfb-Compression", "zlib")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	mpw := multipart.NewWriter(w)
+	mpw.SetBoundary("endofsection")
+	hdr := make(textproto.MIMEHeader)
+	hdr.Add("Content-Type", "binary/octet-stream")
+
+	if v == 1 {
+		err = writeRawV1(r, mpw, hdr, flusher, sub, f)
+	} else {
+		err = writeRawV2(r, mpw, hdr, flusher, sub, f, compress)
+	}
+	if err != nil && r.Context().Err() == nil {
+		log.Println(err)
+	}
+}
+
+func writeRawV1(r *http.Request, mpw *multipart.Writer, hdr textproto.MIMEHeader, flusher http.Flusher, sub *subscription, f *frame) error {
+	var buf image.RGBA
+	pix, stride, bpp := pixels(rawImage(f.im, &buf))
+	bounds := f.im.Bounds()
+
+	part, err := mpw.CreatePart(hdr)
+	if err != nil {
+		return err
+	}
+	rhdr := &rawHeader{1, uint8(bpp), uint16(stride), uint32(bounds.Dx()), uint32(bounds.Dy())}
+	if err = binary.Write(part, binary.BigEndian, rhdr); err != nil {
+		return err
+	}
+	if part, err = mpw.CreatePart(hdr); err != nil {
+		return err
+	}
+	for {
+		if _, err = part.Write(pix); err != nil {
+			return err
+		}
+		f.release()
+		// The client only knows that a part is complete once it sees the
+		// next boundary, so we start the next part right away.
+		if part, err = mpw.CreatePart(hdr); err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		if f, err = sub.next(r.Context()); err != nil {
+			return err
+		}
+		var s, b int
+		pix, s, b = pixels(rawImage(f.im, &buf))
+		if s != stride || b != bpp || f.im.Bounds() != bounds {
+			return fmt.Errorf("frame format changed, ending raw stream")
+		}
+	}
+}
+
+// rawImage returns the representation of im sent over version 1 of the raw
+// protocol. As it has no way to transmit a color map, paletted images are
+// expanded into buf.
+func rawImage(im image.Image, buf *image.RGBA) image.Image {
+	p, ok := im.(*image.Paletted)
+	if !ok {
+		return im
+	}
+	if buf.Rect != p.Rect {
+		*buf = *image.NewRGBA(p.Rect)
+	}
+	draw.Draw(buf, buf.Rect, p, p.Rect.Min, draw.Src)
+	return buf
+}
+
+func writeRawV2(r *http.Request, mpw *multipart.Writer, hdr textproto.MIMEHeader, flusher http.Flusher, sub *subscription, f *frame, compress bool) error {
+	part, err := mpw.CreatePart(hdr)
+	if err != nil {
+		return err
+	}
+	rw := &rawWriter{compress: compress}
+	defer func() { rw.prev.release() }()
+	for {
+		if err = rw.write(part, f); err != nil {
+			return err
+		}
+		// The client only knows that a part is complete once it sees the
+		// next boundary, so we start the next part right away.
+		if part, err = mpw.CreatePart(hdr); err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		if f, err = sub.next(r.Context()); err != nil {
+			return err
+		}
+	}
+}
+
+// rawWriter writes the frames of a version 2 stream, each into its own part.
+type rawWriter struct {
+	compress bool
+	// prev is the last frame written. The writer holds its reference.
+	prev *frame
+	zw   *zlib.Writer
+	buf  []byte
+}
+
+// write writes f into part, as an update of the previously written frame.
+// The reference to f is passed to rw.
+func (rw *rawWriter) write(part io.Writer, f *frame) error {
+	var w io.Writer = part
+	if rw.compress {
+		if rw.zw == nil {
+			rw.zw, _ = zlib.NewWriterLevel(part, zlib.BestSpeed)
+		} else {
+			rw.zw.Reset(part)
+		}
+		w = rw.zw
+	}
+	var xor image.Image
+	if rw.compress && rw.prev != nil && compatible(rw.prev.im, f.im) {
+		xor = rw.prev.im
+	}
+	var err error
+	if rw.buf, err = writeRawFrame(w, f, f.changes(rw.prev), xor, rw.buf); err != nil {
+		return err
+	}
+	if rw.compress {
+		if err = rw.zw.Close(); err != nil {
+			return err
+		}
+	}
+	rw.prev.release()
+	rw.prev = f
+	return nil
+}
+
+// compatible returns whether the frame images a and b have the same bounds and
+// pixel format, so a frame b can be sent as an update of a.
+func compatible(a, b image.Image) bool {
+	var pal color.Palette
+	if p, ok := b.(*image.Paletted); ok {
+		pal = p.Palette
+	}
+	_, _, bpp := pixels(b)
+	return a.Bounds() == b.Bounds() && sameFormat(a, bpp, pal)
+}
+
+// writeRawFrame writes a single frame of a version 2 stream, updating the
+// given rectangles. If xor is not nil, pixels are XORed with it. buf is a
+// scratch buffer, which is returned for reuse.
+func writeRawFrame(w io.Writer, f *frame, rects []image.Rectangle, xor image.Image, buf []byte) ([]byte, error) {
+	bw := bufio.NewWriterSize(w, 1<<16)
+	pix, stride, bpp := pixels(f.im)
+	b := f.im.Bounds()
+	var pal color.Palette
+	if p, ok := f.im.(*image.Paletted); ok {
+		pal = p.Palette
+	}
+	var xpix []byte
+	if xor != nil {
+		xpix, _, _ = pixels(xor)
+	}
+	fh := &rawFrameHeader{
+		Version:      2,
+		BitsPerPixel: uint8(bpp),
+		Colors:       uint16(len(pal)),
+		Seq:          f.seq,
+		Time:         f.time.UnixNano(),
+		Width:        uint32(b.Dx()),
+		Height:       uint32(b.Dy()),
+		Rects:        uint32(len(rects)),
+	}
+	if err := binary.Write(bw, binary.BigEndian, fh); err != nil {
+		return buf, err
+	}
+	for _, c := range pal {
+		c := color.NRGBAModel.Convert(c).(color.NRGBA)
+		bw.Write([]byte{c.R, c.G, c.B, c.A})
+	}
+	for _, r := range rects {
+		r = r.Sub(b.Min)
+		rr := &rawRect{uint32(r.Min.X), uint32(r.Min.Y), uint32(r.Dx()), uint32(r.Dy())}
+		if err := binary.Write(bw, binary.BigEndian, rr); err != nil {
+			return buf, err
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			i, j := y*stride+r.Min.X*bpp/8, y*stride+r.Max.X*bpp/8
+			row := pix[i:j]
+			if xpix != nil {
+				buf = append(buf[:0], row...)
+				xorBytes(buf, xpix[i:j])
+				row = buf
+			}
+			if _, err := bw.Write(row); err != nil {
+				return buf, err
+			}
+		}
+	}
+	return buf, bw.Flush()
+}
+
+// xorBytes sets dst[i] ^= src[i] for all i.
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// proxyconn is a stream reading frames from the raw endpoint of an upstream
+// srvfb. It speaks both versions of the protocol.
+type proxyconn struct {
+	r          *multipart.Reader
+	closer     io.Closer
+	version    int
+	compressed bool
+	zr         io.ReadCloser
+
+	// Used for version 1.
+	bpp    int
+	stride int
+	width  int
+	height int
+
+	// Used for version 2. cur is the current screen content, updated by
+	// every frame. pending is set, if cur contains a frame that hasn't been
+	// returned by readImage yet.
+	cur     image.Image
+	pending bool
+	buf     []byte
+}
+
+// dialProxy connects to the upstream srvfb at addr. If compress is set, a
+// compressed stream is requested.
+func dialProxy(addr string, compress bool) (*proxyconn, error) {
+	u := fmt.Sprintf("http://%s/raw?version=%d", addr, version)
+	if compress {
+		u += "&compress=zlib"
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET /raw: %s", resp.Status)
+	}
+	c := &proxyconn{
+		closer:     resp.Body,
+		compressed: resp.Header.Get("Srvfb-Compression") == "zlib",
+	}
+	if err = c.readHdr(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *proxyconn) readHdr(resp *http.Response) error {
+	mt, parms, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if mt != "multipart/x-mixed-replace" {
+		return fmt.Errorf("unknown media type %q", mt)
+	}
+	if parms["boundary"] == "" {
+		return fmt.Errorf("no boundary in media type %q", resp.Header.Get("Content-Type"))
+	}
+	c.r = multipart.NewReader(resp.Body, parms["boundary"])
+
+	// Parts are not closed explicitly, as that blocks until the next
+	// boundary arrives, which old servers only send with the next frame.
+	// NextPart skips whatever is left of them.
+	part, err := c.nextPart()
+	if err != nil {
+		return err
+	}
+	if c.compressed {
+		c.version = 2
+		c.pending = true
+		return c.readFrame(bufio.NewReader(part))
+	}
+	// Old servers ignore the requested version, so we have to look at
+	// what they actually sent.
+	br := bufio.NewReader(part)
+	v, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch v[0] {
+	case 1:
+		c.version = 1
+	case 2:
+		c.version = 2
+		c.pending = true
+		return c.readFrame(br)
+	default:
+		return fmt.Errorf("incompatible version %d", v[0])
+	}
+
+	var hdr rawHeader
+	if err := binary.Read(br, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	log.Printf("Got header: %#x", hdr)
+	if hdr.BitsPerPixel != 8 && hdr.BitsPerPixel != 16 && hdr.BitsPerPixel != 32 {
+		return fmt.Errorf("incompatible bits per pixel %d", hdr.BitsPerPixel)
+	}
+	c.bpp = int(hdr.BitsPerPixel)
+	c.stride = int(hdr.Stride)
+	c.width = int(hdr.Width)
+	c.height = int(hdr.Height)
+	return nil
+}
+
+func (c *proxyconn) nextPart() (*multipart.Part, error) {
+	part, err := c.r.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	if ct := part.Header.Get("Content-Type"); ct != "binary/octet-stream" {
+		part.Close()
+		return nil, fmt.Errorf("unknown Content-Type %q for part", ct)
+	}
+	return part, nil
+}
+
+func (c *proxyconn) readImage(im image.Image) (image.Image, error) {
+	if c.version == 2 {
+		return c.readImageV2(im)
+	}
+	r := image.Rect(0, 0, c.width, c.height)
+	switch c.bpp {
+	case 8:
+		if g, ok := im.(*image.Gray); !ok || len(g.Pix) != c.stride*c.height {
+			im = &image.Gray{Pix: make([]byte, c.stride*c.height), Stride: c.stride, Rect: r}
+		}
+	case 16:
+		if g, ok := im.(*image.Gray16); !ok || len(g.Pix) != c.stride*c.height {
+			im = &image.Gray16{Pix: make([]byte, c.stride*c.height), Stride: c.stride, Rect: r}
+		}
+	case 32:
+		if m, ok := im.(*image.RGBA); !ok || len(m.Pix) != c.stride*c.height {
+			im = &image.RGBA{Pix: make([]byte, c.stride*c.height), Stride: c.stride, Rect: r}
+		}
+	}
+	part, err := c.nextPart()
+	if err != nil {
+		return nil, err
+	}
+	pix, _, _ := pixels(im)
+	if _, err = io.ReadFull(part, pix); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+func (c *proxyconn) readImageV2(im image.Image) (image.Image, error) {
+	if !c.pending {
+		part, err := c.nextPart()
+		if err != nil {
+			return nil, err
+		}
+		if err = c.readFrame(bufio.NewReader(part)); err != nil {
+			return nil, err
+		}
+	}
+	c.pending = false
+	return copyImage(im, c.cur), nil
+}
+
+// readFrame reads a single version 2 frame from r and applies it to c.cur.
+func (c *proxyconn) readFrame(r io.Reader) error {
+	if c.compressed {
+		var err error
+		if c.zr == nil {
+			c.zr, err = zlib.NewReader(r)
+		} else {
+			err = c.zr.(zlib.Resetter).Reset(r, nil)
+		}
+		if err != nil {
+			return err
+		}
+		r = bufio.NewReader(c.zr)
+	}
+	var err error
+	c.cur, c.buf, err = readRawFrame(r, c.cur, c.compressed, c.buf)
+	return err
+}
+
+// readRawFrame reads a single version 2 frame from r and applies it to cur,
+// which is replaced by a new image, if it is nil or the frame changes the
+// resolution or pixel format. If xor is set, the pixels of frames keeping them
+// are XORed with cur. buf is a scratch buffer, which is returned for reuse.
+func readRawFrame(r io.Reader, cur image.Image, xor bool, buf []byte) (image.Image, []byte, error) {
+	var fh rawFrameHeader
+	if err := binary.Read(r, binary.BigEndian, &fh); err != nil {
+		return cur, buf, err
+	}
+	if fh.Version != 2 {
+		return cur, buf, fmt.Errorf("unexpected version %d in frame", fh.Version)
+	}
+	var pal color.Palette
+	if fh.Colors > 0 {
+		cbuf := make([]byte, 4*int(fh.Colors))
+		if _, err := io.ReadFull(r, cbuf); err != nil {
+			return cur, buf, err
+		}
+		pal = make(color.Palette, fh.Colors)
+		for i := range pal {
+			pal[i] = color.NRGBA{cbuf[4*i], cbuf[4*i+1], cbuf[4*i+2], cbuf[4*i+3]}
+		}
+	}
+	b := image.Rect(0, 0, int(fh.Width), int(fh.Height))
+	xor = xor && cur != nil && cur.Bounds() == b && sameFormat(cur, int(fh.BitsPerPixel), pal)
+	if cur == nil || cur.Bounds() != b || !sameFormat(cur, int(fh.BitsPerPixel), pal) {
+		im, err := newImage(b, int(fh.BitsPerPixel), pal)
+		if err != nil {
+			return cur, buf, err
+		}
+		cur = im
+	} else if p, ok := cur.(*image.Paletted); ok {
+		p.Palette = pal
+	}
+
+	pix, stride, bpp := pixels(cur)
+	for i := uint32(0); i < fh.Rects; i++ {
+		var rr rawRect
+		if err := binary.Read(r, binary.BigEndian, &rr); err != nil {
+			return cur, buf, err
+		}
+		rect := image.Rect(int(rr.X), int(rr.Y), int(rr.X+rr.Width), int(rr.Y+rr.Height))
+		if !rect.In(b) {
+			return cur, buf, fmt.Errorf("rectangle %v out of bounds %v", rect, b)
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			row := pix[y*stride+rect.Min.X*bpp/8 : y*stride+rect.Max.X*bpp/8]
+			if !xor {
+				if _, err := io.ReadFull(r, row); err != nil {
+					return cur, buf, err
+				}
+				continue
+			}
+			buf = append(buf[:0], row...)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return cur, buf, err
+			}
+			xorBytes(row, buf)
+		}
+	}
+	return cur, buf, nil
+}
+
+func (c *proxyconn) polled() bool {
+	return false
+}
+
+func (c *proxyconn) close() error {
+	return c.closer.Close()
+}
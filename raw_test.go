@@ -0,0 +1,255 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+)
+
+// testFrames returns a sequence of frames with consecutive sequence numbers,
+// covering deltas, paletted frames with reduced depth and changes of the
+// resolution and pixel format.
+func testFrames() []*frame {
+	gray16 := func(w, h int, v uint16) *image.Gray16 {
+		m := image.NewGray16(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.SetGray16(x, y, color.Gray16{v + uint16(x*y)})
+			}
+		}
+		return m
+	}
+	drawn := gray16(70, 40, 0x1000)
+	for x := 10; x < 50; x++ {
+		drawn.SetGray16(x, 35, color.Gray16{0xffff})
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 20, 10))
+	gray.Pix[42] = 0x80
+
+	ims := []image.Image{
+		gray16(70, 40, 0x1000),
+		drawn,
+		reduceDepth(nil, drawn, 4),
+		reduceDepth(nil, gray16(70, 40, 0x8000), 4),
+		reduceDepth(nil, gray16(70, 40, 0x8000), 1),
+		reduceDepth(nil, gray16(70, 40, 0x8000), 2),
+		rgba,
+		gray,
+	}
+	var (
+		frames []*frame
+		prev   image.Image
+	)
+	for i, im := range ims {
+		frames = append(frames, &frame{
+			seq:   uint64(i + 1),
+			time:  time.Unix(0, int64(i)*int64(time.Millisecond)),
+			im:    im,
+			dirty: diff.Changed(prev, im, diff.TileSize),
+		})
+		prev = im
+	}
+	return frames
+}
+
+// sameFrame returns an error, if the frame images a and b differ.
+func sameFrame(a, b image.Image) error {
+	if a.Bounds() != b.Bounds() {
+		return fmt.Errorf("bounds %v != %v", a.Bounds(), b.Bounds())
+	}
+	if fmt.Sprintf("%T", a) != fmt.Sprintf("%T", b) {
+		return fmt.Errorf("type %T != %T", a, b)
+	}
+	if pa, ok := a.(*image.Paletted); ok {
+		pb := b.(*image.Paletted)
+		if len(pa.Palette) != len(pb.Palette) {
+			return fmt.Errorf("%d != %d colors", len(pa.Palette), len(pb.Palette))
+		}
+		for i := range pa.Palette {
+			if color.NRGBAModel.Convert(pa.Palette[i]) != color.NRGBAModel.Convert(pb.Palette[i]) {
+				return fmt.Errorf("color %d: %v != %v", i, pa.Palette[i], pb.Palette[i])
+			}
+		}
+	}
+	pa, sa, bpp := pixels(a)
+	pb, sb, _ := pixels(b)
+	n := a.Bounds().Dx() * bpp / 8
+	for y := 0; y < a.Bounds().Dy(); y++ {
+		if !bytes.Equal(pa[y*sa:y*sa+n], pb[y*sb:y*sb+n]) {
+			return fmt.Errorf("row %d differs", y)
+		}
+	}
+	return nil
+}
+
+func TestRawFrameRoundTrip(t *testing.T) {
+	for _, xor := range []bool{false, true} {
+		t.Run(fmt.Sprintf("xor=%v", xor), func(t *testing.T) {
+			var (
+				prev     *frame
+				cur      image.Image
+				wbuf     []byte
+				rbuf     []byte
+				keyframe = true
+				deltas   int
+			)
+			for _, f := range testFrames() {
+				var x image.Image
+				if xor && prev != nil && compatible(prev.im, f.im) {
+					x = prev.im
+				}
+				rects := f.changes(prev)
+				if prev != nil && !compatible(prev.im, f.im) {
+					keyframe = true
+				}
+				if keyframe && (len(rects) != 1 || rects[0] != f.im.Bounds()) {
+					t.Errorf("frame %d: changes() = %v, want the whole screen", f.seq, rects)
+				}
+				if diff.Bounds(rects) != f.im.Bounds() {
+					deltas++
+				}
+
+				var b bytes.Buffer
+				var err error
+				if wbuf, err = writeRawFrame(&b, f, rects, x, wbuf); err != nil {
+					t.Fatalf("frame %d: writeRawFrame() = %v", f.seq, err)
+				}
+				if cur, rbuf, err = readRawFrame(&b, cur, xor, rbuf); err != nil {
+					t.Fatalf("frame %d: readRawFrame() = %v", f.seq, err)
+				}
+				if b.Len() != 0 {
+					t.Errorf("frame %d: %d bytes left after readRawFrame()", f.seq, b.Len())
+				}
+				if err := sameFrame(f.im, cur); err != nil {
+					t.Errorf("frame %d: decoded image differs: %v", f.seq, err)
+				}
+				prev, keyframe = f, false
+			}
+			if deltas == 0 {
+				t.Error("no frame updated only part of the screen")
+			}
+		})
+	}
+}
+
+// oldRaw serves the raw endpoint like a server predating version 2, which
+// ignores the requested version and compression.
+func oldRaw(h *handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.RawQuery = ""
+		h.serveRaw(w, r)
+	})
+}
+
+func TestProxyNegotiation(t *testing.T) {
+	tcs := []struct {
+		name           string
+		old            bool
+		compress       bool
+		wantVersion    int
+		wantCompressed bool
+	}{
+		{"v2", false, false, 2, false},
+		{"v2 compressed", false, true, 2, true},
+		{"v1 server", true, false, 1, false},
+		{"v1 server without compression", true, true, 1, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			src := new(testSource)
+			src.set(7)
+			h := &handler{capture: newCapture(src, 0, 10*time.Millisecond)}
+			var srv *httptest.Server
+			if tc.old {
+				srv = httptest.NewServer(oldRaw(h))
+			} else {
+				srv = httptest.NewServer(h)
+			}
+			defer srv.Close()
+
+			c, err := dialProxy(strings.TrimPrefix(srv.URL, "http://"), tc.compress)
+			if err != nil {
+				t.Fatalf("dialProxy() = %v", err)
+			}
+			defer c.close()
+			if c.version != tc.wantVersion || c.compressed != tc.wantCompressed {
+				t.Errorf("negotiated version %d, compressed %v, want %d, %v", c.version, c.compressed, tc.wantVersion, tc.wantCompressed)
+			}
+			for _, v := range []uint8{7, 9} {
+				src.set(v)
+				var im image.Image
+				for {
+					if im, err = c.readImage(im); err != nil {
+						t.Fatalf("readImage() = %v", err)
+					}
+					if im.(*image.Gray).Pix[0] == v {
+						break
+					}
+				}
+				want, _ := testStream{src}.readImage(nil)
+				if err := sameFrame(want, im); err != nil {
+					t.Errorf("readImage() differs from the screen: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRawCompression(t *testing.T) {
+	var (
+		decoded [2][]image.Image
+		size    [2]int
+	)
+	for i, compress := range []bool{false, true} {
+		rw := &rawWriter{compress: compress}
+		c := &proxyconn{version: 2, compressed: compress}
+		for _, f := range testFrames() {
+			var b bytes.Buffer
+			if err := rw.write(&b, f); err != nil {
+				t.Fatalf("compress=%v: writing frame %d: %v", compress, f.seq, err)
+			}
+			size[i] += b.Len()
+			if err := c.readFrame(&b); err != nil {
+				t.Fatalf("compress=%v: reading frame %d: %v", compress, f.seq, err)
+			}
+			decoded[i] = append(decoded[i], copyImage(nil, c.cur))
+		}
+	}
+	for i, f := range testFrames() {
+		if err := sameFrame(decoded[0][i], decoded[1][i]); err != nil {
+			t.Errorf("frame %d decodes differently with compression: %v", f.seq, err)
+		}
+		if err := sameFrame(f.im, decoded[1][i]); err != nil {
+			t.Errorf("frame %d differs after compression: %v", f.seq, err)
+		}
+	}
+	if size[1] >= size[0] {
+		t.Errorf("compressed stream has %d bytes, uncompressed %d", size[1], size[0])
+	}
+}
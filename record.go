@@ -0,0 +1,441 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+)
+
+// A recording starts with a recordFileHeader, followed by one record per
+// frame. Every record is a recordHeader followed by Length bytes containing a
+// zlib-compressed frame of version 2 of the raw protocol.
+//
+// Keyframes update the whole screen. The pixels of all other frames are XORed
+// with the previous content of the screen, as in a compressed raw stream.
+// Keyframes are written at least every recordKeyframeInterval, so a player
+// can seek to any time by decoding at most that many seconds of frames.
+const (
+	recordMagic            = "srvfbrec"
+	recordVersion          = 1
+	recordKeyframeInterval = 10 * time.Second
+	// maxRecordLength limits the size of a single record read from a
+	// recording.
+	maxRecordLength = 1 << 30
+)
+
+type recordFileHeader struct {
+	Magic   [8]byte
+	Version uint8
+}
+
+type recordHeader struct {
+	// Time is the capture time in nanoseconds since the unix epoch.
+	Time     int64
+	Keyframe uint8
+	Length   uint32
+}
+
+// record appends all frames captured by c to the recording in the given
+// file, which must not exist yet. It only returns if writing fails.
+func record(c *capture, name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fh := recordFileHeader{Version: recordVersion}
+	copy(fh.Magic[:], recordMagic)
+	if err = binary.Write(f, binary.BigEndian, &fh); err != nil {
+		return err
+	}
+	rw := &recordWriter{w: f}
+	err = c.follow(func(fr *frame) error {
+		if fr == nil {
+			// Start the next capture with a keyframe.
+			rw.reset()
+			return nil
+		}
+		return rw.writeFrame(fr)
+	})
+	return fmt.Errorf("recording to %s: %v", name, err)
+}
+
+// recordWriter writes the records of a recording.
+type recordWriter struct {
+	w       io.Writer
+	zw      *zlib.Writer
+	buf     bytes.Buffer
+	scratch []byte
+	// prev is the previously written frame, which rw holds, and key the
+	// time of the last keyframe.
+	prev *frame
+	key  time.Time
+}
+
+// reset makes the next frame a keyframe.
+func (rw *recordWriter) reset() {
+	rw.prev.release()
+	rw.prev = nil
+}
+
+func (rw *recordWriter) writeFrame(f *frame) error {
+	key, data, err := rw.encodeFrame(f)
+	if err != nil {
+		return err
+	}
+	rh := recordHeader{Time: f.time.UnixNano(), Length: uint32(len(data))}
+	if key {
+		rh.Keyframe = 1
+	}
+	if err = binary.Write(rw.w, binary.BigEndian, &rh); err != nil {
+		return err
+	}
+	_, err = rw.w.Write(data)
+	return err
+}
+
+// encodeFrame returns the compressed record of f and whether it is a keyframe.
+// The data is only valid until the next call. The reference to f is passed to
+// rw.
+func (rw *recordWriter) encodeFrame(f *frame) (key bool, data []byte, err error) {
+	var (
+		rects = []image.Rectangle{f.im.Bounds()}
+		xor   image.Image
+	)
+	key = true
+	if rw.prev != nil && compatible(rw.prev.im, f.im) && f.time.Sub(rw.key) < recordKeyframeInterval {
+		rects, xor, key = f.changes(rw.prev), rw.prev.im, false
+	}
+	rw.buf.Reset()
+	if rw.zw == nil {
+		rw.zw, _ = zlib.NewWriterLevel(&rw.buf, zlib.BestSpeed)
+	} else {
+		rw.zw.Reset(&rw.buf)
+	}
+	if rw.scratch, err = writeRawFrame(rw.zw, f, rects, xor, rw.scratch); err != nil {
+		return false, nil, err
+	}
+	if err = rw.zw.Close(); err != nil {
+		return false, nil, err
+	}
+	if key {
+		rw.key = f.time
+	}
+	rw.prev.release()
+	rw.prev = f
+	return key, rw.buf.Bytes(), nil
+}
+
+// replaySource plays back a recording with its original timing, sped up by
+// the given factor. Every stream starts at the given offset from the start of
+// the recording and keeps showing the last frame, once it is done.
+type replaySource struct {
+	name   string
+	speed  float64
+	offset time.Duration
+}
+
+func (s replaySource) open() (stream, error) {
+	f, err := os.Open(s.name)
+	if err != nil {
+		return nil, err
+	}
+	st := newReplayStream(f, s.speed)
+	if err = st.seek(s.offset); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", s.name, err)
+	}
+	return st, nil
+}
+
+// isRecording returns whether the file name is a recording.
+func isRecording(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(recordMagic))
+	if _, err = io.ReadFull(f, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	return string(magic) == recordMagic, err
+}
+
+// readRecording calls fn with every frame of the recording in the given file,
+// as fast as possible, until it returns an error. The frames are only valid
+// until the next call of fn returns.
+func readRecording(name string, fn func(*frame) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	s := newReplayStream(f, 0)
+	defer s.close()
+	if err = s.seek(0); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	// Frames alternate between two buffers, so the previous one is still
+	// valid for computing the changes.
+	var (
+		bufs [2]image.Image
+		prev *frame
+		t    = s.origin
+	)
+	for seq := uint64(1); ; seq++ {
+		im := copyImage(bufs[seq%2], s.cur)
+		bufs[seq%2] = im
+		fr := &frame{seq: seq, time: time.Unix(0, t), im: im}
+		var previm image.Image
+		if prev != nil {
+			previm = prev.im
+		}
+		fr.dirty = diff.Changed(previm, im, diff.TileSize)
+		if err = fn(fr); err != nil {
+			return err
+		}
+		prev = fr
+
+		h, err := s.header()
+		if err == nil {
+			t = h.Time
+			err = s.readRecord()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// replayStream is a stream reading frames from a recording.
+type replayStream struct {
+	f     *os.File
+	r     *bufio.Reader
+	speed float64
+	// start is the time playback started at and origin the time in the
+	// recording corresponding to it.
+	start  time.Time
+	origin int64
+	// next is the header of the next record, if it has already been read.
+	next *recordHeader
+	// cur is the current screen content. pending is set, if it hasn't been
+	// returned by readImage yet.
+	cur     image.Image
+	pending bool
+	eof     bool
+	zr      io.ReadCloser
+	rec     bytes.Buffer
+	buf     []byte
+	// timer waits for the next frame, unless done is closed first.
+	timer     *time.Timer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplayStream(f *os.File, speed float64) *replayStream {
+	return &replayStream{f: f, r: bufio.NewReader(f), speed: speed, done: make(chan struct{})}
+}
+
+// seek starts playback at the given offset from the start of the recording,
+// by decoding all frames from the last keyframe before it.
+func (s *replayStream) seek(offset time.Duration) error {
+	var fh recordFileHeader
+	if err := binary.Read(s.r, binary.BigEndian, &fh); err != nil {
+		return err
+	}
+	if string(fh.Magic[:]) != recordMagic {
+		return errors.New("not a recording")
+	}
+	if fh.Version != recordVersion {
+		return fmt.Errorf("unsupported recording version %d", fh.Version)
+	}
+	pos := int64(binary.Size(fh))
+	first, err := s.header()
+	if err != nil {
+		return err
+	}
+	target := first.Time + int64(offset)
+
+	// Find the last keyframe before the target by skipping from header to
+	// header.
+	key := pos
+	for {
+		h, err := s.header()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if h.Time > target {
+			break
+		}
+		n, err := s.r.Discard(int(h.Length))
+		if err != nil {
+			// The record is truncated, so it can't be played.
+			break
+		}
+		if h.Keyframe != 0 {
+			key = pos
+		}
+		pos += int64(binary.Size(h)) + int64(n)
+		s.next = nil
+	}
+	if _, err = s.f.Seek(key, io.SeekStart); err != nil {
+		return err
+	}
+	s.r.Reset(s.f)
+	s.next = nil
+
+	for {
+		h, err := s.header()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if h.Time > target && s.cur != nil {
+			break
+		}
+		if err = s.readRecord(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if s.cur == nil {
+		return errors.New("no frames in recording")
+	}
+	s.pending = true
+	s.start, s.origin = time.Now(), target
+	return nil
+}
+
+// header returns the header of the next record, without consuming it. A
+// truncated record, as left by an interrupted recording, is treated as the
+// end of the recording.
+func (s *replayStream) header() (*recordHeader, error) {
+	if s.next != nil {
+		return s.next, nil
+	}
+	h := new(recordHeader)
+	if err := binary.Read(s.r, binary.BigEndian, h); err == io.ErrUnexpectedEOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+	if h.Length > maxRecordLength {
+		return nil, fmt.Errorf("record of %d bytes too large", h.Length)
+	}
+	s.next = h
+	return h, nil
+}
+
+// readRecord reads the next record and applies it to s.cur. The record is
+// read completely before it is decoded, so a truncated record ends the
+// recording without changing s.cur.
+func (s *replayStream) readRecord() error {
+	h, err := s.header()
+	if err != nil {
+		return err
+	}
+	s.next = nil
+	s.rec.Reset()
+	if _, err = io.CopyN(&s.rec, s.r, int64(h.Length)); err != nil {
+		return err
+	}
+	if s.zr == nil {
+		s.zr, err = zlib.NewReader(&s.rec)
+	} else {
+		err = s.zr.(zlib.Resetter).Reset(&s.rec, nil)
+	}
+	if err == nil {
+		s.cur, s.buf, err = readRawFrame(bufio.NewReader(s.zr), s.cur, h.Keyframe == 0, s.buf)
+	}
+	return err
+}
+
+func (s *replayStream) readImage(im image.Image) (image.Image, error) {
+	if s.pending || s.eof {
+		s.pending = false
+		return copyImage(im, s.cur), nil
+	}
+	h, err := s.header()
+	if err == nil {
+		d := time.Duration(float64(h.Time-s.origin) / s.speed)
+		if err = s.sleep(time.Until(s.start.Add(d))); err == nil {
+			err = s.readRecord()
+		}
+	}
+	if err == io.EOF {
+		log.Println("End of recording")
+		s.eof = true
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return copyImage(im, s.cur), nil
+}
+
+// sleep waits for d, unless s is closed before.
+func (s *replayStream) sleep(d time.Duration) error {
+	if s.timer == nil {
+		s.timer = time.NewTimer(d)
+	} else {
+		s.timer.Reset(d)
+	}
+	select {
+	case <-s.timer.C:
+		return nil
+	case <-s.done:
+		s.timer.Stop()
+		return os.ErrClosed
+	}
+}
+
+// polled returns whether the recording is done. Until then, readImage waits
+// for the next frame.
+func (s *replayStream) polled() bool {
+	return s.eof
+}
+
+// close closes the recording and interrupts readImage, if it waits for the
+// next frame. It may be called more than once.
+func (s *replayStream) close() error {
+	err := os.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.f.Close()
+	})
+	return err
+}
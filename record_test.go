@@ -0,0 +1,249 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+)
+
+// recordFrames returns frames two seconds apart, each drawing into a copy of
+// the previous one, with a change of the resolution after 16 seconds. They
+// are recorded as keyframes at the indices given by recordKeys.
+func recordFrames() []*frame {
+	var (
+		frames []*frame
+		prev   *image.Gray16
+	)
+	for i := 0; i < 14; i++ {
+		im := image.NewGray16(image.Rect(0, 0, 64, 48))
+		if i >= 8 {
+			im = image.NewGray16(image.Rect(0, 0, 48, 64))
+		}
+		if prev != nil && prev.Bounds() == im.Bounds() {
+			copy(im.Pix, prev.Pix)
+		}
+		for j := 0; j < 8; j++ {
+			im.SetGray16(3*i+j, 2*i, color.Gray16{uint16(0x1234 * (i + 1))})
+		}
+		var previm image.Image
+		if prev != nil {
+			previm = prev
+		}
+		frames = append(frames, &frame{
+			seq:   uint64(i + 1),
+			time:  time.Unix(1000, 0).Add(time.Duration(i) * 2 * time.Second),
+			im:    im,
+			dirty: diff.Changed(previm, im, diff.TileSize),
+		})
+		prev = im
+	}
+	return frames
+}
+
+// recordKeys are the indices of the keyframes of recordFrames: the first
+// frame, the first one recordKeyframeInterval later, the one changing the
+// resolution and the first one recordKeyframeInterval after that.
+var recordKeys = map[int]bool{0: true, 5: true, 8: true, 13: true}
+
+// writeRecording writes a recording of frames into a temporary file and
+// returns its content and the offset of the end of every record.
+func writeRecording(t *testing.T, frames []*frame) (b []byte, ends []int) {
+	t.Helper()
+	var buf bytes.Buffer
+	fh := recordFileHeader{Version: recordVersion}
+	copy(fh.Magic[:], recordMagic)
+	binary.Write(&buf, binary.BigEndian, &fh)
+	rw := &recordWriter{w: &buf}
+	for i, f := range frames {
+		if err := rw.writeFrame(f); err != nil {
+			t.Fatalf("frame %d: writeFrame() = %v", i, err)
+		}
+		ends = append(ends, buf.Len())
+	}
+	return buf.Bytes(), ends
+}
+
+// tempFile writes b to a new file and returns its name.
+func tempFile(t *testing.T, b []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "rec")
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestRecordKeyframes(t *testing.T) {
+	rw := &recordWriter{w: new(bytes.Buffer)}
+	for i, f := range recordFrames() {
+		key, data, err := rw.encodeFrame(f)
+		if err != nil {
+			t.Fatalf("frame %d: encodeFrame() = %v", i, err)
+		}
+		if key != recordKeys[i] {
+			t.Errorf("frame %d: encodeFrame() returns keyframe %v, want %v", i, key, recordKeys[i])
+		}
+		if len(data) == 0 {
+			t.Errorf("frame %d: encodeFrame() returns no data", i)
+		}
+		if rw.prev != f {
+			t.Errorf("frame %d: encodeFrame() doesn't keep the frame", i)
+		}
+	}
+	rw.reset()
+	f := recordFrames()[1]
+	if key, _, _ := rw.encodeFrame(f); !key {
+		t.Error("encodeFrame() after reset() doesn't write a keyframe")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	frames := recordFrames()
+	b, ends := writeRecording(t, frames)
+	name := tempFile(t, b)
+
+	var i int
+	err := readRecording(name, func(f *frame) error {
+		if i >= len(frames) {
+			t.Fatalf("readRecording() returns more than %d frames", len(frames))
+		}
+		if !f.time.Equal(frames[i].time) {
+			t.Errorf("frame %d has time %v, want %v", i, f.time, frames[i].time)
+		}
+		if err := sameFrame(f.im, frames[i].im); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readRecording() = %v", err)
+	}
+	if i != len(frames) {
+		t.Errorf("readRecording() returns %d frames, want %d", i, len(frames))
+	}
+
+	tcs := []struct {
+		offset time.Duration
+		want   int
+	}{
+		{0, 0},
+		{time.Second, 0},
+		{2 * time.Second, 1},
+		{11 * time.Second, 5},
+		{15 * time.Second, 7},
+		{17 * time.Second, 8},
+		{25 * time.Second, 12},
+		{time.Hour, 13},
+	}
+	for _, tc := range tcs {
+		s, err := replaySource{name: name, speed: 1e9, offset: tc.offset}.open()
+		if err != nil {
+			t.Fatalf("open() at %v = %v", tc.offset, err)
+		}
+		// Play the rest of the recording from the offset.
+		var im image.Image
+		for i := tc.want; i < len(frames); i++ {
+			if im, err = s.readImage(im); err != nil {
+				t.Fatalf("offset %v: frame %d: readImage() = %v", tc.offset, i, err)
+			}
+			if err := sameFrame(im, frames[i].im); err != nil {
+				t.Errorf("offset %v: frame %d: %v", tc.offset, i, err)
+			}
+		}
+		if s.polled() {
+			t.Errorf("offset %v: polled() before the end of the recording", tc.offset)
+		}
+		// At the end, the last frame is shown.
+		if im, err = s.readImage(im); err != nil {
+			t.Fatalf("offset %v: readImage() at the end = %v", tc.offset, err)
+		}
+		if err := sameFrame(im, frames[len(frames)-1].im); err != nil {
+			t.Errorf("offset %v: last frame: %v", tc.offset, err)
+		}
+		if !s.polled() {
+			t.Errorf("offset %v: !polled() at the end of the recording", tc.offset)
+		}
+		s.close()
+	}
+
+	// A recording interrupted while writing the last record ends with the
+	// previous frame.
+	last := len(frames) - 1
+	hdr := binary.Size(recordHeader{})
+	for _, n := range []int{ends[last-1] + 1, ends[last-1] + hdr, ends[last-1] + hdr + 10, ends[last] - 10, ends[last] - 1} {
+		name := tempFile(t, b[:n])
+		var got int
+		if err := readRecording(name, func(*frame) error { got++; return nil }); err != nil {
+			t.Errorf("truncated to %d bytes: readRecording() = %v", n, err)
+		}
+		if got != last {
+			t.Errorf("truncated to %d bytes: readRecording() returns %d frames, want %d", n, got, last)
+		}
+		s, err := replaySource{name: name, speed: 1e9, offset: time.Hour}.open()
+		if err != nil {
+			t.Fatalf("truncated to %d bytes: open() = %v", n, err)
+		}
+		for i := 0; i < 2; i++ {
+			im, err := s.readImage(nil)
+			if err != nil {
+				t.Fatalf("truncated to %d bytes: readImage() = %v", n, err)
+			}
+			if err := sameFrame(im, frames[last-1].im); err != nil {
+				t.Errorf("truncated to %d bytes: %v", n, err)
+			}
+		}
+		s.close()
+	}
+}
+
+func TestReplayClose(t *testing.T) {
+	b, _ := writeRecording(t, recordFrames())
+	// At this speed, the second frame is due in a day.
+	s, err := replaySource{name: tempFile(t, b), speed: 1.0 / 43200}.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.readImage(nil); err != nil {
+		t.Fatalf("readImage() = %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.readImage(nil)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("readImage() after close() succeeds")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close() doesn't interrupt readImage()")
+	}
+	if err := s.close(); err == nil {
+		t.Error("second close() succeeds")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+
+	"github.com/Merovius/srvfb/internal/diff"
+	"github.com/Merovius/srvfb/internal/fb"
+)
+
+// snapshotMode is how frames are copied from the framebuffer memory, which
+// the driver may write to while we copy it.
+type snapshotMode int
+
+const (
+	// snapshotCopy copies the framebuffer once.
+	snapshotCopy snapshotMode = iota
+	// snapshotStable copies the framebuffer twice. If the copies differ,
+	// the changed tiles are copied again, until they are equal to the
+	// previous copy or snapshotRetries is exceeded.
+	snapshotStable
+	// snapshotVSync waits for the vertical blank before copying the
+	// framebuffer once. If the driver doesn't support that, it falls back to
+	// snapshotStable.
+	snapshotVSync
+)
+
+// snapshotRetries is the maximum number of times snapshotStable copies the
+// changed tiles again.
+const snapshotRetries = 4
+
+// snapshotStats are published via expvar, under /debug/vars.
+//
+//	total:    number of snapshots taken
+//	torn:     number of snapshots during which the framebuffer changed
+//	retries:  number of times changed tiles were copied again
+//	unstable: number of snapshots that were still changing after all retries
+//	vsync:    number of snapshots taken after waiting for the vertical blank
+//	mode:     the configured snapshot mode
+//	fallback: the mode used instead, if the configured one is unsupported
+var snapshotStats = expvar.NewMap("snapshots")
+
+// snapshotModeStat and snapshotFallbackStat are published as mode and fallback
+// in snapshotStats.
+var (
+	snapshotModeStat     = new(expvar.String)
+	snapshotFallbackStat = new(expvar.String)
+)
+
+func init() {
+	snapshotStats.Set("mode", snapshotModeStat)
+	snapshotStats.Set("fallback", snapshotFallbackStat)
+}
+
+// noVSyncOnce logs the fallback from snapshotVSync only for the first stream
+// noticing it.
+var noVSyncOnce sync.Once
+
+func parseSnapshotMode(s string) (snapshotMode, error) {
+	switch s {
+	case "copy":
+		return snapshotCopy, nil
+	case "stable":
+		return snapshotStable, nil
+	case "vsync":
+		return snapshotVSync, nil
+	default:
+		return 0, fmt.Errorf("invalid snapshot mode %q, want copy, stable or vsync", s)
+	}
+}
+
+// snapshot copies p into dst according to s.mode and returns the copy, which
+// may be a different image than dst.
+func (s *fbSource) snapshot(p *fb.Packed, dst image.Image) (image.Image, error) {
+	snapshotStats.Add("total", 1)
+	if s.mode == snapshotVSync && !s.noVSync {
+		switch err := s.fb.WaitForVSync(); err {
+		case nil:
+			snapshotStats.Add("vsync", 1)
+			return p.Copy(dst), nil
+		case fb.ErrNoVSync:
+			noVSyncOnce.Do(func() {
+				log.Println("Framebuffer can't wait for vsync, copying until stable instead")
+				snapshotFallbackStat.Set("stable")
+			})
+			s.noVSync = true
+		default:
+			return nil, err
+		}
+	}
+	if s.mode == snapshotCopy {
+		return p.Copy(dst), nil
+	}
+
+	dst = p.Copy(dst)
+	s.check = p.Copy(s.check)
+	changed := diff.Changed(dst, s.check, diff.TileSize)
+	if changed == nil {
+		return dst, nil
+	}
+	snapshotStats.Add("torn", 1)
+	for i := 0; i < snapshotRetries; i++ {
+		// Keep the newest copy. Both copies only differ in the changed
+		// tiles, so only they have to be copied and compared again.
+		dst, s.check = s.check, dst
+		snapshotStats.Add("retries", 1)
+		for _, r := range changed {
+			s.copyRect(p, r)
+		}
+		if changed = changedIn(dst, s.check, changed); changed == nil {
+			return dst, nil
+		}
+	}
+	snapshotStats.Add("unstable", 1)
+	dst, s.check = s.check, dst
+	return dst, nil
+}
+
+// copyRect copies the region r of p, in the coordinates of the copy, into
+// s.check.
+func (s *fbSource) copyRect(p *fb.Packed, r image.Rectangle) {
+	s.tile = p.SubImage(r.Add(p.Rect.Min)).Copy(s.tile)
+	dpix, dstride, bpp := pixels(s.check)
+	spix, sstride, _ := pixels(s.tile)
+	n := r.Dx() * bpp / 8
+	for y := 0; y < r.Dy(); y++ {
+		i := (r.Min.Y+y)*dstride + r.Min.X*bpp/8
+		copy(dpix[i:i+n], spix[y*sstride:y*sstride+n])
+	}
+}
+
+// changedIn is like diff.Changed, but only compares the regions rects of a and
+// b.
+func changedIn(a, b image.Image, rects []image.Rectangle) []image.Rectangle {
+	type subImager interface {
+		SubImage(image.Rectangle) image.Image
+	}
+	var changed []image.Rectangle
+	for _, r := range rects {
+		sa, sb := a.(subImager).SubImage(r), b.(subImager).SubImage(r)
+		changed = append(changed, diff.Changed(sa, sb, diff.TileSize)...)
+	}
+	return changed
+}
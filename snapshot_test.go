@@ -0,0 +1,162 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/diff"
+	"github.com/Merovius/srvfb/internal/fb"
+)
+
+// stat returns the value of the counter name in snapshotStats.
+func stat(name string) int64 {
+	if v, ok := snapshotStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// grayInfo describes a fake w×h device with 8-bit gray pixels.
+func grayInfo(w, h int) string {
+	return fmt.Sprintf(`{
+		"Fix": {"Id": "fake"},
+		"Var": {"Xres": %d, "Yres": %d, "Bits_per_pixel": 8, "Grayscale": 1}
+	}`, w, h)
+}
+
+// uniform returns whether all pixels of im are v.
+func uniform(im image.Image, v uint8) bool {
+	g, ok := im.(*image.Gray)
+	return ok && len(bytes.Trim(g.Pix, string([]byte{v}))) == 0
+}
+
+func TestSnapshotVSyncFallback(t *testing.T) {
+	d := openFake(t, grayInfo(4, 4), bytes.Repeat([]byte{7}, 16))
+	s := &fbSource{fb: d, mode: snapshotVSync}
+	vsync := stat("vsync")
+	for i := 0; i < 2; i++ {
+		im, err := s.readImage(nil)
+		if err != nil {
+			t.Fatalf("readImage() = %v", err)
+		}
+		if !uniform(im, 7) {
+			t.Errorf("readImage() = %v, want all 7", im)
+		}
+	}
+	// The fake device can't wait for vsync.
+	if s.mode != snapshotVSync || !s.noVSync {
+		t.Errorf("after fallback mode = %v, noVSync = %v, want %v, true", s.mode, s.noVSync, snapshotVSync)
+	}
+	if got := snapshotFallbackStat.Value(); got != "stable" {
+		t.Errorf("fallback stat = %q, want %q", got, "stable")
+	}
+	if got := stat("vsync"); got != vsync {
+		t.Errorf("vsync stat = %d, want %d", got, vsync)
+	}
+}
+
+func TestSnapshotStable(t *testing.T) {
+	// The frame has to be large, for the writer to run while it is copied,
+	// even with a single CPU.
+	const w, h = 4096, 4096
+	dir := t.TempDir()
+	if err := fb.WriteFake(dir, grayInfo(w, h), make([]byte, w*h)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := fb.OpenFake(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	// The pixels are mapped into memory, so they are written in place, as
+	// by a driver.
+	f, err := os.OpenFile(filepath.Join(dir, "pixels"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The writer redraws the whole screen with the next value, then pauses
+	// for a moment, so snapshots can become stable.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		frames := [][]byte{bytes.Repeat([]byte{1}, w*h), bytes.Repeat([]byte{2}, w*h)}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := f.WriteAt(frames[i%2], 0); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	s := &fbSource{fb: d, mode: snapshotStable}
+	torn, retries, unstable := stat("torn"), stat("retries"), stat("unstable")
+	var im image.Image
+	for deadline := time.Now().Add(10 * time.Second); stat("torn") == torn && time.Now().Before(deadline); {
+		u := stat("unstable")
+		if im, err = s.readImage(im); err != nil {
+			t.Fatalf("readImage() = %v", err)
+		}
+		// Unless the retries were exceeded, the returned copy agrees
+		// with the last copy of every tile.
+		if stat("unstable") == u {
+			if changed := diff.Changed(im, s.check, diff.TileSize); changed != nil {
+				t.Fatalf("readImage() returned a copy differing from the check copy in %v", changed)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if stat("torn") == torn {
+		t.Skip("the writer never overlapped a snapshot")
+	}
+	if stat("retries") == retries {
+		t.Errorf("torn snapshot wasn't retried")
+	}
+	t.Logf("%d torn, %d retries, %d unstable", stat("torn")-torn, stat("retries")-retries, stat("unstable")-unstable)
+
+	// Once the screen doesn't change anymore, the snapshot is exact.
+	if _, err := f.WriteAt(bytes.Repeat([]byte{3}, w*h), 0); err != nil {
+		t.Fatal(err)
+	}
+	torn = stat("torn")
+	if im, err = s.readImage(im); err != nil {
+		t.Fatalf("readImage() = %v", err)
+	}
+	if !uniform(im, 3) {
+		t.Errorf("readImage() of the unchanged screen isn't all 3")
+	}
+	if stat("torn") != torn {
+		t.Errorf("readImage() of the unchanged screen was torn")
+	}
+}
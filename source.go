@@ -0,0 +1,241 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+
+	"github.com/Merovius/srvfb/internal/fb"
+)
+
+// A source provides the frames served by all endpoints.
+type source interface {
+	// open starts a new stream of frames.
+	open() (stream, error)
+}
+
+// A stream is a sequence of frames read from a source.
+type stream interface {
+	// readImage reads the next frame into im, which must be nil or an image
+	// previously returned by readImage. The returned image is an
+	// *image.Gray, *image.Gray16, *image.Paletted or *image.RGBA with its
+	// origin at (0, 0).
+	readImage(im image.Image) (image.Image, error)
+	// polled returns whether readImage returns immediately and has to be
+	// polled for changes. Otherwise, it blocks until a new frame is
+	// available.
+	polled() bool
+	// close releases the stream. When the last subscriber of a capture
+	// leaves, it calls close from its own goroutine, while the capture loop
+	// may be blocked in readImage, to unblock streams, which aren't polled.
+	// readImage must then return (usually with an error) without using what
+	// close released.
+	// Closing a connection or file concurrently is safe; fbSource and
+	// patternSource only get away with it because their close does nothing.
+	close() error
+}
+
+// fbSource reads frames from a framebuffer device. All its streams share the
+// device.
+type fbSource struct {
+	fb *fb.Device
+	// rotate is set, if frames should be rotated by the rotation reported
+	// by the driver.
+	rotate bool
+	// buf holds the unrotated frame, if rotate is set.
+	buf image.Image
+	// mode is how the framebuffer memory is copied. noVSync is set, if
+	// mode is snapshotVSync, but the driver doesn't support it, so
+	// snapshotStable is used instead.
+	mode    snapshotMode
+	noVSync bool
+	// check is the buffer for additional copies made by snapshot and tile
+	// the buffer for re-copied tiles.
+	check image.Image
+	tile  image.Image
+}
+
+func (s fbSource) open() (stream, error) {
+	return &s, nil
+}
+
+func (s *fbSource) readImage(im image.Image) (image.Image, error) {
+	p, err := s.fb.Image()
+	if err != nil {
+		return nil, err
+	}
+	if !s.rotate {
+		return s.snapshot(p, im)
+	}
+	deg, err := s.fb.Rotation()
+	if err != nil {
+		return nil, err
+	}
+	if deg == 0 {
+		return s.snapshot(p, im)
+	}
+	if s.buf, err = s.snapshot(p, s.buf); err != nil {
+		return nil, err
+	}
+	return transform{rotate: deg}.apply(im, s.buf, nil), nil
+}
+
+func (s fbSource) polled() bool {
+	return true
+}
+
+// close does nothing, as the device is shared by all streams. This keeps it
+// safe to call while readImage copies the framebuffer.
+func (s fbSource) close() error {
+	return nil
+}
+
+// proxySource reads frames from the raw stream of an upstream srvfb. Every
+// stream opens a new connection.
+type proxySource struct {
+	addr     string
+	compress bool
+}
+
+func (s proxySource) open() (stream, error) {
+	return dialProxy(s.addr, s.compress)
+}
+
+// patternSource generates a synthetic test pattern: A vertical gradient with a
+// bar sweeping across it every ten seconds.
+type patternSource struct {
+	rect image.Rectangle
+}
+
+func newPatternSource(size string) (patternSource, error) {
+	var w, h int
+	if _, err := fmt.Sscanf(size, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return patternSource{}, fmt.Errorf("invalid size %q, want <width>x<height>", size)
+	}
+	return patternSource{image.Rect(0, 0, w, h)}, nil
+}
+
+func (s patternSource) open() (stream, error) {
+	return s, nil
+}
+
+func (s patternSource) readImage(im image.Image) (image.Image, error) {
+	const period = 10 * time.Second
+
+	g, ok := im.(*image.Gray16)
+	if !ok || g.Rect != s.rect {
+		g = image.NewGray16(s.rect)
+	}
+	w, h := s.rect.Dx(), s.rect.Dy()
+	bw := w/50 + 1
+	bx := int(time.Now().UnixNano() % int64(period) * int64(w) / int64(period))
+	for y := 0; y < h; y++ {
+		v := uint16(y * 0xffff / h)
+		row := g.Pix[y*g.Stride : y*g.Stride+2*w]
+		for x := 0; x < w; x++ {
+			if x >= bx && x < bx+bw {
+				row[2*x], row[2*x+1] = 0, 0
+			} else {
+				row[2*x], row[2*x+1] = uint8(v>>8), uint8(v)
+			}
+		}
+	}
+	return g, nil
+}
+
+func (s patternSource) polled() bool {
+	return true
+}
+
+func (s patternSource) close() error {
+	return nil
+}
+
+// pixels returns the pixel data of an image returned by readImage, together
+// with its stride and bits per pixel.
+func pixels(im image.Image) (pix []byte, stride, bpp int) {
+	switch im := im.(type) {
+	case *image.Gray:
+		return im.Pix[:im.Rect.Dy()*im.Stride], im.Stride, 8
+	case *image.Paletted:
+		return im.Pix[:im.Rect.Dy()*im.Stride], im.Stride, 8
+	case *image.Gray16:
+		return im.Pix[:im.Rect.Dy()*im.Stride], im.Stride, 16
+	case *image.RGBA:
+		return im.Pix[:im.Rect.Dy()*im.Stride], im.Stride, 32
+	default:
+		panic(fmt.Errorf("unsupported image type %T", im))
+	}
+}
+
+// newImage returns a new image of the type used for frames with the given bits
+// per pixel. For 8 bits per pixel, a non-nil palette results in a paletted
+// image.
+func newImage(r image.Rectangle, bpp int, pal color.Palette) (image.Image, error) {
+	switch {
+	case bpp == 8 && pal != nil:
+		return image.NewPaletted(r, pal), nil
+	case bpp == 8:
+		return image.NewGray(r), nil
+	case bpp == 16:
+		return image.NewGray16(r), nil
+	case bpp == 32:
+		return image.NewRGBA(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported bits per pixel %d", bpp)
+	}
+}
+
+// sameFormat returns whether im is of the type newImage would return for bpp
+// and pal.
+func sameFormat(im image.Image, bpp int, pal color.Palette) bool {
+	switch im.(type) {
+	case *image.Paletted:
+		return bpp == 8 && pal != nil
+	case *image.Gray:
+		return bpp == 8 && pal == nil
+	case *image.Gray16:
+		return bpp == 16
+	case *image.RGBA:
+		return bpp == 32
+	default:
+		return false
+	}
+}
+
+// copyImage copies src, which must be a frame image, into dst, reusing its
+// buffer if it has the same type and bounds.
+func copyImage(dst, src image.Image) image.Image {
+	var pal color.Palette
+	if p, ok := src.(*image.Paletted); ok {
+		pal = p.Palette
+	}
+	_, _, bpp := pixels(src)
+	if dst == nil || dst.Bounds() != src.Bounds() || !sameFormat(dst, bpp, pal) {
+		dst, _ = newImage(src.Bounds(), bpp, pal)
+	} else if p, ok := dst.(*image.Paletted); ok {
+		p.Palette = pal
+	}
+	dpix, dstride, _ := pixels(dst)
+	spix, sstride, _ := pixels(src)
+	n := src.Bounds().Dx() * bpp / 8
+	for y := 0; y < src.Bounds().Dy(); y++ {
+		copy(dpix[y*dstride:y*dstride+n], spix[y*sstride:y*sstride+n])
+	}
+	return dst
+}
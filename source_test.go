@@ -0,0 +1,88 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"testing"
+
+	"github.com/Merovius/srvfb/internal/fb"
+)
+
+// openFake creates a fake device with the given description and pixels.
+func openFake(t *testing.T, info string, pix []byte) *fb.Device {
+	t.Helper()
+	dir := t.TempDir()
+	if err := fb.WriteFake(dir, info, pix); err != nil {
+		t.Fatal(err)
+	}
+	d, err := fb.OpenFake(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestFBSourceRotate(t *testing.T) {
+	const w, h = 3, 2
+	pix := make([]byte, w*h)
+	for i := range pix {
+		pix[i] = uint8(i + 1)
+	}
+	src := image.NewGray(image.Rect(0, 0, w, h))
+	copy(src.Pix, pix)
+
+	for _, rotate := range []int{0, 1, 2, 3} {
+		d := openFake(t, fmt.Sprintf(`{
+			"Fix": {"Id": "fake"},
+			"Var": {"Xres": %d, "Yres": %d, "Bits_per_pixel": 8, "Grayscale": 1, "Rotate": %d}
+		}`, w, h, rotate), pix)
+
+		// The image is rotated clockwise by the reported rotation.
+		want := src
+		for i := 0; i < rotate; i++ {
+			want = rotateCW(want)
+		}
+		for _, enabled := range []bool{false, true} {
+			s := &fbSource{fb: d, rotate: enabled}
+			im, err := s.readImage(nil)
+			if err != nil {
+				t.Fatalf("readImage() = %v", err)
+			}
+			want := want
+			if !enabled {
+				want = src
+			}
+			g, ok := im.(*image.Gray)
+			if !ok || g.Rect != want.Rect || string(g.Pix) != string(want.Pix) {
+				t.Errorf("readImage() with Rotate %d and -fb-rotate=%v = %v, want %v", rotate, enabled, im, want)
+			}
+		}
+	}
+}
+
+// rotateCW returns m rotated clockwise by 90°.
+func rotateCW(m *image.Gray) *image.Gray {
+	b := m.Bounds()
+	r := image.NewGray(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r.SetGray(b.Dy()-1-y, x, m.GrayAt(x, y))
+		}
+	}
+	return r
+}
@@ -16,25 +16,22 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"image"
+	"image/jpeg"
 	"io"
 	"log"
-	"mime"
-	"mime/multipart"
 	"net"
 	"net/http"
-	"net/textproto"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/Merovius/srvfb/internal/fb"
@@ -44,7 +41,16 @@ import (
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "pdf":
+		err = runPDF(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "gif":
+		err = runGIF(os.Args[2:])
+	default:
+		err = run()
+	}
+	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
@@ -52,16 +58,40 @@ func main() {
 
 func run() error {
 	listen := flag.String("listen", "", "Address to listen on")
-	proxy := flag.String("proxy", "", "Proxy the screen from the given address")
-	device := flag.String("device", "", "Framebuffer device to serve")
+	proxy := flag.String("proxy", "", "Proxy the screen from the given address. Use vnc://[:password@]host[:port] to proxy a VNC server")
+	proxyPasswordFile := flag.String("proxy-password-file", "", "Read the password of the VNC server proxied with -proxy vnc://host from this file, instead of passing it in the URL, where other users can see it")
+	compress := flag.Bool("compress", true, "Request a compressed stream in proxy mode")
+	device := flag.String("device", "", "Framebuffer device to serve. Use fake:<dir> to serve a fake device described by the files in <dir>")
+	fbRotate := flag.Bool("fb-rotate", false, "Rotate the framebuffer as reported by its driver")
+	snapshot := flag.String("snapshot", "copy", "How to copy the framebuffer, which may change while copying: copy (once), stable (until two copies are equal) or vsync (after waiting for the vertical blank)")
+	pattern := flag.String("pattern", "", "Serve a synthetic test pattern of the given size (e.g. 1404x1872)")
+	replay := flag.String("replay", "", "Serve a recording made with -record")
+	replaySpeed := flag.Float64("replay-speed", 1, "Factor to speed up the playback of -replay by")
+	replayStart := flag.Duration("replay-start", 0, "Offset into the recording to start the playback of -replay at")
+	recordFile := flag.String("record", "", "Record the screen into the given file, which must not exist yet")
+	archivePages := flag.Bool("archive", false, "Archive the last frame of every page, when a page turn is detected, and list them under /archive")
+	archiveDir := flag.String("archive-dir", "", "Store archived pages as PNG files in this directory instead of in memory. Implies -archive")
+	archiveMax := flag.Int("archive-max", 100, "Maximum number of pages archived in memory, without -archive-dir. The oldest pages are dropped")
+	historySize := flag.Int("history", 0, "Keep up to this many megabytes of recent, compressed frames in memory and serve them under /history. 0 disables this")
+	pageTurn := flag.Float64("page-turn", 0.5, "Fraction of the screen, which has to change at once to detect a page turn")
+	maxFPS := flag.Float64("max-fps", 20, "Maximum number of frames per second to capture. 0 disables the limit")
+	maxPoll := flag.Duration("max-poll", time.Second, "Maximum interval to poll the framebuffer at, while its content doesn't change")
+	pngStripes := flag.Int("png-stripes", runtime.NumCPU(), "Number of stripes of each PNG, which are compressed concurrently")
+	vnc := flag.String("vnc", "", "Address to serve the screen read-only to VNC clients on")
 	idle := flag.Duration("idle", 0, "Exit if there's no activity for this time. 0 disables this")
 	flag.Parse()
 	if flag.NArg() != 0 {
-		return errors.New("usage: srvfb [<flags>]")
+		return errors.New("usage: srvfb [<flags>], srvfb pdf [<flags>] <output> <input>... or srvfb gif [<flags>] <output> <recording>")
 	}
 
-	if (*proxy == "") == (*device == "") {
-		return errors.New("exactly one of -proxy or -device is required")
+	if n := countSet(*proxy, *device, *pattern, *replay); n != 1 {
+		return errors.New("exactly one of -proxy, -device, -pattern or -replay is required")
+	}
+	if *proxyPasswordFile != "" && !strings.HasPrefix(*proxy, "vnc://") {
+		return errors.New("-proxy-password-file requires -proxy vnc://...")
+	}
+	if *replaySpeed <= 0 || *replayStart < 0 {
+		return errors.New("-replay-speed must be positive and -replay-start not negative")
 	}
 	if len(listenFDs) > 1 {
 		return errors.New("more than one file descriptor passed by service manager")
@@ -84,28 +114,129 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	l = wrapListener(l, *idle)
-
-	h := new(handler)
+	// VNC connections count as activity as well.
+	it := newIdleTracker(*idle)
+	l = wrapListener(l, it)
+	var vl net.Listener
+	if *vnc != "" {
+		if vl, err = net.Listen("tcp", *vnc); err != nil {
+			return err
+		}
+		vl = wrapListener(vl, it)
+	}
 
-	if *device != "" {
-		h.fb, err = fb.Open(*device)
+	mode, err := parseSnapshotMode(*snapshot)
+	if err != nil {
+		return err
+	}
+	snapshotModeStat.Set(*snapshot)
+
+	var src source
+	switch {
+	case strings.HasPrefix(*device, "fake:"):
+		var d *fb.Device
+		d, err = fb.OpenFake(strings.TrimPrefix(*device, "fake:"))
+		src = fbSource{fb: d, rotate: *fbRotate, mode: mode}
+	case *device != "":
+		var d *fb.Device
+		d, err = fb.Open(*device)
+		src = fbSource{fb: d, rotate: *fbRotate, mode: mode}
+	case strings.HasPrefix(*proxy, "vnc://"):
+		src, err = newVNCSource(*proxy, *proxyPasswordFile)
+	case *proxy != "":
+		src = proxySource{*proxy, *compress}
+	case *pattern != "":
+		src, err = newPatternSource(*pattern)
+	case *replay != "":
+		src = replaySource{*replay, *replaySpeed, *replayStart}
 	}
 	if err != nil {
 		return err
 	}
-	h.proxy = *proxy
+	h := &handler{capture: newCapture(src, interval(*maxFPS), *maxPoll), stripes: *pngStripes}
 	http.Handle("/", h)
-	if err = http.Serve(l, nil); err == errIdle {
+	errc := make(chan error, 3)
+	if *archivePages || *archiveDir != "" {
+		if *pageTurn <= 0 || *pageTurn > 1 {
+			return errors.New("-page-turn must be between 0 and 1")
+		}
+		if *archiveMax <= 0 {
+			return errors.New("-archive-max must be positive")
+		}
+		if *archiveDir != "" {
+			if err = os.MkdirAll(*archiveDir, 0755); err != nil {
+				return err
+			}
+		}
+		h.archive = &archive{dir: *archiveDir, max: *archiveMax, pageTurn: *pageTurn, enc: h.pngEncoder(png.DefaultCompression)}
+		go h.archive.run(h.capture)
+	}
+	if *historySize < 0 {
+		return errors.New("-history must not be negative")
+	}
+	if *historySize > 0 {
+		h.history = &history{max: *historySize << 20}
+		go h.history.run(h.capture)
+	}
+	if *recordFile != "" {
+		go func() { errc <- record(h.capture, *recordFile) }()
+	}
+	if vl != nil {
+		go func() { errc <- h.serveVNC(vl) }()
+	}
+	go func() { errc <- http.Serve(l, nil) }()
+	if err = <-errc; err == errIdle {
 		log.Printf("No activity for %v, shutting down", *idle)
 		err = nil
 	}
 	return err
 }
 
+// countSet returns the number of non-empty strings in s.
+func countSet(s ...string) int {
+	var n int
+	for _, s := range s {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
 type handler struct {
-	fb    *fb.Device
-	proxy string
+	capture *capture
+	// stripes is the number of stripes of encoded PNGs.
+	stripes int
+	// pngBuffers is shared by the PNG encoders of all requests.
+	pngBuffers pngPool
+	// archive is nil, if pages aren't archived.
+	archive *archive
+	// history is nil, if no history is kept.
+	history *history
+}
+
+// pngEncoder returns a PNG encoder with the given compression level.
+func (h *handler) pngEncoder(level png.CompressionLevel) *png.Encoder {
+	return &png.Encoder{
+		CompressionLevel: level,
+		BufferPool:       &h.pngBuffers,
+		Stripes:          h.stripes,
+	}
+}
+
+// pngPool is a png.EncoderBufferPool, so that encoding a frame doesn't
+// allocate.
+type pngPool struct {
+	p sync.Pool
+}
+
+func (p *pngPool) Get() *png.EncoderBuffer {
+	b, _ := p.p.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *pngPool) Put(b *png.EncoderBuffer) {
+	p.p.Put(b)
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -120,177 +251,225 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/video":
 		h.serveVideo(w, r)
 	case "/raw":
-		if h.fb == nil {
-			http.Error(w, "Not serving raw streams in proxy mode", http.StatusNotImplemented)
-			return
-		}
 		h.serveRaw(w, r)
 	case "/download":
 		h.serveImage(w, r)
+	case "/ws":
+		h.serveWebSocket(w, r)
+	case "/apng":
+		h.serveAPNG(w, r)
+	case "/pdf":
+		h.servePDF(w, r)
+	case "/gif":
+		h.serveGIF(w, r)
+	case "/canvas":
+		h.serveCanvas(w, r)
 	default:
+		if r.URL.Path == "/archive" || strings.HasPrefix(r.URL.Path, "/archive/") {
+			h.serveArchive(w, r)
+			return
+		}
+		if r.URL.Path == "/history" || strings.HasPrefix(r.URL.Path, "/history/") {
+			h.serveHistory(w, r)
+			return
+		}
 		http.Error(w, fmt.Sprintf("%q not found", r.URL.Path), http.StatusNotFound)
 	}
 }
 
-const version = 1
+// parseFPS parses the optional fps query parameter of r, returning the
+// minimum interval between frames.
+func parseFPS(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("fps")
+	if s == "" {
+		return 0, nil
+	}
+	fps, err := strconv.ParseFloat(s, 64)
+	if err != nil || fps <= 0 {
+		return 0, fmt.Errorf("invalid fps %q", s)
+	}
+	return interval(fps), nil
+}
+
+// videoFormat returns the content type and the encoder for the frames of
+// /video, as requested by the format and quality parameters of r.
+func (h *handler) videoFormat(r *http.Request) (string, func(io.Writer, image.Image) error, error) {
+	q := r.URL.Query()
+	switch f := q.Get("format"); f {
+	case "", "png":
+		enc := h.pngEncoder(png.BestSpeed)
+		return "image/png", enc.Encode, nil
+	case "jpeg", "mjpeg":
+		o := &jpeg.Options{Quality: jpeg.DefaultQuality}
+		if s := q.Get("quality"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 100 {
+				return "", nil, fmt.Errorf("invalid quality %q, want 1-100", s)
+			}
+			o.Quality = n
+		}
+		var g *image.Gray
+		return "image/jpeg", func(w io.Writer, im image.Image) error {
+			// JPEG has no 16-bit gray levels and the encoder would
+			// convert them pixel by pixel.
+			if g16, ok := im.(*image.Gray16); ok {
+				g = toGray(g, g16)
+				im = g
+			}
+			return jpeg.Encode(w, im, o)
+		}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported format %q", f)
+	}
+}
 
-type rawHeader struct {
-	Version      uint8
-	BitsPerPixel uint8
-	Stride       uint16
-	Width        uint32
-	Height       uint32
+// toGray converts src to 8-bit gray levels, reusing dst if possible.
+func toGray(dst *image.Gray, src *image.Gray16) *image.Gray {
+	r := src.Rect
+	if dst == nil || dst.Rect != r {
+		dst = image.NewGray(r)
+	}
+	for y := 0; y < r.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+r.Dx()]
+		spix := src.Pix[y*src.Stride:]
+		for x := range row {
+			row[x] = spix[2*x]
+		}
+	}
+	return dst
 }
 
-func (h *handler) serveRaw(w http.ResponseWriter, r *http.Request) {
+// videoResendDelay is the time after which /video sends the last frame again,
+// if the screen didn't change.
+const videoResendDelay = 200 * time.Millisecond
+
+func (h *handler) serveVideo(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		log.Println("Not a Flusher")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Not a flusher")
+		http.Error(w, "Internal Server Error", 500)
 		return
 	}
 
-	im := new(image.Gray16)
-	if err := h.readImage(im); err != nil {
-		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	fps, err := parseFPS(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=endofsection")
-	w.WriteHeader(http.StatusOK)
-
-	mpw := multipart.NewWriter(w)
-	mpw.SetBoundary("endofsection")
-	hdr := make(textproto.MIMEHeader)
-	hdr.Add("Content-Type", "binary/octet-stream")
-
-	part, err := mpw.CreatePart(hdr)
+	typ, encode, err := h.videoFormat(r)
 	if err != nil {
-		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	rhdr := &rawHeader{version, 16, uint16(im.Stride), uint32(im.Rect.Dx()), uint32(im.Rect.Dy())}
-	if err = binary.Write(part, binary.BigEndian, rhdr); err != nil {
-		log.Println(err)
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	part, err = mpw.CreatePart(hdr)
+	sub := h.capture.subscribe(fps, t)
+	defer sub.close()
+	f, err := sub.next(r.Context())
 	if err != nil {
-		log.Println(err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
-	_, err = w.Write(im.Pix[im.Rect.Min.Y*im.Stride : im.Rect.Max.Y*im.Stride])
-	if err != nil {
-		log.Println(err)
+	defer func() { f.release() }()
+	if f.im.Bounds().Empty() {
+		http.Error(w, errCropOutside.Error(), http.StatusBadRequest)
 		return
 	}
-	flusher.Flush()
 
-	var dedup deduper
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=endofsection")
+	w.WriteHeader(http.StatusOK)
+
+	pw := &partWriter{w: w, typ: typ}
+	buf := new(bytes.Buffer)
 	for {
-		if err := h.readImage(im); err != nil {
+		buf.Reset()
+		if err := encode(buf, f.im); err != nil {
 			log.Println(err)
 			return
 		}
-		pix := im.Pix[im.Rect.Min.Y*im.Stride : im.Rect.Max.Y*im.Stride]
-		if dedup.skip(pix) {
-			continue
-		}
-		w, err := mpw.CreatePart(hdr)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		_, err = w.Write(pix)
-		if err != nil {
+		if err := pw.write(buf.Bytes()); err != nil {
 			log.Println(err)
 			return
 		}
 		flusher.Flush()
-	}
-}
-
-func (h *handler) serveVideo(w http.ResponseWriter, r *http.Request) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		log.Println("Not a flusher")
-		http.Error(w, "Internal Server Error", 500)
-		return
-	}
-
-	var reader interface {
-		readImage(im *image.Gray16) error
-	}
-
-	if h.proxy != "" {
-		c, err := dialProxy(h.proxy)
+		// For some reason, Chrome only seems to show a frame *after* the
+		// frame after has been sent (i.e. it lags behind one frame), so we
+		// send the last frame again, once the screen stops changing.
+		next, err := sub.nextTimeout(r.Context(), videoResendDelay)
+		if err == context.DeadlineExceeded {
+			if err := pw.write(buf.Bytes()); err != nil {
+				log.Println(err)
+				return
+			}
+			flusher.Flush()
+			next, err = sub.next(r.Context())
+		}
 		if err != nil {
-			log.Println(err)
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
 			return
 		}
-		defer c.close()
-		reader = c
-	} else {
-		reader = h
+		f.release()
+		f = next
 	}
+}
 
-	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=endofsection")
-	w.WriteHeader(http.StatusOK)
+// A partWriter writes the parts of a multipart/x-mixed-replace response with
+// the boundary "endofsection", like a multipart.Writer, but without
+// allocating for every part.
+type partWriter struct {
+	w io.Writer
+	// typ is the Content-Type of the parts.
+	typ string
+	// started is set once the first part was written.
+	started bool
+	hdr     []byte
+}
 
-	mpw := multipart.NewWriter(w)
-	mpw.SetBoundary("endofsection")
-	hdr := make(textproto.MIMEHeader)
-	hdr.Add("Content-Type", "image/png")
-	im := new(image.Gray16)
-	enc := &png.Encoder{CompressionLevel: png.BestSpeed}
-	var dedup deduper
-	for {
-		if err := reader.readImage(im); err != nil {
-			log.Println(err)
-			return
-		}
-		if dedup.skip(im.Pix) {
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
-		w, err := mpw.CreatePart(hdr)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		enc.Encode(w, im)
-		flusher.Flush()
+// write writes b as a part. Some consumers (e.g. ffmpeg) rely on the
+// Content-Length of parts.
+func (pw *partWriter) write(b []byte) error {
+	if pw.hdr == nil {
+		// Room for the longest header, so it never grows.
+		pw.hdr = make([]byte, 0, 96+len(pw.typ))
+	}
+	pw.hdr = pw.hdr[:0]
+	if pw.started {
+		pw.hdr = append(pw.hdr, "\r\n"...)
+	}
+	pw.started = true
+	pw.hdr = append(pw.hdr, "--endofsection\r\nContent-Length: "...)
+	pw.hdr = strconv.AppendInt(pw.hdr, int64(len(b)), 10)
+	pw.hdr = append(pw.hdr, "\r\nContent-Type: "...)
+	pw.hdr = append(pw.hdr, pw.typ...)
+	pw.hdr = append(pw.hdr, "\r\n\r\n"...)
+	if _, err := pw.w.Write(pw.hdr); err != nil {
+		return err
 	}
+	_, err := pw.w.Write(b)
+	return err
 }
 
 func (h *handler) serveImage(w http.ResponseWriter, r *http.Request) {
-	var reader interface {
-		readImage(im *image.Gray16) error
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	if h.proxy != "" {
-		c, err := dialProxy(h.proxy)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
-			return
-		}
-		defer c.close()
-		reader = c
-	} else {
-		reader = h
+	sub := h.capture.subscribe(0, t)
+	defer sub.close()
+	f, err := sub.next(r.Context())
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
 	}
-
-	im := new(image.Gray16)
-	if err := reader.readImage(im); err != nil {
-		log.Println(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if f.im.Bounds().Empty() {
+		http.Error(w, errCropOutside.Error(), http.StatusBadRequest)
 		return
 	}
 	w.Header().Set("Content-Type", "image/png")
-	png.Encode(w, im)
+	h.pngEncoder(png.DefaultCompression).Encode(w, f.im)
 }
 
 func (h *handler) serveIndex(w http.ResponseWriter, r *http.Request) {
@@ -316,6 +495,20 @@ func (h *handler) serveIndex(w http.ResponseWriter, r *http.Request) {
 				background-color: black;
 				transform: rotate(0deg);
 			}
+
+			#history {
+				position: fixed;
+				bottom: 1em;
+				left: 5%;
+				width: 90%;
+				display: none;
+				color: white;
+				text-shadow: 0 0 2px black;
+			}
+
+			#history input {
+				width: 100%;
+			}
 		</style>
 
 		<script>
@@ -325,6 +518,8 @@ func (h *handler) serveIndex(w http.ResponseWriter, r *http.Request) {
 				}
 				let rotate = 0;
 				let stream = document.querySelector('#stream')
+				// Pass parameters like rotate or scale on to the stream.
+				stream.style.backgroundImage = 'url("video' + location.search + '")';
 				let w = stream.width;
 				let h = stream.height;
 				let resize = function() {
@@ -355,191 +550,147 @@ func (h *handler) serveIndex(w http.ResponseWriter, r *http.Request) {
 					resize();
 				};
 				window.onresize = resize;
+
+				// With -history, the slider scrubs back through the recent
+				// frames. Its right end shows the live stream.
+				let history = document.querySelector('#history');
+				let slider = history.querySelector('input');
+				let when = history.querySelector('span');
+				let params = location.search ? '&' + location.search.substring(1) : '';
+				let live = function() {
+					return slider.value === slider.max;
+				};
+				slider.oninput = function() {
+					when.textContent = live() ? 'live' : new Date(Number(slider.value)).toLocaleTimeString();
+				};
+				slider.onchange = function() {
+					if (live()) {
+						stream.style.backgroundImage = 'url("video' + location.search + '")';
+					} else {
+						stream.style.backgroundImage = 'url("history?at=' + slider.value + params + '")';
+					}
+				};
+				let update = function() {
+					fetch('history').then(function(r) {
+						if (!r.ok) {
+							clearInterval(timer);
+							return [];
+						}
+						return r.json();
+					}).then(function(frames) {
+						if (frames.length === 0) {
+							return;
+						}
+						let wasLive = live();
+						slider.min = Date.parse(frames[0].time);
+						slider.max = Date.parse(frames[frames.length-1].time);
+						if (wasLive) {
+							slider.value = slider.max;
+						}
+						history.style.display = 'block';
+					});
+				};
+				let timer = setInterval(update, 5000);
+				update();
 			};
 		</script>
 	</head>
 	<body>
 		<div id="stream"></div>
+		<div id="history"><input type="range" min="0" max="1" value="1"> <span>live</span></div>
 	</body>
 </html>`
 	io.WriteString(w, idx)
 }
 
-func (h *handler) readImage(im *image.Gray16) error {
-	vim, err := h.fb.Image()
-	if err != nil {
-		return err
-	}
-	gim, ok := vim.(*image.Gray16)
-	if !ok {
-		return errors.New("framebuffer is not 16-bit grayscale")
-	}
-	if len(im.Pix) < len(gim.Pix) {
-		im.Pix = append(im.Pix, make([]byte, len(gim.Pix)-len(im.Pix))...)
-	}
-	copy(im.Pix, gim.Pix)
-	for i := 1; i < len(im.Pix); i += 2 {
-		im.Pix[i-1], im.Pix[i] = im.Pix[i], im.Pix[i-1]
-	}
-	im.Stride = gim.Stride
-	im.Rect = gim.Rect
-	return nil
-}
+var errIdle = errors.New("idle timeout")
 
-type proxyconn struct {
-	r      *multipart.Reader
-	closer io.Closer
-	stride int
-	width  int
-	height int
-}
+// An idleTracker tracks the active connections of one or more listeners. Once
+// they all are closed and the idle timeout expires, Accept of every listener
+// returns errIdle.
+type idleTracker struct {
+	timeout time.Duration
 
-func dialProxy(addr string) (*proxyconn, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/raw", addr))
-	if err != nil {
-		return nil, err
-	}
-	c := &proxyconn{closer: resp.Body}
-	if err = c.readHdr(resp); err != nil {
-		resp.Body.Close()
-		return nil, err
-	}
-	return c, nil
+	mu        sync.Mutex
+	active    int
+	idleSince time.Time
+	listeners []*net.TCPListener
 }
 
-func (c *proxyconn) readHdr(resp *http.Response) error {
-	mt, parms, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-	if err != nil {
-		return err
-	}
-	if mt != "multipart/x-mixed-replace" {
-		return fmt.Errorf("unknown media type %q", mt)
-	}
-	if parms["boundary"] == "" {
-		return fmt.Errorf("no boundary in media type %q", resp.Header.Get("Content-Type"))
-	}
-	c.r = multipart.NewReader(resp.Body, parms["boundary"])
-
-	part, err := c.r.NextPart()
-	if err != nil {
-		return err
-	}
-	defer part.Close()
-	if ct := part.Header.Get("Content-Type"); ct != "binary/octet-stream" {
-		return fmt.Errorf("unknown Content-Type %q for part", ct)
-	}
-
-	var hdr rawHeader
-	if err := binary.Read(part, binary.BigEndian, &hdr); err != nil {
-		return err
-	}
-	log.Printf("Got header: %#x", hdr)
-	if hdr.Version != version {
-		return fmt.Errorf("incompatible version %d", hdr.BitsPerPixel)
-	}
-	if hdr.BitsPerPixel != 16 {
-		return fmt.Errorf("incompatible bits per pixel %d", hdr.BitsPerPixel)
-	}
-	c.stride = int(hdr.Stride)
-	c.width = int(hdr.Width)
-	c.height = int(hdr.Height)
-	return nil
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	return &idleTracker{timeout: timeout, idleSince: time.Now()}
 }
 
-func (c *proxyconn) readImage(im *image.Gray16) error {
-	if len(im.Pix) != c.stride*c.height {
-		*im = image.Gray16{
-			Pix:    make([]byte, c.stride*c.height),
-			Stride: c.stride,
-			Rect:   image.Rect(0, 0, c.width, c.height),
-		}
+// add adds d to the number of active connections, updating the deadlines of
+// all listeners.
+func (t *idleTracker) add(d int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active += d
+	var deadline time.Time
+	if t.active == 0 {
+		t.idleSince = time.Now()
+		deadline = t.idleSince.Add(t.timeout)
 	}
-	part, err := c.r.NextPart()
-	if err != nil {
-		return err
-	}
-	defer part.Close()
-	if ct := part.Header.Get("Content-Type"); ct != "binary/octet-stream" {
-		return fmt.Errorf("unknown Content-Type %q for part", ct)
+	for _, l := range t.listeners {
+		l.SetDeadline(deadline)
 	}
-	_, err = io.ReadFull(part, im.Pix)
-	return err
-}
-
-func (c *proxyconn) close() {
-	c.closer.Close()
 }
 
-// deduper keeps state to deduplicate sent frames. For some reason, Chrome only
-// seems to show a frame *after* the frame after has been sent (i.e. it lags
-// behind one frame), so we only start skipping after two consecutive frames
-// are identical.
-type deduper struct {
-	h  hash.Hash32
-	h1 uint32
-	h2 uint32
+// expired returns whether the idle timeout expired.
+func (t *idleTracker) expired() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active == 0 && time.Since(t.idleSince) >= t.timeout
 }
 
-func (d *deduper) skip(b []byte) bool {
-	if d.h == nil {
-		d.h = fnv.New32a()
-	}
-	d.h.Reset()
-	d.h.Write(b)
-	h := d.h.Sum32()
-	if h == d.h1 && h == d.h2 {
-		return true
-	}
-	d.h1, d.h2 = d.h2, h
-	return false
-}
-
-var errIdle = errors.New("idle timeout")
-
-// wrapListener wraps l with an idle timeout, if possible. A zero timeout
+// wrapListener wraps l with the idle timeout of t, if possible. A zero timeout
 // disables timeouts. If setting a timeout fails, the returned Listener falls
 // back to the behavior of the wrapped Listener.
-func wrapListener(l net.Listener, timeout time.Duration) net.Listener {
+func wrapListener(l net.Listener, t *idleTracker) net.Listener {
 	tl, ok := l.(*net.TCPListener)
-	if !ok || timeout == 0 {
+	if !ok || t.timeout == 0 {
 		return l
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, tl)
+	if t.active == 0 {
+		tl.SetDeadline(t.idleSince.Add(t.timeout))
+	}
 	return &listener{
 		TCPListener: tl,
-		timeout:     timeout,
+		idle:        t,
 	}
 }
 
 type listener struct {
-	acceptMu sync.Mutex
-	active   uint32
 	*net.TCPListener
-	timeout time.Duration
+	idle *idleTracker
 }
 
 // Accept implements net.Conn. Connections returned by Accept are tracked. Once
-// all active connections are closed and the idle timeout expires, Accept
-// returns errIdle.
+// all active connections of the listeners sharing the idleTracker are closed
+// and the idle timeout expires, Accept returns errIdle.
 func (l *listener) Accept() (net.Conn, error) {
-	l.acceptMu.Lock()
-	defer l.acceptMu.Unlock()
-
-	if atomic.LoadUint32(&l.active) == 0 {
-		l.SetDeadline(time.Now().Add(l.timeout))
-	}
-	c, err := l.TCPListener.Accept()
-	if err == nil {
-		atomic.AddUint32(&l.active, 1)
-		l.SetDeadline(time.Time{})
-		return &conn{l: l, Conn: c}, nil
-	}
-	to, ok := err.(interface {
-		Timeout() bool
-	})
-	if !ok || !to.Timeout() {
-		return nil, err
+	for {
+		c, err := l.TCPListener.Accept()
+		if err == nil {
+			l.idle.add(1)
+			return &conn{l: l, Conn: c}, nil
+		}
+		to, ok := err.(interface {
+			Timeout() bool
+		})
+		if !ok || !to.Timeout() {
+			return nil, err
+		}
+		// The deadline might have been extended by a connection to
+		// another listener in the meantime.
+		if l.idle.expired() {
+			return nil, errIdle
+		}
 	}
-	return nil, errIdle
 }
 
 type conn struct {
@@ -549,11 +700,7 @@ type conn struct {
 }
 
 func (c *conn) Close() error {
-	c.o.Do(func() {
-		if atomic.AddUint32(&c.l.active, ^uint32(0)) == 0 {
-			c.l.SetDeadline(time.Now().Add(c.l.timeout))
-		}
-	})
+	c.o.Do(func() { c.l.idle.add(-1) })
 	return c.Conn.Close()
 }
 
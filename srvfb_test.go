@@ -0,0 +1,203 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stepSource is a source whose stream blocks until a value is sent on next
+// and returns a 64×64 frame filled with it.
+type stepSource struct {
+	next chan uint8
+}
+
+func (s stepSource) open() (stream, error) {
+	return &stepStream{next: s.next, closed: make(chan struct{})}, nil
+}
+
+type stepStream struct {
+	next   chan uint8
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *stepStream) readImage(im image.Image) (image.Image, error) {
+	var v uint8
+	select {
+	case v = <-s.next:
+	case <-s.closed:
+		return nil, errors.New("stream closed")
+	}
+	m, _ := im.(*image.Gray)
+	if m == nil {
+		m = image.NewGray(image.Rect(0, 0, 64, 64))
+	}
+	for i := range m.Pix {
+		m.Pix[i] = v
+	}
+	return m, nil
+}
+
+func (s *stepStream) polled() bool {
+	return false
+}
+
+func (s *stepStream) close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+// flushRecorder is a http.ResponseWriter, which signals every flush.
+type flushRecorder struct {
+	header  http.Header
+	buf     bytes.Buffer
+	flushed chan struct{}
+}
+
+func (w *flushRecorder) Header() http.Header         { return w.header }
+func (w *flushRecorder) WriteHeader(int)             {}
+func (w *flushRecorder) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *flushRecorder) Flush()                      { w.flushed <- struct{}{} }
+
+func TestVideoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	tcs := []struct {
+		name  string
+		query string
+		// bounds are the bounds of the encoded frames.
+		bounds image.Rectangle
+	}{
+		{"captured", "", image.Rect(0, 0, 64, 64)},
+		{"transformed", "crop=0,0,64,32&rotate=90&depth=4", image.Rect(0, 0, 32, 64)},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			const warmup, frames = 5, 50
+			src := stepSource{make(chan uint8)}
+			h := &handler{capture: newCapture(src, 0, time.Second), stripes: 2}
+			w := &flushRecorder{header: make(http.Header), flushed: make(chan struct{})}
+			// The output must not grow the buffer while measuring.
+			w.buf.Grow(1 << 20)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := httptest.NewRequest("GET", "/video?"+tc.query, nil).WithContext(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h.serveVideo(w, r)
+			}()
+
+			// Frames are read, published, transformed, encoded and
+			// written one at a time. Their value changes by one
+			// 4-bit level each.
+			const dv = 0x11
+			var v uint8
+			timeout := time.NewTimer(10 * time.Second)
+			defer timeout.Stop()
+			step := func() {
+				v += dv
+				src.next <- v
+				select {
+				case <-w.flushed:
+				case <-timeout.C:
+					t.Fatal("frame wasn't written")
+				}
+			}
+			for i := 0; i < warmup; i++ {
+				step()
+			}
+			defer debug.SetGCPercent(debug.SetGCPercent(-1))
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < frames; i++ {
+				step()
+			}
+			runtime.ReadMemStats(&after)
+			// Like testing.AllocsPerRun, the average is rounded down,
+			// as the runtime occasionally allocates on its own, e.g.
+			// for caching type assertions.
+			if n := (after.Mallocs - before.Mallocs) / frames; n != 0 {
+				t.Errorf("streaming frames did %d allocations per frame, want 0", n)
+			}
+			cancel()
+			go func() {
+				for range w.flushed {
+				}
+			}()
+			<-done
+
+			// Every part is a PNG of a frame, in order. Frames may be
+			// repeated, if the test was too slow.
+			mt, params, err := mime.ParseMediaType(w.header.Get("Content-Type"))
+			if err != nil || mt != "multipart/x-mixed-replace" {
+				t.Fatalf("Content-Type = %q", w.header.Get("Content-Type"))
+			}
+			// The response was cut off, so add the final boundary.
+			w.buf.WriteString("\r\n--" + params["boundary"] + "--\r\n")
+			mr := multipart.NewReader(&w.buf, params["boundary"])
+			var last uint8
+			for {
+				p, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n, _ := strconv.Atoi(p.Header.Get("Content-Length")); n != len(b) {
+					t.Errorf("Content-Length = %q, want %d", p.Header.Get("Content-Length"), len(b))
+				}
+				m, err := png.Decode(bytes.NewReader(b))
+				if err != nil {
+					t.Fatalf("part isn't a PNG: %v", err)
+				}
+				if m.Bounds() != tc.bounds {
+					t.Fatalf("part has bounds %v, want %v", m.Bounds(), tc.bounds)
+				}
+				y, _, _, _ := m.At(0, 0).RGBA()
+				got := uint8(y >> 8)
+				if tc.query == "" && got != last && got != last+dv {
+					t.Errorf("part shows frame %d after %d", got, last)
+				}
+				last = got
+			}
+			if tc.query == "" && last != v {
+				t.Errorf("last part shows frame %d, want %d", last, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// A transform is applied to frames before they are encoded, as requested by
+// the crop, rotate, scale and depth query parameters. The zero value leaves
+// frames unchanged.
+type transform struct {
+	// crop is the region of the frame to keep, in the coordinates of the
+	// original frame. It is applied first. An empty rectangle keeps the
+	// whole frame.
+	crop image.Rectangle
+	// rotate is the clockwise rotation in degrees. It is one of 0, 90, 180
+	// and 270.
+	rotate int
+	// scale is the factor the rotated frame is scaled by, in (0, 1). 0
+	// means no scaling.
+	scale float64
+	// depth is the number of bits per pixel of the gray levels the frame is
+	// reduced to last. It is one of 1, 2, 4 and 8, or 0 to keep the format
+	// of the frame. Reduced frames are *image.Gray for 8 bits and
+	// *image.Paletted otherwise, which makes for much smaller PNGs.
+	depth int
+}
+
+// errCropOutside is returned to clients whose crop doesn't overlap the screen.
+// The size of the screen isn't known while parsing the request, so it is only
+// detected by the empty image of the first frame.
+var errCropOutside = errors.New("crop is outside of the screen")
+
+// parseTransform parses the optional crop, rotate, scale and depth query
+// parameters of r. crop is given as x,y,width,height.
+func parseTransform(r *http.Request) (transform, error) {
+	q := r.URL.Query()
+	var t transform
+	if s := q.Get("crop"); s != "" {
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(s, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil || x < 0 || y < 0 || w <= 0 || h <= 0 {
+			return t, fmt.Errorf("invalid crop %q, want x,y,width,height", s)
+		}
+		t.crop = image.Rect(x, y, x+w, y+h)
+	}
+	if s := q.Get("rotate"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n%90 != 0 {
+			return t, fmt.Errorf("invalid rotate %q, want a multiple of 90", s)
+		}
+		t.rotate = (n%360 + 360) % 360
+	}
+	if s := q.Get("scale"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(f > 0 && f <= 1) {
+			return t, fmt.Errorf("invalid scale %q, want a number in (0, 1]", s)
+		}
+		if f < 1 {
+			t.scale = f
+		}
+	}
+	if s := q.Get("depth"); s != "" {
+		switch n, _ := strconv.Atoi(s); n {
+		case 1, 2, 4, 8:
+			t.depth = n
+		default:
+			return t, fmt.Errorf("invalid depth %q, want 1, 2, 4 or 8", s)
+		}
+	}
+	return t, nil
+}
+
+// identity returns whether t leaves frames unchanged.
+func (t transform) identity() bool {
+	return t.geometric() && t.depth == 0
+}
+
+// geometric returns whether t leaves the geometry of frames unchanged.
+func (t transform) geometric() bool {
+	return t.crop.Empty() && t.rotate == 0 && t.scale == 0
+}
+
+// apply returns im, which must be a frame image, with t applied. The result
+// is written to dst, if it has the right type and bounds, or to a new image
+// otherwise. If t changes both the geometry and the depth, the intermediate
+// image is written to *tmp in the same way, if tmp is not nil.
+func (t transform) apply(dst, im image.Image, tmp *image.Image) image.Image {
+	if t.depth == 0 {
+		return t.applyGeometry(dst, im)
+	}
+	if !t.geometric() {
+		var buf image.Image
+		if tmp == nil {
+			tmp = &buf
+		}
+		*tmp = t.applyGeometry(*tmp, im)
+		im = *tmp
+	}
+	return reduceDepth(dst, im, t.depth)
+}
+
+// applyGeometry crops, rotates and scales im. When scaling down, every pixel
+// is the average of the pixels it covers, except for paletted images, which
+// are sampled.
+func (t transform) applyGeometry(dst, im image.Image) image.Image {
+	r := im.Bounds()
+	if !t.crop.Empty() {
+		r = t.crop.Intersect(r)
+	}
+	// w and h are the size after rotation.
+	w, h := r.Dx(), r.Dy()
+	if t.rotate == 90 || t.rotate == 270 {
+		w, h = h, w
+	}
+	dw, dh := w, h
+	if t.scale != 0 {
+		dw = int(math.Max(1, math.Round(float64(w)*t.scale)))
+		dh = int(math.Max(1, math.Round(float64(h)*t.scale)))
+	}
+	if r.Empty() {
+		dw, dh = 0, 0
+	}
+
+	spix, sstride, bpp := pixels(im)
+	var pal color.Palette
+	if p, ok := im.(*image.Paletted); ok {
+		pal = p.Palette
+	}
+	if dr := image.Rect(0, 0, dw, dh); dst == nil || dst.Bounds() != dr || !sameFormat(dst, bpp, pal) {
+		dst, _ = newImage(dr, bpp, pal)
+	} else if p, ok := dst.(*image.Paletted); ok {
+		p.Palette = pal
+	}
+	dpix, dstride, _ := pixels(dst)
+	n := bpp / 8
+
+	// offset returns the offset in spix of the pixel at (x, y) of the
+	// rotated image.
+	offset := func(x, y int) int {
+		switch t.rotate {
+		case 90:
+			x, y = y, r.Dy()-1-x
+		case 180:
+			x, y = r.Dx()-1-x, r.Dy()-1-y
+		case 270:
+			x, y = r.Dx()-1-y, x
+		}
+		return (r.Min.Y+y)*sstride + (r.Min.X+x)*n
+	}
+
+	switch {
+	case t.rotate == 0 && dw == w && dh == h:
+		for y := 0; y < dh; y++ {
+			copy(dpix[y*dstride:y*dstride+dw*n], spix[offset(0, y):])
+		}
+	case dw == w && dh == h, pal != nil:
+		for y := 0; y < dh; y++ {
+			sy := (2*y + 1) * h / (2 * dh)
+			for x := 0; x < dw; x++ {
+				sx := (2*x + 1) * w / (2 * dw)
+				copy(dpix[y*dstride+x*n:][:n], spix[offset(sx, sy):])
+			}
+		}
+	default:
+		// Gray16 has a single 16-bit big-endian component, the other
+		// types n components of a byte each.
+		comps, size := n, 1
+		if bpp == 16 {
+			comps, size = 1, 2
+		}
+		var sum [4]int
+		for y := 0; y < dh; y++ {
+			y0, y1 := span(y, h, dh)
+			for x := 0; x < dw; x++ {
+				x0, x1 := span(x, w, dw)
+				sum = [4]int{}
+				for sy := y0; sy < y1; sy++ {
+					for sx := x0; sx < x1; sx++ {
+						p := spix[offset(sx, sy):]
+						for c := 0; c < comps; c++ {
+							if size == 2 {
+								sum[c] += int(p[0])<<8 | int(p[1])
+							} else {
+								sum[c] += int(p[c])
+							}
+						}
+					}
+				}
+				cnt := (y1 - y0) * (x1 - x0)
+				d := dpix[y*dstride+x*n:]
+				for c := 0; c < comps; c++ {
+					v := (sum[c] + cnt/2) / cnt
+					if size == 2 {
+						d[0], d[1] = uint8(v>>8), uint8(v)
+					} else {
+						d[c] = uint8(v)
+					}
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// span returns the range of the n source pixels covered by the i-th of m
+// destination pixels.
+func span(i, n, m int) (lo, hi int) {
+	lo, hi = i*n/m, (i+1)*n/m
+	if hi <= lo {
+		hi = lo + 1
+	}
+	return lo, hi
+}
+
+// grayPalettes are the palettes of reduced images with 1, 2 and 4 bits per
+// pixel, indexed by depth. They are shared by all images and must not be
+// modified.
+var grayPalettes = func() (p [5]color.Palette) {
+	for _, depth := range []int{1, 2, 4} {
+		pal := make(color.Palette, 1<<uint(depth))
+		for i := range pal {
+			pal[i] = color.Gray{uint8(i * 0xff / (len(pal) - 1))}
+		}
+		p[depth] = pal
+	}
+	return p
+}()
+
+// reduceDepth converts im, which must be a frame image, to gray levels with
+// the given number of bits per pixel, reusing dst if possible.
+func reduceDepth(dst, im image.Image, depth int) image.Image {
+	r := im.Bounds()
+	var pal color.Palette
+	if depth < 8 {
+		pal = grayPalettes[depth]
+	}
+	if dst == nil || dst.Bounds() != r || !sameFormat(dst, 8, pal) {
+		dst, _ = newImage(r, 8, pal)
+	} else if p, ok := dst.(*image.Paletted); ok {
+		p.Palette = pal
+	}
+	dpix, dstride, _ := pixels(dst)
+
+	// level maps a 16-bit gray value to the reduced level.
+	max := uint32(1)<<uint(depth) - 1
+	level := func(g uint32) uint8 {
+		return uint8((g*max + 0x7fff) / 0xffff)
+	}
+	var lut [256]uint8
+	if p, ok := im.(*image.Paletted); ok {
+		for i, c := range p.Palette {
+			lut[i] = level(uint32(color.Gray16Model.Convert(c).(color.Gray16).Y))
+		}
+	}
+	spix, sstride, _ := pixels(im)
+	for y := 0; y < r.Dy(); y++ {
+		src := spix[y*sstride:]
+		row := dpix[y*dstride : y*dstride+r.Dx()]
+		switch im.(type) {
+		case *image.Gray:
+			for x := range row {
+				row[x] = level(uint32(src[x]) * 0x101)
+			}
+		case *image.Gray16:
+			for x := range row {
+				row[x] = level(uint32(src[2*x])<<8 | uint32(src[2*x+1]))
+			}
+		case *image.RGBA:
+			// The same weights as color.Gray16Model.
+			for x := range row {
+				r, g, b := uint32(src[4*x])*0x101, uint32(src[4*x+1])*0x101, uint32(src[4*x+2])*0x101
+				row[x] = level((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+			}
+		case *image.Paletted:
+			for x := range row {
+				row[x] = lut[src[x]]
+			}
+		}
+	}
+	return dst
+}
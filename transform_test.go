@@ -0,0 +1,383 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testPalette holds the colors used by paletted test images.
+var testPalette = func() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{uint8(i)}
+	}
+	return p
+}()
+
+// testImage returns a w×h image of the same type as typ, whose pixels are
+// given row by row by vals. The components of a pixel differ from each other
+// and the high and low bytes of Gray16 pixels differ, so that mixing them up
+// is detected.
+func testImage(typ image.Image, w, h int, vals ...uint8) image.Image {
+	r := image.Rect(0, 0, w, h)
+	switch typ.(type) {
+	case *image.Gray16:
+		m := image.NewGray16(r)
+		for i, v := range vals {
+			m.SetGray16(i%w, i/w, color.Gray16{uint16(v)<<8 | uint16(0xff-v)})
+		}
+		return m
+	case *image.RGBA:
+		m := image.NewRGBA(r)
+		for i, v := range vals {
+			m.SetRGBA(i%w, i/w, color.RGBA{v, 2 * v, 3 * v, 0xff})
+		}
+		return m
+	case *image.Paletted:
+		m := image.NewPaletted(r, testPalette)
+		copy(m.Pix, vals)
+		return m
+	default:
+		m := image.NewGray(r)
+		copy(m.Pix, vals)
+		return m
+	}
+}
+
+// sameImage returns an error if a and b differ in type, bounds or pixels.
+func sameImage(a, b image.Image) error {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || a.Bounds() != b.Bounds() {
+		return fmt.Errorf("got %T %v, want %T %v", a, a.Bounds(), b, b.Bounds())
+	}
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if ca, cb := a.At(x, y), b.At(x, y); ca != cb {
+				return fmt.Errorf("pixel (%d, %d) = %v, want %v", x, y, ca, cb)
+			}
+		}
+	}
+	return nil
+}
+
+var testFormats = []image.Image{&image.Gray{}, &image.Gray16{}, &image.RGBA{}, &image.Paletted{}}
+
+func TestParseTransform(t *testing.T) {
+	tcs := []struct {
+		query string
+		want  transform
+		err   bool
+	}{
+		{"", transform{}, false},
+		{"crop=1,2,3,4", transform{crop: image.Rect(1, 2, 4, 6)}, false},
+		{"crop=-1,2,3,4", transform{}, true},
+		{"crop=1,2,0,4", transform{}, true},
+		{"crop=1,2,3", transform{}, true},
+		{"rotate=90", transform{rotate: 90}, false},
+		{"rotate=-90", transform{rotate: 270}, false},
+		{"rotate=540", transform{rotate: 180}, false},
+		{"rotate=45", transform{}, true},
+		{"scale=0.5", transform{scale: 0.5}, false},
+		{"scale=1", transform{}, false},
+		{"scale=0", transform{}, true},
+		{"scale=2", transform{}, true},
+		{"depth=4", transform{depth: 4}, false},
+		{"depth=3", transform{}, true},
+		{"crop=0,0,8,8&rotate=270&scale=0.25&depth=1", transform{image.Rect(0, 0, 8, 8), 270, 0.25, 1}, false},
+	}
+	for _, tc := range tcs {
+		got, err := parseTransform(httptest.NewRequest("GET", "/?"+tc.query, nil))
+		if (err != nil) != tc.err {
+			t.Errorf("parseTransform(%q) = _, %v, want error %v", tc.query, err, tc.err)
+		} else if err == nil && got != tc.want {
+			t.Errorf("parseTransform(%q) = %+v, want %+v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestApplyGeometry(t *testing.T) {
+	// The source is 3×2:
+	//   1 2 3
+	//   4 5 6
+	tcs := []struct {
+		name string
+		t    transform
+		w, h int
+		want []uint8
+	}{
+		{"identity", transform{}, 3, 2, []uint8{1, 2, 3, 4, 5, 6}},
+		{"crop", transform{crop: image.Rect(1, 0, 3, 1)}, 2, 1, []uint8{2, 3}},
+		{"crop clamped", transform{crop: image.Rect(2, 1, 10, 10)}, 1, 1, []uint8{6}},
+		{"crop outside", transform{crop: image.Rect(3, 0, 5, 2)}, 0, 0, nil},
+		{"rotate 90", transform{rotate: 90}, 2, 3, []uint8{4, 1, 5, 2, 6, 3}},
+		{"rotate 180", transform{rotate: 180}, 3, 2, []uint8{6, 5, 4, 3, 2, 1}},
+		{"rotate 270", transform{rotate: 270}, 2, 3, []uint8{3, 6, 2, 5, 1, 4}},
+		{"crop and rotate", transform{crop: image.Rect(1, 0, 3, 2), rotate: 90}, 2, 2, []uint8{5, 2, 6, 3}},
+		{"crop clamped and rotate", transform{crop: image.Rect(0, 1, 5, 5), rotate: 270}, 1, 3, []uint8{6, 5, 4}},
+	}
+	for _, typ := range testFormats {
+		for _, tc := range tcs {
+			t.Run(fmt.Sprintf("%T/%s", typ, tc.name), func(t *testing.T) {
+				src := testImage(typ, 3, 2, 1, 2, 3, 4, 5, 6)
+				want := testImage(typ, tc.w, tc.h, tc.want...)
+				got := tc.t.applyGeometry(nil, src)
+				if err := sameImage(got, want); err != nil {
+					t.Fatalf("applyGeometry() %v", err)
+				}
+				// A second call reuses the result.
+				if again := tc.t.applyGeometry(got, src); again != got {
+					t.Errorf("applyGeometry() didn't reuse dst")
+				}
+				if err := sameImage(got, want); err != nil {
+					t.Errorf("applyGeometry() into dst %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	tcs := []struct {
+		name string
+		t    transform
+		typ  image.Image
+		w, h int
+		src  []uint8
+		want image.Image
+	}{
+		{
+			// Every pixel is the rounded average of the 2×2 block it
+			// covers.
+			name: "gray",
+			t:    transform{scale: 0.5},
+			typ:  &image.Gray{},
+			w:    4, h: 2,
+			src:  []uint8{10, 20, 0, 1, 30, 41, 1, 1},
+			want: testImage(&image.Gray{}, 2, 1, 25, 1),
+		},
+		{
+			name: "rgba",
+			t:    transform{scale: 0.5},
+			typ:  &image.RGBA{},
+			w:    2, h: 2,
+			src: []uint8{10, 20, 30, 40},
+			want: &image.RGBA{
+				Pix:    []uint8{25, 50, 75, 0xff},
+				Stride: 4,
+				Rect:   image.Rect(0, 0, 1, 1),
+			},
+		},
+		{
+			// Gray16 is averaged as big-endian 16-bit values, so the
+			// low bytes carry into the high byte. Averaging the bytes
+			// separately or in the wrong order gives 0x02fe or
+			// 0x82fd.
+			name: "gray16",
+			t:    transform{scale: 0.5},
+			typ:  &image.Gray16{},
+			w:    2, h: 1,
+			src: []uint8{1, 2},
+			want: &image.Gray16{
+				// (0x01fe + 0x02fd + 1) / 2 = 0x027e
+				Pix:    []uint8{0x02, 0x7e},
+				Stride: 2,
+				Rect:   image.Rect(0, 0, 1, 1),
+			},
+		},
+		{
+			// Paletted images are sampled from the center of the
+			// block instead of averaged.
+			name: "paletted",
+			t:    transform{scale: 0.5},
+			typ:  &image.Paletted{},
+			w:    4, h: 4,
+			src: []uint8{
+				1, 2, 3, 4,
+				5, 6, 7, 8,
+				9, 10, 11, 12,
+				13, 14, 15, 16,
+			},
+			want: testImage(&image.Paletted{}, 2, 2, 6, 8, 14, 16),
+		},
+		{
+			// 5 × 0.5 rounds to 3; the blocks are [0,1), [1,3) and
+			// [3,5).
+			name: "uneven",
+			t:    transform{scale: 0.5},
+			typ:  &image.Gray{},
+			w:    5, h: 1,
+			src:  []uint8{10, 20, 41, 100, 201},
+			want: testImage(&image.Gray{}, 3, 1, 10, 31, 151),
+		},
+		{
+			name: "at least one pixel",
+			t:    transform{scale: 0.01},
+			typ:  &image.Gray{},
+			w:    4, h: 1,
+			src:  []uint8{1, 2, 3, 4},
+			want: testImage(&image.Gray{}, 1, 1, 3),
+		},
+		{
+			// Scaling applies to the rotated size.
+			name: "rotated",
+			t:    transform{rotate: 90, scale: 0.5},
+			typ:  &image.Gray{},
+			w:    4, h: 2,
+			src:  []uint8{1, 3, 10, 10, 5, 7, 20, 20},
+			want: testImage(&image.Gray{}, 1, 2, 4, 15),
+		},
+		{
+			name: "cropped",
+			t:    transform{crop: image.Rect(2, 0, 4, 2), scale: 0.5},
+			typ:  &image.Gray{},
+			w:    4, h: 2,
+			src:  []uint8{1, 3, 10, 10, 5, 7, 20, 20},
+			want: testImage(&image.Gray{}, 1, 1, 15),
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			src := testImage(tc.typ, tc.w, tc.h, tc.src...)
+			if err := sameImage(tc.t.applyGeometry(nil, src), tc.want); err != nil {
+				t.Errorf("applyGeometry() %v", err)
+			}
+		})
+	}
+}
+
+// grayLevels returns the image reduceDepth should return for a w×h frame with
+// the given levels.
+func grayLevels(depth, w, h int, levels ...uint8) image.Image {
+	r := image.Rect(0, 0, w, h)
+	if depth == 8 {
+		m := image.NewGray(r)
+		copy(m.Pix, levels)
+		return m
+	}
+	pal := make(color.Palette, 1<<uint(depth))
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i * 0xff / (len(pal) - 1))}
+	}
+	m := image.NewPaletted(r, pal)
+	copy(m.Pix, levels)
+	return m
+}
+
+func TestReduceDepth(t *testing.T) {
+	gray16 := func(vals ...uint16) image.Image {
+		m := image.NewGray16(image.Rect(0, 0, len(vals), 1))
+		for i, v := range vals {
+			m.SetGray16(i, 0, color.Gray16{v})
+		}
+		return m
+	}
+	rgba := func(cs ...color.RGBA) image.Image {
+		m := image.NewRGBA(image.Rect(0, 0, len(cs), 1))
+		for i, c := range cs {
+			m.SetRGBA(i, 0, c)
+		}
+		return m
+	}
+	tcs := []struct {
+		name  string
+		depth int
+		src   image.Image
+		want  []uint8
+	}{
+		{"1 bit", 1, gray16(0, 0x7fff, 0x8000, 0xffff), []uint8{0, 0, 1, 1}},
+		{"2 bits", 2, gray16(0, 0x2aaa, 0x2aab, 0x5555, 0xaaaa, 0xffff), []uint8{0, 0, 1, 1, 2, 3}},
+		{"4 bits", 4, gray16(0, 0x1111, 0x8888, 0xeeee, 0xffff), []uint8{0, 1, 8, 14, 15}},
+		{"8 bits", 8, gray16(0, 0x1234, 0x8100, 0x8101, 0xffff), []uint8{0, 0x12, 0x80, 0x81, 0xff}},
+		{"gray 1 bit", 1, testImage(&image.Gray{}, 4, 1, 0, 0x7f, 0x80, 0xff), []uint8{0, 0, 1, 1}},
+		{"gray 4 bits", 4, testImage(&image.Gray{}, 4, 1, 0, 0x11, 0x88, 0xff), []uint8{0, 1, 8, 15}},
+		{"gray 8 bits", 8, testImage(&image.Gray{}, 3, 1, 0, 0x42, 0xff), []uint8{0, 0x42, 0xff}},
+		{
+			// The same weights as color.GrayModel.
+			"rgba 8 bits", 8,
+			rgba(color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0xff, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}),
+			[]uint8{76, 150, 29, 0xff},
+		},
+		{
+			"rgba 2 bits", 2,
+			rgba(color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0xff, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}),
+			[]uint8{1, 2, 0, 3},
+		},
+		// Paletted frames are mapped through their palette, whose
+		// entries are the index as gray.
+		{"paletted 2 bits", 2, testImage(&image.Paletted{}, 4, 1, 0, 0x55, 0xaa, 0xff), []uint8{0, 1, 2, 3}},
+		{"paletted 8 bits", 8, testImage(&image.Paletted{}, 3, 1, 0, 0x42, 0xff), []uint8{0, 0x42, 0xff}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			want := grayLevels(tc.depth, tc.src.Bounds().Dx(), tc.src.Bounds().Dy(), tc.want...)
+			got := reduceDepth(nil, tc.src, tc.depth)
+			if err := sameImage(got, want); err != nil {
+				t.Fatalf("reduceDepth(%d) %v", tc.depth, err)
+			}
+			if p, ok := got.(*image.Paletted); ok && len(p.Palette) != 1<<uint(tc.depth) {
+				t.Errorf("reduceDepth(%d) has %d colors, want %d", tc.depth, len(p.Palette), 1<<uint(tc.depth))
+			}
+			if again := reduceDepth(got, tc.src, tc.depth); again != got {
+				t.Errorf("reduceDepth(%d) didn't reuse dst", tc.depth)
+			}
+		})
+	}
+}
+
+func TestReduceDepthReuse(t *testing.T) {
+	src := testImage(&image.Gray{}, 4, 1, 0, 0x55, 0xaa, 0xff)
+	// A paletted dst of another depth is reused with the new palette.
+	dst := reduceDepth(nil, src, 1)
+	got := reduceDepth(dst, src, 2)
+	if got != dst {
+		t.Errorf("reduceDepth(2) didn't reuse the 1 bit dst")
+	}
+	if err := sameImage(got, grayLevels(2, 4, 1, 0, 1, 2, 3)); err != nil {
+		t.Errorf("reduceDepth(2) into 1 bit dst %v", err)
+	}
+	// A Gray dst can't hold a paletted image.
+	dst = reduceDepth(nil, src, 8)
+	if got := reduceDepth(dst, src, 4); got == dst {
+		t.Errorf("reduceDepth(4) reused the 8 bit dst")
+	}
+}
+
+func TestApplyDepth(t *testing.T) {
+	// Geometry is applied before the depth is reduced.
+	src := testImage(&image.Gray{}, 3, 2, 0, 0x10, 0x20, 0x30, 0xee, 0xff)
+	tr := transform{crop: image.Rect(1, 0, 3, 2), rotate: 180, depth: 1}
+	want := grayLevels(1, 2, 2, 1, 1, 0, 0)
+	var tmp image.Image
+	got := tr.apply(nil, src, &tmp)
+	if err := sameImage(got, want); err != nil {
+		t.Fatalf("apply() %v", err)
+	}
+	if tmp == nil {
+		t.Fatalf("apply() didn't keep the intermediate image")
+	}
+	first := tmp
+	if again := tr.apply(got, src, &tmp); again != got || tmp != first {
+		t.Errorf("apply() didn't reuse dst and the intermediate image")
+	}
+	if err := sameImage(got, want); err != nil {
+		t.Errorf("apply() into dst %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Merovius/srvfb/internal/diff"
+	"github.com/Merovius/srvfb/internal/rfb"
+)
+
+const (
+	// vncScrollArea is the minimum size of a changed region, for which we
+	// check whether it was scrolled, to send it using CopyRect.
+	vncScrollArea = 64 * 64
+	// vncMaxScroll is the maximum scroll distance detected.
+	vncMaxScroll = 256
+)
+
+// serveVNC serves the screen read-only to VNC clients connecting to l.
+func (h *handler) serveVNC(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h.serveVNCConn(c)
+	}
+}
+
+func (h *handler) serveVNCConn(c net.Conn) {
+	defer c.Close()
+	log.Println("VNC", c.RemoteAddr())
+
+	if err := rfb.ServerHandshake(c); err != nil {
+		log.Println(err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := h.capture.subscribe(0, transform{})
+	defer sub.close()
+	latest, err := sub.next(ctx)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(c)
+	b := latest.im.Bounds()
+	if err := rfb.WriteServerInit(w, b.Dx(), b.Dy(), rfb.DefaultFormat, "srvfb"); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := w.Flush(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	msgs := make(chan interface{})
+	go func() {
+		defer cancel()
+		for {
+			m, err := rfb.ReadClientMessage(c)
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.Println(err)
+				}
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	frames := make(chan *frame)
+	go func() {
+		defer cancel()
+		for {
+			f, err := sub.next(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case frames <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		enc = rfb.NewEncoder()
+		// sent is the frame the framebuffer of the client currently shows.
+		sent *frame
+		req  *rfb.FramebufferUpdateRequest
+	)
+	for {
+		select {
+		case m := <-msgs:
+			switch m := m.(type) {
+			case *rfb.SetPixelFormat:
+				if err := m.Format.Check(); err != nil {
+					log.Println(err)
+					return
+				}
+				enc.SetPixelFormat(m.Format)
+				// The client can't reuse pixels in the old format.
+				sent = nil
+			case *rfb.SetEncodings:
+				enc.SetEncodings(m.Encodings)
+			case *rfb.FramebufferUpdateRequest:
+				req = m
+			}
+		case latest = <-frames:
+		case <-ctx.Done():
+			return
+		}
+		if req == nil {
+			continue
+		}
+
+		resize := sent != nil && sent.im.Bounds() != latest.im.Bounds()
+		if resize {
+			if !enc.Supports(rfb.EncDesktopSize) {
+				log.Println("VNC client doesn't support changing the screen size")
+				return
+			}
+			sent = nil
+		}
+		rects := vncRects(enc, sent, latest, req)
+		if req.Incremental && !resize && len(rects) == 0 {
+			continue
+		}
+		if err := enc.WriteUpdate(w, latest.im, resize, rects); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := w.Flush(); err != nil {
+			log.Println(err)
+			return
+		}
+		sent, req = latest, nil
+	}
+}
+
+// vncRects returns the rectangles of an update, answering req and bringing
+// the framebuffer of the client from sent to cur. Changes outside the
+// requested region are included, as the client would otherwise miss them.
+func vncRects(enc *rfb.Encoder, sent, cur *frame, req *rfb.FramebufferUpdateRequest) []rfb.Rect {
+	var full image.Rectangle
+	if !req.Incremental {
+		full = image.Rect(int(req.X), int(req.Y), int(req.X)+int(req.Width), int(req.Y)+int(req.Height)).Intersect(cur.im.Bounds())
+	}
+	// Rectangles sent with CopyRect must come first, so their source is
+	// still the content of sent. The source must also not overlap the
+	// destination of a previous copy.
+	var copies, rects []rfb.Rect
+	if !full.Empty() {
+		rects = append(rects, rfb.Rect{Rectangle: full})
+	}
+	for _, r := range cur.changes(sent) {
+		if r.In(full) {
+			continue
+		}
+		if sent != nil && full.Empty() && enc.Supports(rfb.EncCopyRect) && r.Dx()*r.Dy() >= vncScrollArea {
+			if src, ok := diff.Moved(sent.im, cur.im, r, vncMaxScroll); ok && !overlaps(copies, r.Sub(r.Min).Add(src)) {
+				copies = append(copies, rfb.Rect{Rectangle: r, Copy: true, Src: src})
+				continue
+			}
+		}
+		rects = append(rects, rfb.Rect{Rectangle: r})
+	}
+	return append(copies, rects...)
+}
+
+// overlaps returns whether r overlaps any of rects.
+func overlaps(rects []rfb.Rect, r image.Rectangle) bool {
+	for _, rr := range rects {
+		if rr.Overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// vncSource reads frames from a VNC server. Every stream opens a new
+// connection.
+type vncSource struct {
+	addr     string
+	password string
+}
+
+// newVNCSource parses a URL of the form vnc://[:password@]host[:port]. If
+// passwordFile is not empty, the password is read from that file instead,
+// ignoring a trailing newline.
+func newVNCSource(s, passwordFile string) (vncSource, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return vncSource{}, err
+	}
+	if u.Scheme != "vnc" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return vncSource{}, fmt.Errorf("invalid VNC URL %q, want vnc://[:password@]host[:port]", s)
+	}
+	src := vncSource{addr: u.Host}
+	if u.Port() == "" {
+		src.addr = net.JoinHostPort(u.Hostname(), "5900")
+	}
+	if u.User != nil {
+		src.password, _ = u.User.Password()
+	}
+	if passwordFile != "" {
+		if u.User != nil {
+			return vncSource{}, errors.New("VNC password given both in the URL and in a file")
+		}
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return vncSource{}, err
+		}
+		src.password = strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	}
+	return src, nil
+}
+
+func (s vncSource) open() (stream, error) {
+	c, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	si, err := rfb.ClientHandshake(c, s.password)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	log.Printf("Connected to VNC server %q (%dx%d)", si.Name, si.Width, si.Height)
+	vs := &vncStream{
+		c:   c,
+		r:   bufio.NewReader(c),
+		dec: rfb.NewDecoder(rfb.DefaultFormat),
+		fb:  image.NewRGBA(image.Rect(0, 0, si.Width, si.Height)),
+	}
+	if err = rfb.WriteSetPixelFormat(c, rfb.DefaultFormat); err == nil {
+		if err = rfb.WriteSetEncodings(c, vs.dec.Encodings()); err == nil {
+			err = vs.request(false)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return vs, nil
+}
+
+type vncStream struct {
+	c   net.Conn
+	r   *bufio.Reader
+	dec *rfb.Decoder
+	// fb is the framebuffer of the server, as far as we know it.
+	fb *image.RGBA
+}
+
+// request requests an update of the whole framebuffer.
+func (s *vncStream) request(incremental bool) error {
+	return rfb.WriteFramebufferUpdateRequest(s.c, rfb.FramebufferUpdateRequest{
+		Incremental: incremental,
+		Width:       uint16(s.fb.Rect.Dx()),
+		Height:      uint16(s.fb.Rect.Dy()),
+	})
+}
+
+func (s *vncStream) readImage(im image.Image) (image.Image, error) {
+	var err error
+	if s.fb, err = s.dec.ReadUpdate(s.r, s.fb); err != nil {
+		return nil, err
+	}
+	// Request the next update right away, so it can be transmitted while
+	// the frame is processed.
+	if err = s.request(true); err != nil {
+		return nil, err
+	}
+	return copyImage(im, s.fb), nil
+}
+
+func (s *vncStream) polled() bool {
+	return false
+}
+
+func (s *vncStream) close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Merovius/srvfb/internal/rfb"
+)
+
+func TestVNCRectsCopy(t *testing.T) {
+	// All rows of sent differ, so scrolled regions are found at exactly one
+	// offset.
+	b := image.Rect(0, 0, 128, 512)
+	sent := image.NewGray16(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sent.SetGray16(x, y, color.Gray16{uint16(y<<8 | x<<1)})
+		}
+	}
+	cur := image.NewGray16(b)
+	copy(cur.Pix, sent.Pix)
+	// The top half scrolls up by 40 rows.
+	copy(cur.Pix[cur.PixOffset(0, 0):cur.PixOffset(0, 256)], sent.Pix[sent.PixOffset(0, 40):])
+	// Rows 320 to 448 show rows 200 to 328, which the first copy overwrites,
+	// so they must not be copied.
+	copy(cur.Pix[cur.PixOffset(0, 320):cur.PixOffset(0, 448)], sent.Pix[sent.PixOffset(0, 200):])
+	// Some noise outside of the scrolled regions.
+	cur.SetGray16(5, 500, color.Gray16{0xffff})
+
+	enc := rfb.NewEncoder()
+	dec := rfb.NewDecoder(rfb.DefaultFormat)
+	enc.SetEncodings(dec.Encodings())
+	var (
+		conn   bytes.Buffer
+		client *image.RGBA
+	)
+	// The client shows sent.
+	if err := enc.WriteUpdate(&conn, sent, true, []rfb.Rect{{Rectangle: b}}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := dec.ReadUpdate(&conn, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf, cf := &frame{seq: 1, im: sent}, &frame{seq: 3, im: cur}
+	req := &rfb.FramebufferUpdateRequest{Incremental: true, Width: uint16(b.Dx()), Height: uint16(b.Dy())}
+	rects := vncRects(enc, sf, cf, req)
+
+	var copies []rfb.Rect
+	for i, r := range rects {
+		if !r.Copy {
+			continue
+		}
+		if len(copies) != i {
+			t.Errorf("CopyRect %v follows other rectangles", r.Rectangle)
+		}
+		copies = append(copies, r)
+	}
+	wantCopy := rfb.Rect{Rectangle: image.Rect(0, 0, 128, 256), Copy: true, Src: image.Pt(0, 40)}
+	if len(copies) != 1 || copies[0] != wantCopy {
+		t.Errorf("vncRects() copies %v, want only %v", copies, wantCopy)
+	}
+
+	if err := enc.WriteUpdate(&conn, cur, false, rects); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = dec.ReadUpdate(&conn, client); err != nil {
+		t.Fatal(err)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if got, want := client.RGBAAt(x, y), color.RGBAModel.Convert(cur.At(x, y)); got != want {
+				t.Fatalf("client shows %v at (%d, %d), want %v", got, x, y, want)
+			}
+		}
+	}
+}
+
+func TestNewVNCSource(t *testing.T) {
+	pwFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(pwFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		url     string
+		pwFile  string
+		want    vncSource
+		wantErr bool
+	}{
+		{url: "vnc://host", want: vncSource{addr: "host:5900"}},
+		{url: "vnc://host:5901/", want: vncSource{addr: "host:5901"}},
+		{url: "vnc://:secret@host", want: vncSource{addr: "host:5900", password: "secret"}},
+		{url: "vnc://[::1]", want: vncSource{addr: "[::1]:5900"}},
+		{url: "vnc://host", pwFile: pwFile, want: vncSource{addr: "host:5900", password: "secret"}},
+		{url: "vnc://:other@host", pwFile: pwFile, wantErr: true},
+		{url: "vnc://host", pwFile: filepath.Join(t.TempDir(), "missing"), wantErr: true},
+		{url: "http://host", wantErr: true},
+		{url: "vnc://host/path", wantErr: true},
+	}
+	for _, tc := range tcs {
+		got, err := newVNCSource(tc.url, tc.pwFile)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("newVNCSource(%q, %q) = %+v, want error", tc.url, tc.pwFile, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("newVNCSource(%q, %q) = %+v, %v, want %+v, <nil>", tc.url, tc.pwFile, got, err, tc.want)
+		}
+	}
+}
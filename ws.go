@@ -0,0 +1,268 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Merovius/srvfb/internal/diff"
+	"github.com/Merovius/srvfb/internal/png"
+	"github.com/Merovius/srvfb/internal/websocket"
+)
+
+// wsMaxRects is the maximum number of rectangles in a message. Frames with
+// more changed regions are sent as a single rectangle containing all of them.
+const wsMaxRects = 64
+
+// wsHeader is the header of a message sent by /ws. Every message is a single
+// frame and is followed by Rects rectangles, each consisting of a wsRect and
+// a PNG image of its content. Only the regions changed since the previous
+// message are sent. All integers are big-endian.
+type wsHeader struct {
+	Seq uint64
+	// Time is the capture time in milliseconds since the epoch.
+	Time   int64
+	Width  uint32
+	Height uint32
+	Rects  uint32
+}
+
+type wsRect struct {
+	X, Y, Width, Height uint32
+	// Length is the size of the PNG image following the rectangle.
+	Length uint32
+}
+
+// serveWebSocket streams frames as binary WebSocket messages.
+func (h *handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	fps, err := parseFPS(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := parseTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer c.Close()
+
+	// The request context isn't canceled for hijacked connections, so we
+	// notice the client going away by reading from the connection.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				if err != io.EOF {
+					log.Println(err)
+				}
+				return
+			}
+		}
+	}()
+
+	sub := h.capture.subscribe(fps, t)
+	defer sub.close()
+	enc := h.pngEncoder(png.BestSpeed)
+	var (
+		sent *frame
+		buf  = new(bytes.Buffer)
+		pbuf = new(bytes.Buffer)
+	)
+	defer func() { sent.release() }()
+	for {
+		f, err := sub.next(ctx)
+		if err != nil {
+			return
+		}
+		rects := f.changes(sent)
+		if len(rects) > wsMaxRects {
+			rects = []image.Rectangle{diff.Bounds(rects)}
+		}
+		b := f.im.Bounds()
+		buf.Reset()
+		binary.Write(buf, binary.BigEndian, wsHeader{
+			Seq:    f.seq,
+			Time:   f.time.UnixNano() / 1e6,
+			Width:  uint32(b.Dx()),
+			Height: uint32(b.Dy()),
+			Rects:  uint32(len(rects)),
+		})
+		for _, rr := range rects {
+			pbuf.Reset()
+			m := f.im.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(rr)
+			if err := enc.Encode(pbuf, m); err != nil {
+				log.Println(err)
+				return
+			}
+			binary.Write(buf, binary.BigEndian, wsRect{
+				X:      uint32(rr.Min.X),
+				Y:      uint32(rr.Min.Y),
+				Width:  uint32(rr.Dx()),
+				Height: uint32(rr.Dy()),
+				Length: uint32(pbuf.Len()),
+			})
+			buf.Write(pbuf.Bytes())
+		}
+		if err := c.WriteBinary(buf.Bytes()); err != nil {
+			f.release()
+			return
+		}
+		sent.release()
+		sent = f
+	}
+}
+
+// serveCanvas serves an alternative to the index page, which paints the
+// frames received from /ws onto a canvas.
+func (h *handler) serveCanvas(w http.ResponseWriter, r *http.Request) {
+	const idx = `<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>srvfb</title>
+		<style>
+			body {
+				width: 100%;
+				height: 100%;
+				margin: 0;
+				background-color: black;
+			}
+
+			#stream {
+				position: absolute;
+				top: 0;
+				left: 0;
+				object-fit: contain;
+				transform: rotate(0deg);
+			}
+
+			#info {
+				position: fixed;
+				top: 0;
+				left: 0;
+				padding: 0.2em 0.5em;
+				font-family: monospace;
+				color: white;
+				background-color: rgba(0, 0, 0, 0.5);
+			}
+		</style>
+
+		<script>
+			document.onreadystatechange = function(e) {
+				if (document.readyState !== "complete") {
+					return;
+				}
+				let rotate = 0;
+				let stream = document.querySelector('#stream');
+				let info = document.querySelector('#info');
+				let ctx = stream.getContext('2d');
+				let resize = function() {
+					let [w, h] = [stream.width, stream.height];
+					let [nt, nl, nh, nw] = [0,0,0,0];
+					if ((w > h) == (rotate%2)) {
+						nh = window.innerHeight;
+						nw = window.innerWidth;
+					} else {
+						nh = window.innerWidth;
+						nw = window.innerHeight;
+					}
+					if (rotate%2) {
+						nl = (nh-nw)/2;
+						nt = (nw-nh)/2;
+					}
+					stream.style.height = nh + "px";
+					stream.style.width = nw + "px";
+					stream.style.top = nt + "px";
+					stream.style.left = nl + "px";
+					stream.style.transform = 'rotate('+rotate*90+'deg)';
+				};
+				resize();
+				stream.onclick = function(ev) {
+					rotate = (rotate+1)%4;
+					resize();
+				};
+				window.onresize = resize;
+
+				// Times at which the frames of the last second were painted.
+				let painted = [];
+				let paint = async function(buf) {
+					let d = new DataView(buf);
+					let seq = d.getBigUint64(0);
+					let time = Number(d.getBigInt64(8));
+					let [w, h, n] = [d.getUint32(16), d.getUint32(20), d.getUint32(24)];
+					if (stream.width != w || stream.height != h) {
+						stream.width = w;
+						stream.height = h;
+						resize();
+					}
+					let rects = [];
+					for (let i = 0, off = 28; i < n; i++) {
+						let [x, y, len] = [d.getUint32(off), d.getUint32(off+4), d.getUint32(off+16)];
+						let blob = new Blob([new Uint8Array(buf, off+20, len)], {type: "image/png"});
+						rects.push({x: x, y: y, img: createImageBitmap(blob)});
+						off += 20+len;
+					}
+					for (let r of rects) {
+						ctx.drawImage(await r.img, r.x, r.y);
+					}
+					let now = performance.now();
+					painted.push(now);
+					while (painted[0] < now-1000) {
+						painted.shift();
+					}
+					info.textContent = painted.length + " fps, " + (Date.now()-time) + " ms latency, frame " + seq;
+				};
+
+				let connect = function() {
+					let proto = location.protocol === "https:" ? "wss:" : "ws:";
+					let ws = new WebSocket(proto + "//" + location.host + "/ws" + location.search);
+					ws.binaryType = "arraybuffer";
+					// Messages must be painted in order.
+					let queue = Promise.resolve();
+					ws.onmessage = function(ev) {
+						queue = queue.then(() => paint(ev.data));
+					};
+					ws.onclose = function(ev) {
+						info.textContent = "disconnected";
+						setTimeout(connect, 1000);
+					};
+				};
+				connect();
+			};
+		</script>
+	</head>
+	<body>
+		<canvas id="stream"></canvas>
+		<div id="info"></div>
+	</body>
+</html>`
+	io.WriteString(w, idx)
+}